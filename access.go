@@ -93,15 +93,27 @@ func setAccessKeyCookies(w http.ResponseWriter, siteURL, fileName, value string,
 
 	cookie.Path = path.Join(u.Path, Config.selifPath, fileName)
 	http.SetCookie(w, &cookie)
+
+	cookie.Path = path.Join(u.Path, Config.selifPath, "thumb", fileName)
+	http.SetCookie(w, &cookie)
 }
 
 func fileAccessHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	fileName := c.URLParams["name"]
+
 	if !Config.noDirectAgents && cliUserAgentRe.MatchString(r.Header.Get("User-Agent")) && !strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		fileServeHandler(c, w, r)
-		return
+		// Links redirect command line clients too, instead of serving them
+		// the URL they lead to
+		if metadata, err := storageBackend.Head(fileName); err != nil || !isLink(metadata) {
+			fileServeHandler(c, w, r)
+			return
+		}
 	}
 
-	fileName := c.URLParams["name"]
+	if isReservedKey(fileName) {
+		notFoundHandler(c, w, r)
+		return
+	}
 
 	metadata, err := checkFile(fileName)
 	if err == backends.NotFoundErr {
@@ -143,5 +155,42 @@ func fileAccessHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		setAccessKeyCookies(w, getSiteURL(r), fileName, metadata.AccessKey, expiry)
 	}
 
+	if isLink(metadata) {
+		linkHandler(c, w, r, fileName, metadata)
+		return
+	}
+
+	if metadata.MaxDownloads > 0 && !strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		// Link previews fetch pages like browsers do, so files that can
+		// only be downloaded a few times are served once a person confirms
+		if r.PostFormValue("download") == "" {
+			_ = renderTemplate(Templates["download.html"], pongo2.Context{
+				"filename":  fileName,
+				"remaining": metadata.MaxDownloads - metadata.Downloads,
+			}, r, w)
+			return
+		}
+
+		if isEncryptedPaste(metadata) {
+			fileDisplayHandler(c, w, r, fileName, metadata)
+			return
+		}
+
+		fileServeHandler(c, w, r)
+		return
+	}
+
 	fileDisplayHandler(c, w, r, fileName, metadata)
 }
+
+// Whether a request is a POST to the page of a file, which confirms the
+// download of a file limited to a few downloads or gives its access key.
+// It only reads the file, like a GET to the page does.
+func isFileAccessPost(r *http.Request) bool {
+	if r.Method != "POST" {
+		return false
+	}
+
+	name, found := strings.CutPrefix(r.URL.Path, Config.sitePath)
+	return found && name != "" && name != "upload" && !strings.Contains(name, "/")
+}
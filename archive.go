@@ -0,0 +1,226 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/zenazn/goji/web"
+)
+
+// Formats several files can be downloaded in at once
+const (
+	archiveZip   = "zip"
+	archiveTarGz = "tar.gz"
+)
+
+var archiveMimetypes = map[string]string{
+	archiveZip:   "application/zip",
+	archiveTarGz: "application/gzip",
+}
+
+// Mimetypes worth deflating in zip archives, other files are stored as is
+// since most of them are compressed already
+var archiveCompressibleMimetypes = []string{
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type archiveFile struct {
+	name     string
+	metadata backends.Metadata
+}
+
+// Download the files of a collection as an archive. Like in the collection
+// listing, files that were deleted or expired are left out.
+func collectionArchiveHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	id := c.URLParams["id"]
+
+	collection, _, err := readCollection(id)
+	if err == errCollectionNotFound {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt collection.")
+		return
+	}
+
+	var files []archiveFile
+	for _, filename := range collection.Files {
+		metadata, err := checkFile(filename)
+		if err != nil {
+			continue
+		}
+		files = append(files, archiveFile{filename, metadata})
+	}
+
+	serveArchive(c, w, r, id, files)
+}
+
+// Download the files given as file parameters of the request as an archive
+func archiveHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	var files []archiveFile
+	seen := make(map[string]bool)
+	for _, filename := range r.URL.Query()["file"] {
+		if seen[filename] {
+			continue
+		}
+		seen[filename] = true
+
+		if isReservedKey(filename) {
+			notFoundHandler(c, w, r)
+			return
+		}
+
+		metadata, err := checkFile(filename)
+		if err == backends.NotFoundErr {
+			notFoundHandler(c, w, r)
+			return
+		} else if err != nil {
+			oopsHandler(c, w, r, RespAUTO, "Corrupt metadata.")
+			return
+		}
+		files = append(files, archiveFile{filename, metadata})
+	}
+
+	if len(files) == 0 {
+		badRequestHandler(c, w, r, RespAUTO, "No files to download.")
+		return
+	}
+
+	serveArchive(c, w, r, "files", files)
+}
+
+// Stream files as an archive in the format given by the request, reading
+// each one from the storage backend as it gets added, so that nothing but
+// the compression state is held in memory or written to disk. Each file
+// added counts as a download of it.
+func serveArchive(c web.C, w http.ResponseWriter, r *http.Request, name string, files []archiveFile) {
+	format := c.URLParams["format"]
+	mimetype, ok := archiveMimetypes[format]
+	if !ok {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	// Nothing can be refused once the archive is under way, so access keys
+	// are checked for all the files first
+	for _, file := range files {
+		if _, err := checkAccessKey(r, &file.metadata); err != nil {
+			unauthorizedHandler(c, w, r)
+			return
+		}
+	}
+
+	if !Config.disableSecurityHeaders {
+		w.Header().Set(cspHeader, defaultFileCSPOptions.policy)
+		w.Header().Set(rpHeader, defaultFileCSPOptions.referrerPolicy)
+	}
+	w.Header().Set("Content-Type", mimetype)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+"."+format+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.Method == "HEAD" {
+		return
+	}
+
+	var err error
+	switch format {
+	case archiveZip:
+		err = writeZip(w, files)
+	case archiveTarGz:
+		err = writeTarGz(w, files)
+	}
+	if err != nil {
+		// The status was sent with the start of the archive, so the client
+		// can only tell from the archive being cut short
+		log.Printf("Could not stream archive %s.%s: %v", name, format, err)
+	}
+}
+
+func archiveCompressible(mimetype string) bool {
+	if strings.HasPrefix(mimetype, "text/") {
+		return true
+	}
+	for _, m := range archiveCompressibleMimetypes {
+		if mimetype == m {
+			return true
+		}
+	}
+	return false
+}
+
+func writeZip(w io.Writer, files []archiveFile) error {
+	zw := zip.NewWriter(w)
+	modified := time.Now()
+
+	for _, file := range files {
+		header := &zip.FileHeader{
+			Name:     file.name,
+			Method:   zip.Store,
+			Modified: modified,
+		}
+		if archiveCompressible(file.metadata.Mimetype) {
+			header.Method = zip.Deflate
+		}
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+
+		_, reader, err := getDownload(file.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, files []archiveFile) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	modified := time.Now()
+
+	for _, file := range files {
+		metadata, reader, err := getDownload(file.name)
+		if err != nil {
+			return err
+		}
+
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     file.name,
+			Mode:     0644,
+			Size:     metadata.Size,
+			ModTime:  modified,
+		})
+		if err == nil {
+			_, err = io.Copy(tw, reader)
+		}
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	return gw.Close()
+}
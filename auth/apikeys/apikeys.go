@@ -2,14 +2,19 @@ package apikeys
 
 import (
 	"bufio"
-	"encoding/base64"
+	"crypto/subtle"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"golang.org/x/crypto/scrypt"
+	"github.com/dustin/go-humanize"
 
+	"github.com/andreimarcu/linx-server/expiry"
 	"github.com/zenazn/goji/web"
 )
 
@@ -24,19 +29,155 @@ const (
 type AuthOptions struct {
 	AuthFile      string
 	UnauthMethods []string
+	// Requests let through without a key whatever their method, if not nil
+	UnauthRequest func(r *http.Request) bool
 	BasicAuth     bool
 	SiteName      string
 	SitePath      string
 }
 
+// What a key can be used for, which routes require with RequireScope
+type Scope string
+
+const (
+	// Upload files and links, and delete and edit them with their delete
+	// key
+	ScopeUpload Scope = "upload"
+	// Delete any file or collection without its delete key
+	ScopeDeleteAny Scope = "delete-any"
+	// View files and pages of a private instance
+	ScopeReadPrivate Scope = "read-private"
+	// Everything the other scopes allow, and edit any file without its
+	// delete key
+	ScopeAdmin Scope = "admin"
+)
+
+var knownScopes = map[Scope]bool{
+	ScopeUpload:      true,
+	ScopeDeleteAny:   true,
+	ScopeReadPrivate: true,
+	ScopeAdmin:       true,
+}
+
+// Scopes of keys that don't list theirs, which can do what any key could
+// before keys had scopes
+var defaultScopes = []Scope{ScopeUpload, ScopeReadPrivate}
+
+// Key of the web.C environment the key a request was authenticated with is
+// stored under
+const envKey = "apikeys.Key"
+
 type ApiKeysMiddleware struct {
 	successHandler http.Handler
-	authKeys       []string
+	authKeys       []Key
+	cache          *keyCache
 	o              AuthOptions
+	c              *web.C
+}
+
+// An API key, identified by the hash it is stored as, along with its
+// scopes and the limits of what can be uploaded with it. Limits left at
+// their zero value are only those of the server.
+type Key struct {
+	Hash        string
+	Label       string
+	Scopes      []Scope
+	MaxSize     int64
+	MaxExpiry   time.Duration
+	Mimetypes   []string
+	ForceRandom bool
+	// Total size of the files uploaded with the key that haven't expired
+	// yet, counted by label
+	Quota int64
+}
+
+// Parse a line of an authfile, which holds the hash of a key optionally
+// followed by its label, scopes and limits, such as
+// <hash> label=ci scopes=upload,read-private maxsize=100MB maxexpiry=1d mimetypes=image/*,text/plain random=true quota=1GB
+func ParseAuthKey(line string) (k Key, err error) {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return k, errors.New("missing key hash")
+	}
+	k.Hash = fields[0]
+	err = checkHash(k.Hash)
+	if err != nil {
+		return k, err
+	}
+
+	for _, field := range fields[1:] {
+		name, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return k, fmt.Errorf("option %q is not name=value", field)
+		}
+
+		switch name {
+		case "label":
+			k.Label = value
+		case "scopes":
+			k.Scopes = []Scope{}
+			for _, scope := range strings.Split(strings.ToLower(value), ",") {
+				if scope == "" {
+					continue
+				}
+				if !knownScopes[Scope(scope)] {
+					return k, fmt.Errorf("unknown scope %q", scope)
+				}
+				k.Scopes = append(k.Scopes, Scope(scope))
+			}
+		case "maxsize":
+			k.MaxSize, err = parseSize(value)
+		case "maxexpiry":
+			k.MaxExpiry, err = expiry.ParseDuration(value)
+		case "mimetypes":
+			for _, mimetype := range strings.Split(strings.ToLower(value), ",") {
+				if mimetype != "" {
+					k.Mimetypes = append(k.Mimetypes, mimetype)
+				}
+			}
+		case "random":
+			k.ForceRandom, err = strconv.ParseBool(value)
+		case "quota":
+			k.Quota, err = parseSize(value)
+		default:
+			return k, fmt.Errorf("unknown option %q", name)
+		}
+		if err != nil {
+			return k, fmt.Errorf("option %s: %v", name, err)
+		}
+	}
+
+	if k.Quota > 0 && k.Label == "" {
+		return k, errors.New("keys with a quota need a label")
+	}
+	if k.Scopes == nil {
+		k.Scopes = defaultScopes
+	}
+	return k, nil
+}
+
+// Check whether a key has a scope, which admin keys have all of
+func (k *Key) HasScope(scope Scope) bool {
+	if k == nil {
+		return false
+	}
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+func parseSize(value string) (int64, error) {
+	size, err := humanize.ParseBytes(value)
+	return int64(size), err
 }
 
-func ReadAuthKeys(authFile string) []string {
-	var authKeys []string
+// Read the keys of an authfile, skipping blank lines and those starting
+// with #
+func ReadAuthKeys(authFile string) []Key {
+	var authKeys []Key
 
 	f, err := os.Open(authFile)
 	if err != nil {
@@ -45,8 +186,17 @@ func ReadAuthKeys(authFile string) []string {
 	defer f.Close()
 
 	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		authKeys = append(authKeys, scanner.Text())
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := ParseAuthKey(line)
+		if err != nil {
+			log.Fatalf("Invalid key on line %d of authfile: %v", lineNum, err)
+		}
+		authKeys = append(authKeys, key)
 	}
 
 	err = scanner.Err()
@@ -57,16 +207,82 @@ func ReadAuthKeys(authFile string) []string {
 	return authKeys
 }
 
-func CheckAuth(authKeys []string, key string) (result bool, err error) {
-	checkKey, err := scrypt.Key([]byte(key), []byte(scryptSalt), scryptN, scryptr, scryptp, scryptKeyLen)
-	if err != nil {
-		return
+// Check a key against its hash, in constant time
+func VerifyKey(hash, key string) (bool, error) {
+	if isLegacyHash(hash) {
+		encodedKey, err := legacyHashKey(key)
+		if err != nil {
+			return false, err
+		}
+		return subtle.ConstantTimeCompare([]byte(encodedKey), []byte(hash)) == 1, nil
+	}
+	return verifyPHC(hash, key)
+}
+
+// Find the key matching the one a request was made with. Every salted
+// hash is derived on its own, while keys hashed with the fixed salt share
+// theirs.
+func FindKey(authKeys []Key, key string) (*Key, error) {
+	var legacyKey string
+
+	for i := range authKeys {
+		hash := authKeys[i].Hash
+		var match bool
+		if isLegacyHash(hash) {
+			if legacyKey == "" {
+				var err error
+				legacyKey, err = legacyHashKey(key)
+				if err != nil {
+					return nil, err
+				}
+			}
+			match = subtle.ConstantTimeCompare([]byte(legacyKey), []byte(hash)) == 1
+		} else {
+			var err error
+			match, err = verifyPHC(hash, key)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if match {
+			return &authKeys[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Key a request was authenticated with, nil if it wasn't
+func RequestKey(c web.C) *Key {
+	key, _ := c.Env[envKey].(*Key)
+	return key
+}
+
+// Allow a route only to keys with one of the scopes. Requests the
+// middleware lets through without a key, such as those reading a public
+// instance, are allowed as they are.
+func RequireScope(h web.HandlerFunc, scopes ...Scope) web.HandlerFunc {
+	return func(c web.C, w http.ResponseWriter, r *http.Request) {
+		key := RequestKey(c)
+		if key == nil {
+			h(c, w, r)
+			return
+		}
+
+		for _, scope := range scopes {
+			if key.HasScope(scope) {
+				h(c, w, r)
+				return
+			}
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 	}
+}
 
-	encodedKey := base64.StdEncoding.EncodeToString(checkKey)
+func CheckAuth(authKeys []string, key string) (result bool, err error) {
 	for _, v := range authKeys {
-		if encodedKey == v {
-			result = true
+		result, err = VerifyKey(v, key)
+		if err != nil || result {
 			return
 		}
 	}
@@ -109,7 +325,8 @@ func (a ApiKeysMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		successHandler = a.successHandler
 	}
 
-	if sliceContains(a.o.UnauthMethods, r.Method) && r.URL.Path != prefix+"auth" {
+	unauth := sliceContains(a.o.UnauthMethods, r.Method) || (a.o.UnauthRequest != nil && a.o.UnauthRequest(r))
+	if unauth && r.URL.Path != prefix+"auth" {
 		// allow unauthenticated methods
 		successHandler.ServeHTTP(w, r)
 		return
@@ -123,21 +340,38 @@ func (a ApiKeysMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	result, err := CheckAuth(a.authKeys, key)
-	if err != nil || !result {
-		http.HandlerFunc(a.badAuthorizationHandler).ServeHTTP(w, r)
-		return
+	authKey := a.cache.get(key)
+	if authKey == nil {
+		var err error
+		authKey, err = FindKey(a.authKeys, key)
+		if err != nil || authKey == nil {
+			http.HandlerFunc(a.badAuthorizationHandler).ServeHTTP(w, r)
+			return
+		}
+		a.cache.put(key, authKey)
+	}
+
+	if a.c.Env == nil {
+		a.c.Env = make(map[interface{}]interface{})
 	}
+	a.c.Env[envKey] = authKey
 
 	successHandler.ServeHTTP(w, r)
 }
 
 func NewApiKeysMiddleware(o AuthOptions) func(*web.C, http.Handler) http.Handler {
+	// The keys and the cache of those requests were made with are shared
+	// by every stack of the middleware
+	authKeys := ReadAuthKeys(o.AuthFile)
+	cache := newKeyCache()
+
 	fn := func(c *web.C, h http.Handler) http.Handler {
 		return ApiKeysMiddleware{
 			successHandler: h,
-			authKeys:       ReadAuthKeys(o.AuthFile),
+			authKeys:       authKeys,
+			cache:          cache,
 			o:              o,
+			c:              c,
 		}
 	}
 	return fn
@@ -1,7 +1,12 @@
 package apikeys
 
 import (
+	"encoding/base64"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
 )
 
 func TestCheckAuth(t *testing.T) {
@@ -22,3 +27,169 @@ func TestCheckAuth(t *testing.T) {
 		t.Fatal("Authorization failed for valid key")
 	}
 }
+
+func TestParseAuthKey(t *testing.T) {
+	k, err := ParseAuthKey("vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Hash != "vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM=" || k.Label != "" || k.MaxSize != 0 || k.Quota != 0 {
+		t.Fatalf("Unexpected key %+v", k)
+	}
+
+	k, err = ParseAuthKey("vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM= label=ci maxsize=10MB maxexpiry=1d mimetypes=image/*,Text/Plain random=true quota=1GB")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Label != "ci" || k.MaxSize != 10000000 || k.MaxExpiry != 24*time.Hour || !k.ForceRandom || k.Quota != 1000000000 ||
+		len(k.Mimetypes) != 2 || k.Mimetypes[0] != "image/*" || k.Mimetypes[1] != "text/plain" {
+		t.Fatalf("Unexpected key %+v", k)
+	}
+
+	invalid := []string{
+		"",
+		"hash label",
+		"hash maxsize=lots",
+		"hash maxexpiry=forever",
+		"hash maxexpiry=2030-01-01T00:00:00Z",
+		"hash random=maybe",
+		"hash colour=blue",
+		"hash quota=1GB",
+		"hash scopes=upload,superuser",
+	}
+	for _, line := range invalid {
+		_, err := ParseAuthKey(line)
+		if err == nil {
+			t.Fatalf("No error for %q", line)
+		}
+	}
+}
+
+func TestKeyScopes(t *testing.T) {
+	k, err := ParseAuthKey("hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !k.HasScope(ScopeUpload) || !k.HasScope(ScopeReadPrivate) || k.HasScope(ScopeDeleteAny) || k.HasScope(ScopeAdmin) {
+		t.Fatalf("Unexpected default scopes %v", k.Scopes)
+	}
+
+	k, err = ParseAuthKey("hash scopes=Read-Private")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.HasScope(ScopeUpload) || !k.HasScope(ScopeReadPrivate) {
+		t.Fatalf("Unexpected scopes %v", k.Scopes)
+	}
+
+	k, err = ParseAuthKey("hash scopes=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.HasScope(ScopeUpload) || k.HasScope(ScopeReadPrivate) {
+		t.Fatalf("Key without scopes has %v", k.Scopes)
+	}
+
+	k, err = ParseAuthKey("hash scopes=admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, scope := range []Scope{ScopeUpload, ScopeDeleteAny, ScopeReadPrivate, ScopeAdmin} {
+		if !k.HasScope(scope) {
+			t.Fatalf("Admin key doesn't have scope %s", scope)
+		}
+	}
+
+	var none *Key
+	if none.HasScope(ScopeReadPrivate) {
+		t.Fatal("Missing key has a scope")
+	}
+}
+
+func TestHashKey(t *testing.T) {
+	hash, err := HashKey("haPVipRnGJ0QovA9nyqK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=3,p=4$") {
+		t.Fatalf("Unexpected hash %q", hash)
+	}
+
+	again, err := HashKey("haPVipRnGJ0QovA9nyqK")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == hash {
+		t.Fatal("Identical keys hashed identically")
+	}
+
+	salt := []byte("0123456789abcdef")
+	derived, err := scrypt.Key([]byte("haPVipRnGJ0QovA9nyqK"), salt, 1<<10, 8, 1, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scryptHash := "$scrypt$ln=10,r=8,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" +
+		base64.RawStdEncoding.EncodeToString(derived)
+
+	for _, h := range []string{hash, again, scryptHash, "vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM="} {
+		if _, err := ParseAuthKey(h); err != nil {
+			t.Fatalf("Could not parse %q: %v", h, err)
+		}
+		if ok, err := VerifyKey(h, "haPVipRnGJ0QovA9nyqK"); err != nil || !ok {
+			t.Fatalf("Key does not match %q: %v", h, err)
+		}
+		if ok, err := VerifyKey(h, "thisisnotvalid"); err != nil || ok {
+			t.Fatalf("Invalid key matches %q: %v", h, err)
+		}
+	}
+
+	invalid := []string{
+		"not base64!",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA",
+		"$argon2id$v=18$m=65536,t=3,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=0,t=3,p=4$c2FsdA$aGFzaA",
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA$",
+		"$scrypt$ln=40,r=8,p=1$c2FsdA$aGFzaA",
+		"$bcrypt$ln=10$c2FsdA$aGFzaA",
+	}
+	for _, h := range invalid {
+		if _, err := ParseAuthKey(h); err == nil {
+			t.Fatalf("No error for hash %q", h)
+		}
+	}
+}
+
+func TestFindKey(t *testing.T) {
+	hash, err := HashKey("salted-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authKeys := []Key{
+		{Hash: "vFpNprT9wbHgwAubpvRxYCCpA2FQMAK6hFqPvAGrdZo=", Label: "other"},
+		{Hash: hash, Label: "salted"},
+		{Hash: "vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM=", Label: "legacy"},
+	}
+
+	for key, label := range map[string]string{"salted-key": "salted", "haPVipRnGJ0QovA9nyqK": "legacy"} {
+		k, err := FindKey(authKeys, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k == nil || k.Label != label {
+			t.Fatalf("Found %+v for the %s key", k, label)
+		}
+	}
+
+	if k, err := FindKey(authKeys, "thisisnotvalid"); err != nil || k != nil {
+		t.Fatalf("Found %+v for an invalid key: %v", k, err)
+	}
+
+	cache := newKeyCache()
+	if cache.get("salted-key") != nil {
+		t.Fatal("Empty cache has a key")
+	}
+	cache.put("salted-key", &authKeys[1])
+	if cache.get("salted-key") != &authKeys[1] || cache.get("haPVipRnGJ0QovA9nyqK") != nil {
+		t.Fatal("Cache returned the wrong key")
+	}
+}
@@ -0,0 +1,182 @@
+package apikeys
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Keys are hashed with argon2id and a random salt, in the PHC string
+// format, such as
+// $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>
+// where the salt and hash are unpadded base64. scrypt hashes in the same
+// format, such as $scrypt$ln=16,r=8,p=1$<salt>$<hash>, and the bare base64
+// of scrypt hashes with the fixed salt keys used to be hashed with are
+// accepted too.
+const (
+	argon2Memory  = 64 * 1024
+	argon2Time    = 3
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	saltLen       = 16
+)
+
+var errInvalidHash = errors.New("invalid key hash")
+
+// Hash a key with a new random salt, for an authfile
+func HashKey(key string) (string, error) {
+	salt := make([]byte, saltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	hash := argon2.IDKey([]byte(key), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(hash)), nil
+}
+
+// Hash of a key with the fixed salt keys used to be hashed with
+func legacyHashKey(key string) (string, error) {
+	checkKey, err := scrypt.Key([]byte(key), []byte(scryptSalt), scryptN, scryptr, scryptp, scryptKeyLen)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(checkKey), nil
+}
+
+func isLegacyHash(hash string) bool {
+	return !strings.HasPrefix(hash, "$")
+}
+
+// A hash in the PHC string format, with the parameters of its function,
+// which is argon2id or scrypt
+type phcHash struct {
+	function string
+	params   map[string]int
+	salt     []byte
+	hash     []byte
+}
+
+func parsePHC(s string) (h phcHash, err error) {
+	fields := strings.Split(s, "$")
+	if len(fields) < 5 || fields[0] != "" {
+		return h, errInvalidHash
+	}
+	h.function = fields[1]
+	fields = fields[2:]
+
+	// The version is optional, and only argon2 has one
+	if strings.HasPrefix(fields[0], "v=") {
+		if len(fields) != 4 || fields[0] != fmt.Sprintf("v=%d", argon2.Version) {
+			return h, errInvalidHash
+		}
+		fields = fields[1:]
+	} else if len(fields) != 3 {
+		return h, errInvalidHash
+	}
+
+	h.params = make(map[string]int)
+	for _, param := range strings.Split(fields[0], ",") {
+		name, value, ok := strings.Cut(param, "=")
+		if !ok {
+			return h, errInvalidHash
+		}
+		h.params[name], err = strconv.Atoi(value)
+		if err != nil || h.params[name] <= 0 {
+			return h, errInvalidHash
+		}
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return h, errInvalidHash
+	}
+	h.hash, err = base64.RawStdEncoding.DecodeString(fields[2])
+	if err != nil || len(h.hash) == 0 {
+		return h, errInvalidHash
+	}
+
+	switch h.function {
+	case "argon2id":
+		if h.params["m"] == 0 || h.params["t"] == 0 || h.params["p"] == 0 || h.params["p"] > 255 {
+			return h, errInvalidHash
+		}
+	case "scrypt":
+		if h.params["ln"] == 0 || h.params["ln"] > 30 || h.params["r"] == 0 || h.params["p"] == 0 {
+			return h, errInvalidHash
+		}
+	default:
+		return h, fmt.Errorf("unsupported hash function %q", h.function)
+	}
+	return h, nil
+}
+
+// Check that a hash can be verified, so that mistakes in authfiles are
+// found when they are read
+func checkHash(hash string) error {
+	if isLegacyHash(hash) {
+		_, err := base64.StdEncoding.DecodeString(hash)
+		if err != nil {
+			return errInvalidHash
+		}
+		return nil
+	}
+
+	_, err := parsePHC(hash)
+	return err
+}
+
+// Check a key against a hash in the PHC string format, in constant time
+func verifyPHC(hash, key string) (bool, error) {
+	h, err := parsePHC(hash)
+	if err != nil {
+		return false, err
+	}
+
+	var derived []byte
+	switch h.function {
+	case "argon2id":
+		derived = argon2.IDKey([]byte(key), h.salt, uint32(h.params["t"]), uint32(h.params["m"]),
+			uint8(h.params["p"]), uint32(len(h.hash)))
+	case "scrypt":
+		derived, err = scrypt.Key([]byte(key), h.salt, 1<<h.params["ln"], h.params["r"], h.params["p"], len(h.hash))
+		if err != nil {
+			return false, err
+		}
+	}
+	return subtle.ConstantTimeCompare(derived, h.hash) == 1, nil
+}
+
+// Keys that were found in an authfile, by the SHA-256 of the key requests
+// were made with, so that each key is only derived once. Only keys that
+// were found are kept, which are at most as many as the authfile has.
+type keyCache struct {
+	mu   sync.Mutex
+	keys map[[sha256.Size]byte]*Key
+}
+
+func newKeyCache() *keyCache {
+	return &keyCache{keys: make(map[[sha256.Size]byte]*Key)}
+}
+
+func (kc *keyCache) get(key string) *Key {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	return kc.keys[sha256.Sum256([]byte(key))]
+}
+
+func (kc *keyCache) put(key string, k *Key) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+	kc.keys[sha256.Sum256([]byte(key))] = k
+}
@@ -0,0 +1,479 @@
+package encrypted
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/helpers"
+)
+
+// Wraps a storage backend so that it only ever sees encrypted file contents
+// and metadata. The wrapped backend keeps the expiry and download counts in
+// the clear so that it can still clean up expired files and count downloads,
+// and files stored before encryption was enabled are passed through as they
+// are.
+type EncryptedBackend struct {
+	backend backends.MetaStorageBackend
+	keys    Keyring
+}
+
+// Metadata sealed into the Envelope of the wrapped backend's metadata
+type sealedMetadata struct {
+	DeleteKey    string   `json:"delete_key"`
+	AccessKey    string   `json:"access_key,omitempty"`
+	Sha256sum    string   `json:"sha256sum"`
+	Mimetype     string   `json:"mimetype"`
+	Size         int64    `json:"size"`
+	SrcIp        string   `json:"srcip,omitempty"`
+	OriginalName string   `json:"original_name,omitempty"`
+	ArchiveFiles []string `json:"archive_files,omitempty"`
+	Uploader     string   `json:"uploader,omitempty"`
+	Collection   string   `json:"collection,omitempty"`
+	KeyID        string   `json:"key_id"`
+	Salt         []byte   `json:"salt"`
+}
+
+func (b EncryptedBackend) Delete(key string) error {
+	return b.backend.Delete(key)
+}
+
+func (b EncryptedBackend) Exists(key string) (bool, error) {
+	return b.backend.Exists(key)
+}
+
+func (b EncryptedBackend) Head(key string) (metadata backends.Metadata, err error) {
+	metadata, _, err = b.head(key)
+	return
+}
+
+func (b EncryptedBackend) head(key string) (metadata backends.Metadata, sealed *sealedMetadata, err error) {
+	stored, err := b.backend.Head(key)
+	if err != nil || stored.Envelope == "" {
+		return stored, nil, err
+	}
+
+	sealed, err = b.openMetadata(key, stored.Envelope)
+	if err != nil {
+		return
+	}
+
+	return openedMetadata(stored, sealed), sealed, nil
+}
+
+// Metadata of a file from what the wrapped backend keeps in the clear and
+// what is sealed
+func openedMetadata(stored backends.Metadata, sealed *sealedMetadata) backends.Metadata {
+	return backends.Metadata{
+		DeleteKey:    sealed.DeleteKey,
+		AccessKey:    sealed.AccessKey,
+		Sha256sum:    sealed.Sha256sum,
+		Mimetype:     sealed.Mimetype,
+		Size:         sealed.Size,
+		Expiry:       stored.Expiry,
+		SrcIp:        sealed.SrcIp,
+		OriginalName: sealed.OriginalName,
+		ArchiveFiles: sealed.ArchiveFiles,
+		Uploader:     sealed.Uploader,
+		Collection:   sealed.Collection,
+		MaxDownloads: stored.MaxDownloads,
+		Downloads:    stored.Downloads,
+		Malware:      stored.Malware,
+		Revision:     stored.Revision,
+	}
+}
+
+func (b EncryptedBackend) Get(key string) (metadata backends.Metadata, r io.ReadCloser, err error) {
+	metadata, sealed, err := b.head(key)
+	if err != nil {
+		return
+	}
+	if sealed == nil {
+		return b.backend.Get(key)
+	}
+
+	r, err = b.openFile(key, sealed, metadata.Size, 0)
+	return
+}
+
+func (b EncryptedBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) error {
+	metadata, sealed, err := b.head(key)
+	if err != nil {
+		return err
+	}
+	if sealed == nil {
+		return b.backend.ServeFile(key, w, r)
+	}
+
+	f := &fileReadSeeker{b: b, key: key, sealed: sealed, size: metadata.Size}
+	defer f.Close()
+
+	// ServeContent takes care of range requests by seeking, and relies on
+	// the Etag set by the caller for If-Range
+	http.ServeContent(w, r, key, time.Time{}, f)
+	return nil
+}
+
+func (b EncryptedBackend) Put(key string, r io.Reader, m backends.Metadata) (stored backends.Metadata, err error) {
+	br := bufio.NewReader(r)
+	if _, err = br.Peek(1); err == io.EOF {
+		return stored, backends.FileEmptyError
+	} else if err != nil {
+		return
+	}
+
+	sealed := &sealedMetadata{
+		DeleteKey:    m.DeleteKey,
+		AccessKey:    m.AccessKey,
+		Mimetype:     m.Mimetype,
+		SrcIp:        m.SrcIp,
+		OriginalName: m.OriginalName,
+		Uploader:     m.Uploader,
+		Collection:   m.Collection,
+		KeyID:        b.keys.active,
+		Salt:         make([]byte, saltSize),
+	}
+	_, err = rand.Read(sealed.Salt)
+	if err != nil {
+		return
+	}
+
+	masterKey, err := b.keys.key(sealed.KeyID)
+	if err != nil {
+		return
+	}
+	aead, err := fileAEAD(masterKey, sealed.Salt)
+	if err != nil {
+		return
+	}
+
+	// The file is stored along with the metadata kept in the clear, and
+	// what is known of the sealed metadata before its contents are read,
+	// so that it is never served as if it wasn't encrypted
+	stored = backends.Metadata{
+		Expiry:       m.Expiry,
+		MaxDownloads: m.MaxDownloads,
+		Downloads:    m.Downloads,
+		Malware:      m.Malware,
+		Revision:     m.Revision,
+	}
+	stored.Envelope, err = b.sealMetadata(key, sealed)
+	if err != nil {
+		return
+	}
+
+	// Generate the plaintext metadata from what passes through on its way
+	// to being encrypted
+	mw := helpers.NewMetadataWriter()
+	defer mw.Close()
+
+	encrypted := newEncryptingReader(io.TeeReader(br, mw), aead, fileHeader(sealed.KeyID, sealed.Salt))
+	stored, err = b.backend.Put(key, encrypted, stored)
+	if err != nil {
+		return
+	}
+	generated := mw.Metadata(nil)
+
+	sealed.Sha256sum = generated.Sha256sum
+	sealed.Size = generated.Size
+	if sealed.Mimetype == "" {
+		sealed.Mimetype = generated.Mimetype
+	}
+
+	// Zip archives are listed from what was just stored, decrypting only
+	// the parts the listing reads
+	if generated.Mimetype == "application/zip" {
+		f := &fileReadSeeker{b: b, key: key, sealed: sealed, size: generated.Size}
+		generated = mw.Metadata(f)
+		f.Close()
+	}
+	sealed.ArchiveFiles = generated.ArchiveFiles
+
+	stored.Envelope, err = b.sealMetadata(key, sealed)
+	if err == nil {
+		err = b.backend.PutMetadata(key, stored)
+	}
+	if err != nil {
+		b.backend.Delete(key)
+		return
+	}
+
+	return openedMetadata(stored, sealed), nil
+}
+
+func (b EncryptedBackend) PutMetadata(key string, m backends.Metadata) error {
+	stored, err := b.backend.Head(key)
+	if err != nil {
+		return err
+	}
+	if stored.Envelope == "" {
+		return b.backend.PutMetadata(key, m)
+	}
+
+	sealed, err := b.openMetadata(key, stored.Envelope)
+	if err != nil {
+		return err
+	}
+
+	sealed.DeleteKey = m.DeleteKey
+	sealed.AccessKey = m.AccessKey
+	sealed.Sha256sum = m.Sha256sum
+	sealed.Mimetype = m.Mimetype
+	sealed.Size = m.Size
+	sealed.SrcIp = m.SrcIp
+	sealed.OriginalName = m.OriginalName
+	sealed.ArchiveFiles = m.ArchiveFiles
+	sealed.Uploader = m.Uploader
+	sealed.Collection = m.Collection
+
+	stored.Expiry = m.Expiry
+	stored.MaxDownloads = m.MaxDownloads
+	stored.Downloads = m.Downloads
+	stored.Malware = m.Malware
+	stored.Revision = m.Revision
+	stored.Envelope, err = b.sealMetadata(key, sealed)
+	if err != nil {
+		return err
+	}
+
+	return b.backend.PutMetadata(key, stored)
+}
+
+func (b EncryptedBackend) Size(key string) (int64, error) {
+	metadata, err := b.Head(key)
+	if err != nil {
+		return 0, err
+	}
+	return metadata.Size, nil
+}
+
+func (b EncryptedBackend) List() ([]string, error) {
+	return b.backend.List()
+}
+
+func (b EncryptedBackend) ListExpired() ([]string, error) {
+	if lister, ok := b.backend.(backends.ExpiryLister); ok {
+		return lister.ListExpired()
+	}
+
+	files, err := b.backend.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
+	for _, file := range files {
+		metadata, err := b.backend.Head(file)
+		if err != nil || expiry.IsTsExpired(metadata.Expiry) {
+			output = append(output, file)
+		}
+	}
+
+	return output, nil
+}
+
+// Open a file for reading from a plaintext offset
+func (b EncryptedBackend) openFile(key string, sealed *sealedMetadata, size int64, offset int64) (io.ReadCloser, error) {
+	masterKey, err := b.keys.key(sealed.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := fileAEAD(masterKey, sealed.Salt)
+	if err != nil {
+		return nil, err
+	}
+
+	var rc io.ReadCloser
+	chunkOffset := (offset / chunkSize) * encryptedChunkSize
+	if chunkOffset == 0 {
+		_, rc, err = b.backend.Get(key)
+		if err == nil {
+			err = checkHeader(rc, sealed.KeyID, sealed.Salt)
+		}
+	} else {
+		rc, err = b.getFrom(key, headerSize(sealed.KeyID)+chunkOffset)
+	}
+	if err != nil {
+		if rc != nil {
+			rc.Close()
+		}
+		return nil, err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{newDecryptingReader(rc, aead, size, offset), rc}, nil
+}
+
+func (b EncryptedBackend) getFrom(key string, offset int64) (io.ReadCloser, error) {
+	if getter, ok := b.backend.(backends.RangeGetter); ok {
+		return getter.GetFrom(key, offset)
+	}
+
+	_, rc, err := b.backend.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if seeker, ok := rc.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, rc, offset)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+// Metadata is sealed with a key derived from the active master key, and
+// bound to the name of its file
+func (b EncryptedBackend) sealMetadata(key string, sealed *sealedMetadata) (string, error) {
+	plaintext, err := json.Marshal(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	masterKey, err := b.keys.key(b.keys.active)
+	if err != nil {
+		return "", err
+	}
+	aead, err := deriveAEAD(masterKey, nil, "linx-server metadata")
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := aead.Seal(nonce, nonce, plaintext, []byte(key))
+	return b.keys.active + ":" + base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+func (b EncryptedBackend) openMetadata(key string, envelope string) (*sealedMetadata, error) {
+	keyID, encoded, found := strings.Cut(envelope, ":")
+	if !found {
+		return nil, backends.BadMetadata
+	}
+
+	masterKey, err := b.keys.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := deriveAEAD(masterKey, nil, "linx-server metadata")
+	if err != nil {
+		return nil, err
+	}
+
+	ciphertext, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(ciphertext) < aead.NonceSize() {
+		return nil, backends.BadMetadata
+	}
+
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, errAuthentication
+	}
+
+	sealed := &sealedMetadata{}
+	err = json.Unmarshal(plaintext, sealed)
+	if err != nil {
+		return nil, backends.BadMetadata
+	}
+	return sealed, nil
+}
+
+// Decrypts a file on demand as http.ServeContent seeks and reads through it
+type fileReadSeeker struct {
+	b      EncryptedBackend
+	key    string
+	sealed *sealedMetadata
+	size   int64
+	pos    int64
+	r      io.ReadCloser
+}
+
+func (f *fileReadSeeker) Read(p []byte) (n int, err error) {
+	if f.pos >= f.size {
+		return 0, io.EOF
+	}
+
+	if f.r == nil {
+		f.r, err = f.b.openFile(f.key, f.sealed, f.size, f.pos)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = f.r.Read(p)
+	f.pos += int64(n)
+	return
+}
+
+// Reads are independent of the position of Read and Seek, so that zip
+// archives can be listed
+func (f *fileReadSeeker) ReadAt(p []byte, off int64) (n int, err error) {
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	r, err := f.b.openFile(f.key, f.sealed, f.size, off)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	n, err = io.ReadFull(r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return
+}
+
+func (f *fileReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += f.pos
+	case io.SeekEnd:
+		pos += f.size
+	}
+	if pos < 0 {
+		return 0, errors.New("encrypted: negative position")
+	}
+
+	if pos != f.pos {
+		f.Close()
+		f.pos = pos
+	}
+	return pos, nil
+}
+
+func (f *fileReadSeeker) Close() error {
+	if f.r == nil {
+		return nil
+	}
+	err := f.r.Close()
+	f.r = nil
+	return err
+}
+
+func NewEncryptedBackend(backend backends.MetaStorageBackend, keys Keyring) EncryptedBackend {
+	return EncryptedBackend{
+		backend: backend,
+		keys:    keys,
+	}
+}
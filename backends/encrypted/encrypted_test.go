@@ -0,0 +1,352 @@
+package encrypted
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+func writeKeyFile(t *testing.T, ids ...string) string {
+	var lines []string
+	for _, id := range ids {
+		key := make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, id+" "+base64.StdEncoding.EncodeToString(key))
+	}
+
+	keyFile := path.Join(t.TempDir(), "keys")
+	err := os.WriteFile(keyFile, []byte("# linx keys\n"+strings.Join(lines, "\n")+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keyFile
+}
+
+func newTestBackend(t *testing.T) (EncryptedBackend, localfs.LocalfsBackend, string) {
+	dir := t.TempDir()
+	filesPath := path.Join(dir, "files")
+	metaPath := path.Join(dir, "meta")
+	for _, p := range []string{filesPath, metaPath} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inner := localfs.NewLocalfsBackend(localfs.LocalfsOptions{
+		MetaPath:  metaPath,
+		FilesPath: filesPath,
+	})
+
+	keys, err := ReadKeyFile(writeKeyFile(t, "old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewEncryptedBackend(inner, keys), inner, dir
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte('a' + i%26)
+	}
+	return content
+}
+
+func TestRoundTrip(t *testing.T) {
+	b, inner, dir := newTestBackend(t)
+
+	for _, size := range []int{1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 17} {
+		content := testContent(size)
+
+		m, err := b.Put("file.txt", bytes.NewReader(content), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "secretdelete", AccessKey: "secretaccess", SrcIp: "10.0.0.1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Size != int64(size) || m.DeleteKey != "secretdelete" {
+			t.Fatalf("Unexpected metadata from Put %+v", m)
+		}
+
+		head, err := b.Head("file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Size != int64(size) || head.Sha256sum != m.Sha256sum || head.AccessKey != "secretaccess" || head.SrcIp != "10.0.0.1" {
+			t.Fatalf("Unexpected metadata from Head %+v", head)
+		}
+
+		_, r, err := b.Get("file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("Decrypted contents of %d bytes do not match", size)
+		}
+
+		stored, err := inner.Head("file.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Size != headerSize("old")+int64(size)+chunkCount(int64(size))*16 {
+			t.Fatalf("Unexpected stored size %d for %d bytes", stored.Size, size)
+		}
+	}
+
+	for _, sub := range []string{"files", "meta"} {
+		raw, err := os.ReadFile(path.Join(dir, sub, "file.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(raw, []byte("secret")) || bytes.Contains(raw, []byte("abcdefgh")) {
+			t.Fatalf("Plaintext found in stored %s", sub)
+		}
+	}
+}
+
+func TestServeFileRange(t *testing.T) {
+	b, _, _ := newTestBackend(t)
+
+	content := testContent(3*chunkSize + 17)
+	_, err := b.Put("file.txt", bytes.NewReader(content), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/selif/file.txt", nil)
+	req.Header.Set("Range", "bytes=65530-131080")
+
+	err = b.ServeFile("file.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Expected 206, got %d", w.Code)
+	}
+	if !bytes.Equal(w.Body.Bytes(), content[65530:131081]) {
+		t.Fatal("Range contents do not match")
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/selif/file.txt", nil)
+
+	err = b.ServeFile("file.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("Full contents do not match, got status %d", w.Code)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	b, inner, _ := newTestBackend(t)
+
+	_, err := b.Put("old.txt", strings.NewReader("encrypted with the old key"), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKeys := b.keys
+	keys, err := ReadKeyFile(writeKeyFile(t, "new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys.keys["old"] = oldKeys.keys["old"]
+	b = NewEncryptedBackend(inner, keys)
+
+	_, r, err := b.Get("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if string(got) != "encrypted with the old key" {
+		t.Fatalf("Could not read file after rotation, got %q", got)
+	}
+
+	m, err := b.Head("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AccessKey = "rotated"
+	err = b.PutMetadata("old.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := inner.Head("old.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored.Envelope, "new:") {
+		t.Fatalf("Metadata was not sealed with the active key: %q", stored.Envelope)
+	}
+
+	b = NewEncryptedBackend(inner, oldKeys)
+	if _, err := b.Head("old.txt"); err == nil {
+		t.Fatal("Metadata sealed with an unknown key was opened")
+	}
+}
+
+func TestTamperedFile(t *testing.T) {
+	b, _, dir := newTestBackend(t)
+
+	_, err := b.Put("file.txt", bytes.NewReader(testContent(1000)), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := path.Join(dir, "files", "file.txt")
+	raw, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-20] ^= 1
+	err = os.WriteFile(filePath, raw, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := b.Get("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if _, err := io.ReadAll(r); err != errAuthentication {
+		t.Fatalf("Expected authentication error, got %v", err)
+	}
+}
+
+func TestEmptyAndPlaintextFiles(t *testing.T) {
+	b, inner, _ := newTestBackend(t)
+
+	_, err := b.Put("empty.txt", strings.NewReader(""), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != backends.FileEmptyError {
+		t.Fatalf("Expected FileEmptyError, got %v", err)
+	}
+
+	// Files stored before encryption was enabled are still served
+	_, err = inner.Put("plain.txt", strings.NewReader("plaintext"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, r, err := b.Get("plain.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if string(got) != "plaintext" || m.DeleteKey != "key" {
+		t.Fatalf("Unexpected plaintext file %q %+v", got, m)
+	}
+}
+
+func TestArchiveFiles(t *testing.T) {
+	b, _, _ := newTestBackend(t)
+
+	// Large enough for the central directory to be past the first chunk
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	for _, name := range []string{"b.txt", "a.txt"} {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(testContent(2 * chunkSize))
+	}
+	zw.Close()
+
+	m, err := b.Put("archive.zip", bytes.NewReader(zipBuf.Bytes()), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(m.ArchiveFiles, ",") != "a.txt,b.txt" {
+		t.Fatalf("Unexpected archive files from Put %v", m.ArchiveFiles)
+	}
+
+	m, err = b.Head("archive.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Mimetype != "application/zip" || strings.Join(m.ArchiveFiles, ",") != "a.txt,b.txt" {
+		t.Fatalf("Unexpected archive metadata %s %v", m.Mimetype, m.ArchiveFiles)
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	tw.WriteHeader(&tar.Header{Name: "c.txt", Mode: 0644, Size: 6, Typeflag: tar.TypeReg})
+	tw.Write([]byte("tarred"))
+	tw.Close()
+
+	_, err = b.Put("archive.tar", &tarBuf, backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = b.Head("archive.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(m.ArchiveFiles, ",") != "c.txt" {
+		t.Fatalf("Unexpected tar archive files %v", m.ArchiveFiles)
+	}
+}
+
+func TestPutWithMetadata(t *testing.T) {
+	b, inner, _ := newTestBackend(t)
+
+	m, err := b.Put("file.txt", strings.NewReader("limited"), backends.Metadata{
+		Expiry:       expiry.NeverExpire,
+		DeleteKey:    "secretdelete",
+		OriginalName: "File.txt",
+		MaxDownloads: 1,
+		Malware:      "Eicar-Test-Signature",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, got := range []backends.Metadata{m, head} {
+		if got.OriginalName != "File.txt" || got.MaxDownloads != 1 || got.Malware != "Eicar-Test-Signature" ||
+			got.DeleteKey != "secretdelete" || got.Size != 7 || got.Mimetype != "text/plain; charset=utf-8" {
+			t.Fatalf("Unexpected metadata %+v", got)
+		}
+	}
+
+	// Limits are kept in the clear, and the rest only sealed
+	stored, err := inner.Head("file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.MaxDownloads != 1 || stored.Malware != "Eicar-Test-Signature" || stored.OriginalName != "" || stored.DeleteKey != "" {
+		t.Fatalf("Unexpected stored metadata %+v", stored)
+	}
+}
@@ -0,0 +1,85 @@
+package encrypted
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const keySize = 32
+
+var keyIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Holds the master keys read from a key file. New files and metadata are
+// encrypted with the active key, while every key can still decrypt.
+type Keyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+// Read a key file, which has one "<id> <base64 key>" line per 32-byte key.
+// The first key is the active one, so keys are rotated by adding a new line
+// at the top and keeping the old ones for as long as files use them.
+func ReadKeyFile(keyFile string) (k Keyring, err error) {
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	k.keys = make(map[string][]byte)
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return k, fmt.Errorf("line %d: expected \"<id> <base64 key>\"", lineNum)
+		}
+
+		id := fields[0]
+		if !keyIDRe.MatchString(id) {
+			return k, fmt.Errorf("line %d: invalid key id %q", lineNum, id)
+		}
+		if _, exists := k.keys[id]; exists {
+			return k, fmt.Errorf("line %d: duplicate key id %q", lineNum, id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil || len(key) != keySize {
+			return k, fmt.Errorf("line %d: key must be %d base64-encoded bytes", lineNum, keySize)
+		}
+
+		if k.active == "" {
+			k.active = id
+		}
+		k.keys[id] = key
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return
+	}
+
+	if k.active == "" {
+		return k, errors.New("no keys in key file")
+	}
+
+	return
+}
+
+func (k Keyring) key(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key %q", id)
+	}
+	return key, nil
+}
@@ -0,0 +1,182 @@
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Files are stored as a header followed by the plaintext split in chunks,
+// each sealed with AES-GCM under a key derived from the master key and a
+// per-file salt. The nonce of a chunk is its index plus a flag marking the
+// last chunk, so chunks can't be reordered and the file can't be truncated,
+// and any chunk can be decrypted on its own for range requests.
+//
+// A file of n bytes has n/chunkSize full chunks followed by a last chunk of
+// n%chunkSize bytes, which is empty when n is a multiple of chunkSize.
+const (
+	chunkSize          = 64 * 1024
+	encryptedChunkSize = chunkSize + 16
+	saltSize           = 32
+)
+
+var magic = []byte("linxenc1")
+
+var errAuthentication = errors.New("encrypted: message authentication failed")
+
+func headerSize(keyID string) int64 {
+	return int64(len(magic) + 1 + len(keyID) + saltSize)
+}
+
+func fileHeader(keyID string, salt []byte) []byte {
+	header := make([]byte, 0, headerSize(keyID))
+	header = append(header, magic...)
+	header = append(header, byte(len(keyID)))
+	header = append(header, keyID...)
+	return append(header, salt...)
+}
+
+func deriveAEAD(masterKey []byte, salt []byte, info string) (cipher.AEAD, error) {
+	key := make([]byte, keySize)
+	_, err := io.ReadFull(hkdf.New(sha256.New, masterKey, salt, []byte(info)), key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func fileAEAD(masterKey []byte, salt []byte) (cipher.AEAD, error) {
+	return deriveAEAD(masterKey, salt, "linx-server file")
+}
+
+func chunkNonce(index int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(index))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+func chunkCount(size int64) int64 {
+	return size/chunkSize + 1
+}
+
+type encryptingReader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	plain []byte
+	out   []byte
+	index int64
+	done  bool
+}
+
+func newEncryptingReader(src io.Reader, aead cipher.AEAD, header []byte) *encryptingReader {
+	return &encryptingReader{
+		src:   src,
+		aead:  aead,
+		plain: make([]byte, chunkSize),
+		out:   append(make([]byte, 0, encryptedChunkSize), header...),
+	}
+}
+
+func (e *encryptingReader) Read(p []byte) (int, error) {
+	if len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(e.src, e.plain)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			e.done = true
+		} else if err != nil {
+			return 0, err
+		}
+
+		e.out = e.aead.Seal(e.out[:0], chunkNonce(e.index, e.done), e.plain[:n], nil)
+		e.index++
+	}
+
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+// Decrypts the chunks of a file of the given plaintext size, starting with
+// the chunk that src is positioned at
+type decryptingReader struct {
+	src   io.Reader
+	aead  cipher.AEAD
+	enc   []byte
+	out   []byte
+	index int64
+	last  int64
+	skip  int
+}
+
+func newDecryptingReader(src io.Reader, aead cipher.AEAD, size int64, offset int64) *decryptingReader {
+	return &decryptingReader{
+		src:   src,
+		aead:  aead,
+		enc:   make([]byte, encryptedChunkSize),
+		index: offset / chunkSize,
+		last:  chunkCount(size) - 1,
+		skip:  int(offset % chunkSize),
+	}
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	for len(d.out) == 0 {
+		if d.index > d.last {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(d.src, d.enc)
+		if err == io.ErrUnexpectedEOF && d.index == d.last {
+			err = nil
+		} else if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		d.out, err = d.aead.Open(d.enc[:0], chunkNonce(d.index, d.index == d.last), d.enc[:n], nil)
+		if err != nil {
+			return 0, errAuthentication
+		}
+		d.index++
+
+		d.out = d.out[min(d.skip, len(d.out)):]
+		d.skip = 0
+	}
+
+	n := copy(p, d.out)
+	d.out = d.out[n:]
+	return n, nil
+}
+
+func checkHeader(r io.Reader, keyID string, salt []byte) error {
+	header := make([]byte, headerSize(keyID))
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(header, fileHeader(keyID, salt)) {
+		return errors.New("encrypted: file header does not match its metadata")
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package localfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	metaBucket    = []byte("metadata")
+	expiryIndex   = []byte("idx_expiry")
+	sha256Index   = []byte("idx_sha256")
+	srcIpIndex    = []byte("idx_srcip")
+	uploadedIndex = []byte("idx_uploaded")
+)
+
+// Stores metadata in a bolt database, indexed by expiry, sha256sum, source
+// IP and upload time. Index entries are the indexed value followed by the
+// key, so lookups are prefix or range scans.
+type BoltMetaStore struct {
+	db *bolt.DB
+}
+
+type boltRecord struct {
+	MetadataJSON
+	Uploaded int64 `json:"uploaded"`
+}
+
+func (s *BoltMetaStore) Get(key string) (metadata backends.Metadata, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, key)
+		if err != nil {
+			return err
+		}
+		metadata = metadataFromJSON(record.MetadataJSON)
+		return nil
+	})
+	return
+}
+
+func (s *BoltMetaStore) Put(key string, metadata backends.Metadata) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		uploaded := time.Now().Unix()
+		if record, err := getRecord(tx, key); err == nil {
+			uploaded = record.Uploaded
+		}
+
+		return putRecord(tx, key, boltRecord{metadataToJSON(metadata), uploaded})
+	})
+}
+
+// Store metadata with a known upload time, as when importing existing files
+func (s *BoltMetaStore) Import(key string, metadata backends.Metadata, uploaded time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return putRecord(tx, key, boltRecord{metadataToJSON(metadata), uploaded.Unix()})
+	})
+}
+
+func (s *BoltMetaStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		record, err := getRecord(tx, key)
+		if err != nil {
+			return err
+		}
+
+		err = deleteIndexes(tx, key, record)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltMetaStore) ExpiredBefore(t time.Time) ([]string, error) {
+	// NeverExpire is not indexed, so everything from the start is expired
+	return s.scanTime(expiryIndex, time.Unix(0, 0), t)
+}
+
+func (s *BoltMetaStore) UploadedBetween(from, to time.Time) ([]string, error) {
+	return s.scanTime(uploadedIndex, from, to)
+}
+
+func (s *BoltMetaStore) BySha256(sum string) ([]string, error) {
+	return s.scanPrefix(sha256Index, stringIndexKey(sum, ""))
+}
+
+func (s *BoltMetaStore) BySrcIp(srcIp string) ([]string, error) {
+	return s.scanPrefix(srcIpIndex, stringIndexKey(srcIp, ""))
+}
+
+func (s *BoltMetaStore) Close() error {
+	return s.db.Close()
+}
+
+// List keys in a time index from "from" (inclusive) to "to" (exclusive)
+func (s *BoltMetaStore) scanTime(bucket []byte, from, to time.Time) (keys []string, err error) {
+	start := timeIndexKey(from.Unix(), "")
+	end := timeIndexKey(to.Unix(), "")
+
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.Compare(k, end) < 0; k, _ = c.Next() {
+			keys = append(keys, string(k[8:]))
+		}
+		return nil
+	})
+	return
+}
+
+func (s *BoltMetaStore) scanPrefix(bucket []byte, prefix []byte) (keys []string, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			keys = append(keys, string(k[len(prefix):]))
+		}
+		return nil
+	})
+	return
+}
+
+func getRecord(tx *bolt.Tx, key string) (record boltRecord, err error) {
+	value := tx.Bucket(metaBucket).Get([]byte(key))
+	if value == nil {
+		return record, backends.NotFoundErr
+	}
+
+	if err := json.Unmarshal(value, &record); err != nil {
+		return record, backends.BadMetadata
+	}
+	return
+}
+
+func putRecord(tx *bolt.Tx, key string, record boltRecord) error {
+	if old, err := getRecord(tx, key); err == nil {
+		err = deleteIndexes(tx, key, old)
+		if err != nil {
+			return err
+		}
+	}
+
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Bucket(metaBucket).Put([]byte(key), value)
+	if err != nil {
+		return err
+	}
+
+	for bucket, indexKey := range indexKeys(key, record) {
+		err = tx.Bucket([]byte(bucket)).Put(indexKey, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteIndexes(tx *bolt.Tx, key string, record boltRecord) error {
+	for bucket, indexKey := range indexKeys(key, record) {
+		err := tx.Bucket([]byte(bucket)).Delete(indexKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexKeys(key string, record boltRecord) map[string][]byte {
+	keys := map[string][]byte{
+		string(sha256Index):   stringIndexKey(record.Sha256sum, key),
+		string(uploadedIndex): timeIndexKey(record.Uploaded, key),
+	}
+
+	if record.Expiry != expiry.NeverExpire.Unix() {
+		keys[string(expiryIndex)] = timeIndexKey(record.Expiry, key)
+	}
+	if record.SrcIp != "" {
+		keys[string(srcIpIndex)] = stringIndexKey(record.SrcIp, key)
+	}
+
+	return keys
+}
+
+func timeIndexKey(ts int64, key string) []byte {
+	// Timestamps before the epoch sort first
+	if ts < 0 {
+		ts = 0
+	}
+
+	indexKey := make([]byte, 8, 8+len(key))
+	binary.BigEndian.PutUint64(indexKey, uint64(ts))
+	return append(indexKey, key...)
+}
+
+func stringIndexKey(value string, key string) []byte {
+	return []byte(value + "\x00" + key)
+}
+
+func NewBoltMetaStore(dbPath string) (*BoltMetaStore, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{metaBucket, expiryIndex, sha256Index, srcIpIndex, uploadedIndex} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltMetaStore{db: db}, nil
+}
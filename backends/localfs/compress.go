@@ -0,0 +1,275 @@
+package localfs
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/klauspost/compress/zstd"
+)
+
+const encodingZstd = "zstd"
+
+// Files smaller than this are not worth compressing
+const minCompressSize = 1024
+
+var compressibleMimetypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/x-ndjson",
+	"application/xml",
+	"application/x-sh",
+	"image/svg+xml",
+}
+
+func compressible(m backends.Metadata) bool {
+	if m.Size < minCompressSize {
+		return false
+	}
+
+	for _, prefix := range compressibleMimetypes {
+		if strings.HasPrefix(m.Mimetype, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress the file at filePath in place, unless that doesn't make it any
+// smaller, and return the encoding it is now stored with
+func compressFile(filePath string) (encoding string, err error) {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return
+	}
+	defer src.Close()
+
+	// Temporary files are hidden so they aren't listed as uploads
+	tmp, err := os.CreateTemp(path.Dir(filePath), ".compress-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	enc, err := zstd.NewWriter(tmp)
+	if err != nil {
+		return
+	}
+
+	_, err = io.Copy(enc, src)
+	if err != nil {
+		enc.Close()
+		return
+	}
+	err = enc.Close()
+	if err != nil {
+		return
+	}
+
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return
+	}
+	tmpInfo, err := tmp.Stat()
+	if err != nil {
+		return
+	}
+	if tmpInfo.Size() >= srcInfo.Size() {
+		return "", nil
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	err = os.Rename(tmp.Name(), filePath)
+	if err != nil {
+		return
+	}
+
+	return encodingZstd, nil
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+	f *os.File
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return z.f.Close()
+}
+
+// Open a file stored with the given encoding for reading its original
+// contents
+func openDecoded(filePath string, encoding string) (io.ReadCloser, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch encoding {
+	case "":
+		return f, nil
+	case encodingZstd:
+		dec, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return zstdReadCloser{dec, f}, nil
+	default:
+		f.Close()
+		return nil, errors.New("unknown file encoding " + encoding)
+	}
+}
+
+// Serve a compressed file as is to clients that accept its encoding,
+// transcode it to gzip for clients that only accept that, and decompress
+// it for everyone else and for range requests
+func serveEncoded(w http.ResponseWriter, r *http.Request, filePath string, metadata backends.Metadata) error {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if r.Header.Get("Range") == "" {
+		if acceptsEncoding(r, metadata.Encoding) {
+			f, err := os.Open(filePath)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			fileInfo, err := f.Stat()
+			if err != nil {
+				return err
+			}
+
+			setEncodingHeaders(w, metadata.Encoding)
+			w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
+			_, err = io.Copy(w, f)
+			return err
+		}
+
+		if acceptsEncoding(r, "gzip") {
+			rc, err := openDecoded(filePath, metadata.Encoding)
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+
+			setEncodingHeaders(w, "gzip")
+			w.Header().Del("Content-Length")
+			gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+			_, err = io.Copy(gz, rc)
+			if err != nil {
+				return err
+			}
+			return gz.Close()
+		}
+	}
+
+	rs := &decodedReadSeeker{path: filePath, encoding: metadata.Encoding, size: metadata.Size}
+	defer rs.Close()
+
+	http.ServeContent(w, r, path.Base(filePath), time.Time{}, rs)
+	return nil
+}
+
+func setEncodingHeaders(w http.ResponseWriter, encoding string) {
+	w.Header().Set("Content-Encoding", encoding)
+	w.Header().Del("Accept-Ranges")
+
+	// The encoded bytes differ from the ones the Etag was computed on
+	if etag := w.Header().Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header().Set("Etag", "W/"+etag)
+	}
+}
+
+// Check whether the Accept-Encoding header of a request lists an encoding
+// without q=0
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(accepted, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+
+		for _, param := range strings.Split(params, ";") {
+			q, found := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if found && strings.Trim(q, "0.") == "" {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Provides seeking within the original contents of an encoded file by
+// decoding it again from the start when needed
+type decodedReadSeeker struct {
+	path     string
+	encoding string
+	size     int64
+	pos      int64
+	rc       io.ReadCloser
+}
+
+func (d *decodedReadSeeker) Read(p []byte) (n int, err error) {
+	if d.pos >= d.size {
+		return 0, io.EOF
+	}
+
+	if d.rc == nil {
+		d.rc, err = openDecoded(d.path, d.encoding)
+		if err != nil {
+			return 0, err
+		}
+
+		_, err = io.CopyN(io.Discard, d.rc, d.pos)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err = d.rc.Read(p)
+	d.pos += int64(n)
+	return
+}
+
+func (d *decodedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	pos := offset
+	switch whence {
+	case io.SeekCurrent:
+		pos += d.pos
+	case io.SeekEnd:
+		pos += d.size
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	if pos != d.pos {
+		d.Close()
+		d.pos = pos
+	}
+	return pos, nil
+}
+
+func (d *decodedReadSeeker) Close() error {
+	if d.rc == nil {
+		return nil
+	}
+	err := d.rc.Close()
+	d.rc = nil
+	return err
+}
@@ -1,44 +1,65 @@
 package localfs
 
 import (
-	"encoding/json"
 	"io"
+	"io/fs"
 	"net/http"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
 	"github.com/andreimarcu/linx-server/helpers"
 )
 
+// Name of the directory, in both the files and metadata paths, that holds
+// content-addressed blobs and their reference counts when dedup is enabled
+const blobsDir = ".blobs"
+
+// Serializes blob reference count updates within this process
+var blobMutex sync.Mutex
+
 type LocalfsBackend struct {
 	metaPath  string
 	filesPath string
+	dedup     bool
+	compress  bool
+	files     shardLayout
+	metaStore MetaStore
 }
 
-type MetadataJSON struct {
-	DeleteKey    string   `json:"delete_key"`
-	AccessKey    string   `json:"access_key,omitempty"`
-	Sha256sum    string   `json:"sha256sum"`
-	Mimetype     string   `json:"mimetype"`
-	Size         int64    `json:"size"`
-	Expiry       int64    `json:"expiry"`
-	SrcIp        string   `json:"srcip,omitempty"`
-	ArchiveFiles []string `json:"archive_files,omitempty"`
+type LocalfsOptions struct {
+	MetaPath  string
+	FilesPath string
+	// Store identical uploads only once, under their sha256sum
+	Dedup bool
+	// Compress text uploads with zstd
+	Compress bool
+	// Levels of subdirectories to spread files and metadata over, from 0
+	// for a flat layout to MaxShardDepth. Files still in the flat layout
+	// are found as well, and can be moved with MigrateShards.
+	ShardDepth int
+	// Where to keep metadata, defaults to one JSON file per key in MetaPath
+	MetaStore MetaStore
 }
 
 func (b LocalfsBackend) Delete(key string) (err error) {
-	err = os.Remove(path.Join(b.filesPath, key))
+	blobMutex.Lock()
+	err = b.unlinkFile(key)
+	blobMutex.Unlock()
 	if err != nil {
 		return
 	}
-	err = os.Remove(path.Join(b.metaPath, key))
+	err = b.metaStore.Delete(key)
 	return
 }
 
 func (b LocalfsBackend) Exists(key string) (bool, error) {
-	_, err := os.Stat(path.Join(b.filesPath, key))
+	_, err := os.Stat(b.files.path(key))
 	if os.IsNotExist(err) {
 		return false, nil
 	}
@@ -46,30 +67,7 @@ func (b LocalfsBackend) Exists(key string) (bool, error) {
 }
 
 func (b LocalfsBackend) Head(key string) (metadata backends.Metadata, err error) {
-	f, err := os.Open(path.Join(b.metaPath, key))
-	if os.IsNotExist(err) {
-		return metadata, backends.NotFoundErr
-	} else if err != nil {
-		return metadata, backends.BadMetadata
-	}
-	defer f.Close()
-
-	decoder := json.NewDecoder(f)
-
-	mjson := MetadataJSON{}
-	if err := decoder.Decode(&mjson); err != nil {
-		return metadata, backends.BadMetadata
-	}
-
-	metadata.DeleteKey = mjson.DeleteKey
-	metadata.AccessKey = mjson.AccessKey
-	metadata.Mimetype = mjson.Mimetype
-	metadata.ArchiveFiles = mjson.ArchiveFiles
-	metadata.Sha256sum = mjson.Sha256sum
-	metadata.Expiry = time.Unix(mjson.Expiry, 0)
-	metadata.Size = mjson.Size
-
-	return
+	return b.metaStore.Get(key)
 }
 
 func (b LocalfsBackend) Get(key string) (metadata backends.Metadata, f io.ReadCloser, err error) {
@@ -78,7 +76,7 @@ func (b LocalfsBackend) Get(key string) (metadata backends.Metadata, f io.ReadCl
 		return
 	}
 
-	f, err = os.Open(path.Join(b.filesPath, key))
+	f, err = openDecoded(b.files.path(key), metadata.Encoding)
 	if err != nil {
 		return
 	}
@@ -86,87 +84,144 @@ func (b LocalfsBackend) Get(key string) (metadata backends.Metadata, f io.ReadCl
 	return
 }
 
+func (b LocalfsBackend) GetFrom(key string, offset int64) (io.ReadCloser, error) {
+	metadata, err := b.Head(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := openDecoded(b.files.path(key), metadata.Encoding)
+	if os.IsNotExist(err) {
+		return nil, backends.NotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	if seeker, ok := f.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, f, offset)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
 func (b LocalfsBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
-	_, err = b.Head(key)
+	metadata, err := b.Head(key)
 	if err != nil {
 		return
 	}
 
-	filePath := path.Join(b.filesPath, key)
+	filePath := b.files.path(key)
+	if metadata.Encoding != "" {
+		return serveEncoded(w, r, filePath, metadata)
+	}
+
 	http.ServeFile(w, r, filePath)
 
 	return
 }
 
 func (b LocalfsBackend) writeMetadata(key string, metadata backends.Metadata) error {
-	metaPath := path.Join(b.metaPath, key)
+	return b.metaStore.Put(key, metadata)
+}
 
-	mjson := MetadataJSON{
-		DeleteKey:    metadata.DeleteKey,
-		AccessKey:    metadata.AccessKey,
-		Mimetype:     metadata.Mimetype,
-		ArchiveFiles: metadata.ArchiveFiles,
-		Sha256sum:    metadata.Sha256sum,
-		Expiry:       metadata.Expiry.Unix(),
-		Size:         metadata.Size,
-		SrcIp:        metadata.SrcIp,
+func (b LocalfsBackend) Put(key string, r io.Reader, m backends.Metadata) (stored backends.Metadata, err error) {
+	if b.dedup {
+		return b.putDedup(key, r, m)
 	}
 
-	dst, err := os.Create(metaPath)
+	filePath, err := b.files.createPath(key)
 	if err != nil {
-		return err
+		return
 	}
-	defer dst.Close()
 
-	encoder := json.NewEncoder(dst)
-	err = encoder.Encode(mjson)
+	// The file is written next to where it goes, hidden so that it isn't
+	// listed, and only replaces the previous one once its metadata is
+	// stored
+	tmp, err := os.CreateTemp(path.Dir(filePath), ".upload-")
 	if err != nil {
-		os.Remove(metaPath)
-		return err
+		return
 	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-	return nil
-}
+	mw := helpers.NewMetadataWriter()
+	defer mw.Close()
+
+	bytes, err := io.Copy(io.MultiWriter(tmp, mw), r)
+	if bytes == 0 {
+		return stored, backends.FileEmptyError
+	} else if err != nil {
+		return
+	}
 
-func (b LocalfsBackend) Put(key string, r io.Reader, expiry time.Time, deleteKey, accessKey string, srcIp string) (m backends.Metadata, err error) {
-	filePath := path.Join(b.filesPath, key)
+	m = mw.Complete(m, tmp)
+	m.Encoding = ""
 
-	dst, err := os.Create(filePath)
+	err = tmp.Close()
 	if err != nil {
 		return
 	}
-	defer dst.Close()
 
-	bytes, err := io.Copy(dst, r)
-	if bytes == 0 {
-		os.Remove(filePath)
-		return m, backends.FileEmptyError
-	} else if err != nil {
-		os.Remove(filePath)
-		return m, err
+	if b.compress && compressible(m) {
+		m.Encoding, err = compressFile(tmp.Name())
+		if err != nil {
+			return
+		}
 	}
 
-	_, err = dst.Seek(0, 0)
-	m, err = helpers.GenerateMetadata(dst)
-	_, err = dst.Seek(0, 0)
+	blobMutex.Lock()
+	err = b.replaceFile(key, tmp.Name(), filePath, m)
+	blobMutex.Unlock()
 	if err != nil {
-		os.Remove(filePath)
 		return
 	}
 
-	m.Expiry = expiry
-	m.DeleteKey = deleteKey
-	m.AccessKey = accessKey
-	m.SrcIp = srcIp
-	m.ArchiveFiles, _ = helpers.ListArchiveFiles(m.Mimetype, m.Size, dst)
+	return m, nil
+}
 
-	err = b.writeMetadata(key, m)
+// Store the metadata of key, then move the file written at src in place
+// of the previous one, so that the file is never served without its
+// metadata. The previous metadata is restored if the file can't be moved,
+// and the blob the previous file was linked to is released once it is
+// replaced. Callers must hold blobMutex.
+func (b LocalfsBackend) replaceFile(key string, src string, filePath string, m backends.Metadata) error {
+	previousPath, previousBlob := b.linkedBlob(key)
+	previous, headErr := b.Head(key)
+
+	err := b.writeMetadata(key, m)
 	if err != nil {
-		os.Remove(filePath)
-		return
+		return err
 	}
 
-	return
+	err = os.Rename(src, filePath)
+	if err != nil {
+		if headErr == nil {
+			b.writeMetadata(key, previous)
+		} else {
+			b.metaStore.Delete(key)
+		}
+		return err
+	}
+
+	// A previous file left in the flat layout would be found again once
+	// this one is deleted
+	if previousPath != filePath {
+		os.Remove(previousPath)
+	}
+
+	// The file is stored by now, so a blob that can't be released is only
+	// kept longer than needed
+	if previousBlob != "" && b.addBlobRef(previousBlob, -1) == nil {
+		b.releaseBlob(previousBlob)
+	}
+
+	return nil
 }
 
 func (b LocalfsBackend) PutMetadata(key string, m backends.Metadata) (err error) {
@@ -179,7 +234,11 @@ func (b LocalfsBackend) PutMetadata(key string, m backends.Metadata) (err error)
 }
 
 func (b LocalfsBackend) Size(key string) (int64, error) {
-	fileInfo, err := os.Stat(path.Join(b.filesPath, key))
+	if metadata, err := b.Head(key); err == nil && metadata.Encoding != "" {
+		return metadata.Size, nil
+	}
+
+	fileInfo, err := os.Stat(b.files.path(key))
 	if err != nil {
 		return 0, err
 	}
@@ -190,21 +249,262 @@ func (b LocalfsBackend) Size(key string) (int64, error) {
 func (b LocalfsBackend) List() ([]string, error) {
 	var output []string
 
-	files, err := os.ReadDir(b.filesPath)
+	err := b.files.walk(func(key string, entry fs.DirEntry) error {
+		output = append(output, key)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
+	return output, nil
+}
+
+// Move the file and metadata of key from the flat layout to the one
+// configured with ShardDepth, if they aren't there already. This is safe to
+// do while a server is using the same store.
+func (b LocalfsBackend) MigrateShards(key string) (moved bool, err error) {
+	moved, err = b.files.migrate(key)
+	if err != nil {
+		return
+	}
+
+	if store, ok := b.metaStore.(JSONMetaStore); ok {
+		metaMoved, err := store.migrate(key)
+		return moved || metaMoved, err
+	}
+
+	return
+}
+
+func (b LocalfsBackend) ListExpired() ([]string, error) {
+	if index, ok := b.metaStore.(ExpiryIndex); ok {
+		return index.ExpiredBefore(time.Now())
+	}
+
+	files, err := b.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var output []string
 	for _, file := range files {
-		output = append(output, file.Name())
+		metadata, err := b.Head(file)
+		if err != nil || expiry.IsTsExpired(metadata.Expiry) {
+			output = append(output, file)
+		}
 	}
 
 	return output, nil
 }
 
-func NewLocalfsBackend(metaPath string, filesPath string) LocalfsBackend {
+// Store the upload once under its sha256sum and link key to it. Identical
+// uploads share the same blob, which is removed along with its last name.
+func (b LocalfsBackend) putDedup(key string, r io.Reader, m backends.Metadata) (stored backends.Metadata, err error) {
+	blobsPath := path.Join(b.filesPath, blobsDir)
+	err = os.MkdirAll(blobsPath, 0755)
+	if err != nil {
+		return
+	}
+
+	tmp, err := os.CreateTemp(blobsPath, "upload-")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	mw := helpers.NewMetadataWriter()
+	defer mw.Close()
+
+	bytes, err := io.Copy(io.MultiWriter(tmp, mw), r)
+	if bytes == 0 {
+		return stored, backends.FileEmptyError
+	} else if err != nil {
+		return
+	}
+
+	m = mw.Complete(m, tmp)
+	m.Encoding = ""
+
+	err = tmp.Close()
+	if err != nil {
+		return
+	}
+
+	if b.compress && compressible(m) {
+		m.Encoding, err = compressFile(tmp.Name())
+		if err != nil {
+			return
+		}
+	}
+
+	filePath, err := b.files.createPath(key)
+	if err != nil {
+		return
+	}
+
+	blobMutex.Lock()
+	defer blobMutex.Unlock()
+
+	blob := blobName(m.Sha256sum, m.Encoding)
+	blobPath := path.Join(blobsPath, blob)
+	if _, err = os.Stat(blobPath); os.IsNotExist(err) {
+		err = os.Rename(tmp.Name(), blobPath)
+	}
+	if err != nil {
+		return
+	}
+
+	// The blob is referenced before the previous file is released, which
+	// might be linked to the very same blob
+	err = b.addBlobRef(blob, 1)
+	if err != nil {
+		b.releaseBlob(blob)
+		return
+	}
+
+	link, err := tempLink(blobPath, path.Dir(filePath))
+	if err == nil {
+		defer os.Remove(link)
+		err = b.replaceFile(key, link, filePath, m)
+	}
+	if err != nil {
+		b.addBlobRef(blob, -1)
+		b.releaseBlob(blob)
+		return
+	}
+
+	return m, nil
+}
+
+// Link a hidden name in dir to target, so that it can be moved in place of
+// another file
+func tempLink(target string, dir string) (string, error) {
+	for {
+		f, err := os.CreateTemp(dir, ".link-")
+		if err != nil {
+			return "", err
+		}
+		f.Close()
+		os.Remove(f.Name())
+
+		err = os.Link(target, f.Name())
+		if !os.IsExist(err) {
+			return f.Name(), err
+		}
+	}
+}
+
+// Remove the file stored under key. If it is a name for a deduplicated blob,
+// drop its reference and remove the blob once no other name points to it.
+// Callers must hold blobMutex.
+func (b LocalfsBackend) unlinkFile(key string) error {
+	filePath, blob := b.linkedBlob(key)
+
+	err := os.Remove(filePath)
+	if err != nil {
+		return err
+	}
+
+	if blob != "" {
+		err = b.addBlobRef(blob, -1)
+		if err != nil {
+			return err
+		}
+		return b.releaseBlob(blob)
+	}
+
+	return nil
+}
+
+// Path of the file stored under key, and the name of the deduplicated blob
+// it is linked to, if any
+func (b LocalfsBackend) linkedBlob(key string) (filePath string, blob string) {
+	filePath = b.files.path(key)
+
+	if metadata, err := b.Head(key); err == nil && metadata.Sha256sum != "" {
+		name := blobName(metadata.Sha256sum, metadata.Encoding)
+		fileInfo, ferr := os.Stat(filePath)
+		blobInfo, berr := os.Stat(path.Join(b.filesPath, blobsDir, name))
+		if ferr == nil && berr == nil && os.SameFile(fileInfo, blobInfo) {
+			blob = name
+		}
+	}
+
+	return
+}
+
+// Blobs are named after the sha256sum of their contents, with the encoding
+// they are stored with as an extension
+func blobName(sum string, encoding string) string {
+	if encoding == "" {
+		return sum
+	}
+	return sum + "." + encoding
+}
+
+func (b LocalfsBackend) blobRefs(blob string) (int64, error) {
+	contents, err := os.ReadFile(path.Join(b.metaPath, blobsDir, blob))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(contents)), 10, 64)
+}
+
+func (b LocalfsBackend) addBlobRef(blob string, delta int64) error {
+	refsPath := path.Join(b.metaPath, blobsDir)
+	err := os.MkdirAll(refsPath, 0700)
+	if err != nil {
+		return err
+	}
+
+	refs, err := b.blobRefs(blob)
+	if err != nil {
+		return err
+	}
+
+	refs += delta
+	if refs <= 0 {
+		err = os.Remove(path.Join(refsPath, blob))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	return os.WriteFile(path.Join(refsPath, blob), []byte(strconv.FormatInt(refs, 10)+"\n"), 0600)
+}
+
+// Remove the blob if nothing references it anymore
+func (b LocalfsBackend) releaseBlob(blob string) error {
+	refs, err := b.blobRefs(blob)
+	if err != nil || refs > 0 {
+		return err
+	}
+
+	err = os.Remove(path.Join(b.filesPath, blobsDir, blob))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func NewLocalfsBackend(o LocalfsOptions) LocalfsBackend {
+	metaStore := o.MetaStore
+	if metaStore == nil {
+		metaStore = NewJSONMetaStore(o.MetaPath, o.ShardDepth)
+	}
+
 	return LocalfsBackend{
-		metaPath:  metaPath,
-		filesPath: filesPath,
+		metaPath:  o.MetaPath,
+		filesPath: o.FilesPath,
+		dedup:     o.Dedup,
+		compress:  o.Compress,
+		files:     shardLayout{dir: o.FilesPath, depth: o.ShardDepth},
+		metaStore: metaStore,
 	}
 }
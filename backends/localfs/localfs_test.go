@@ -0,0 +1,519 @@
+package localfs
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/klauspost/compress/zstd"
+)
+
+func newTestBackend(t *testing.T, dedup bool) LocalfsBackend {
+	dir := t.TempDir()
+	filesPath := path.Join(dir, "files")
+	metaPath := path.Join(dir, "meta")
+	for _, p := range []string{filesPath, metaPath} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewLocalfsBackend(LocalfsOptions{
+		MetaPath:  metaPath,
+		FilesPath: filesPath,
+		Dedup:     dedup,
+	})
+}
+
+func readAll(t *testing.T, b LocalfsBackend, key string) string {
+	_, r, err := b.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestDedupSharesBlob(t *testing.T) {
+	b := newTestBackend(t, true)
+
+	m, err := b.Put("a.txt", strings.NewReader("same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put("b.txt", strings.NewReader("same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobPath := path.Join(b.filesPath, blobsDir, m.Sha256sum)
+	if refs, _ := b.blobRefs(m.Sha256sum); refs != 2 {
+		t.Fatalf("Expected 2 references to the blob, got %d", refs)
+	}
+
+	files, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "a.txt,b.txt" {
+		t.Fatalf("Unexpected file list %v", files)
+	}
+
+	err = b.Delete("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(blobPath); err != nil {
+		t.Fatalf("Blob was removed while still referenced: %v", err)
+	}
+	if readAll(t, b, "b.txt") != "same content" {
+		t.Fatal("Remaining name lost its contents")
+	}
+
+	err = b.Delete("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Fatalf("Blob was not removed with its last name: %v", err)
+	}
+	if _, err := os.Stat(path.Join(b.metaPath, blobsDir, m.Sha256sum)); !os.IsNotExist(err) {
+		t.Fatalf("Reference count was not removed with its last name: %v", err)
+	}
+}
+
+func TestDedupOverwrite(t *testing.T) {
+	b := newTestBackend(t, true)
+
+	m, err := b.Put("a.txt", strings.NewReader("same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put("b.txt", strings.NewReader("same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwriting with the same contents keeps the blob
+	_, err = b.Put("a.txt", strings.NewReader("same content"), backends.Metadata{Expiry: time.Now().Add(time.Hour), DeleteKey: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refs, _ := b.blobRefs(m.Sha256sum); refs != 2 {
+		t.Fatalf("Expected 2 references to the blob, got %d", refs)
+	}
+
+	// Overwriting with other contents, even without dedup, must not touch
+	// the shared blob
+	nb := b
+	nb.dedup = false
+	_, err = nb.Put("a.txt", strings.NewReader("other content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if readAll(t, b, "a.txt") != "other content" {
+		t.Fatal("Overwritten name has the wrong contents")
+	}
+	if readAll(t, b, "b.txt") != "same content" {
+		t.Fatal("Shared blob was modified by an overwrite")
+	}
+	if refs, _ := b.blobRefs(m.Sha256sum); refs != 1 {
+		t.Fatalf("Expected 1 reference to the blob, got %d", refs)
+	}
+}
+
+func TestPutWithMetadata(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		b := newTestBackend(t, dedup)
+
+		m, err := b.Put("a.txt", strings.NewReader("same content"), backends.Metadata{
+			Expiry:       expiry.NeverExpire,
+			DeleteKey:    "a",
+			Mimetype:     "text/uri-list",
+			OriginalName: "A.txt",
+			MaxDownloads: 1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		head, err := b.Head("a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range []backends.Metadata{m, head} {
+			if got.Mimetype != "text/uri-list" || got.OriginalName != "A.txt" || got.MaxDownloads != 1 ||
+				got.Size != 12 || got.Sha256sum == "" || got.DeleteKey != "a" {
+				t.Fatalf("[dedup %v] Unexpected metadata %+v", dedup, got)
+			}
+		}
+
+		// A failed overwrite leaves the file and its metadata as they were
+		broken := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("broken")))
+		_, err = b.Put("a.txt", broken, backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "a"})
+		if err == nil {
+			t.Fatalf("[dedup %v] No error for a broken upload", dedup)
+		}
+
+		head, err = b.Head("a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.Sha256sum != m.Sha256sum || head.MaxDownloads != 1 || readAll(t, b, "a.txt") != "same content" {
+			t.Fatalf("[dedup %v] File changed by a failed overwrite %+v", dedup, head)
+		}
+
+		// Files are written aside until they are complete
+		files, err := b.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 1 || files[0] != "a.txt" {
+			t.Fatalf("[dedup %v] Unexpected files %v", dedup, files)
+		}
+	}
+}
+
+func TestBoltMetaStoreIndexes(t *testing.T) {
+	store, err := NewBoltMetaStore(path.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	b := newTestBackend(t, false)
+	b.metaStore = store
+
+	past := time.Now().Add(-time.Hour)
+	_, err = b.Put("expired.txt", strings.NewReader("same content"), backends.Metadata{Expiry: past, DeleteKey: "a", SrcIp: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.Put("forever.txt", strings.NewReader("same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: "b", SrcIp: "10.0.0.2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := b.Put("later.txt", strings.NewReader("other content"), backends.Metadata{Expiry: time.Now().Add(time.Hour), DeleteKey: "c", SrcIp: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	head, err := b.Head("later.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.DeleteKey != "c" || head.SrcIp != "10.0.0.1" || head.Sha256sum != m.Sha256sum {
+		t.Fatalf("Unexpected metadata %+v", head)
+	}
+
+	expired, err := b.ListExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(expired, ",") != "expired.txt" {
+		t.Fatalf("Unexpected expired files %v", expired)
+	}
+
+	bySum, err := store.BySha256(m.Sha256sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(bySum, ",") != "later.txt" {
+		t.Fatalf("Unexpected files by sha256sum %v", bySum)
+	}
+
+	byIp, err := store.BySrcIp("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(byIp, ",") != "expired.txt,later.txt" {
+		t.Fatalf("Unexpected files by source IP %v", byIp)
+	}
+
+	uploaded, err := store.UploadedBetween(time.Now().Add(-time.Minute), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploaded) != 3 {
+		t.Fatalf("Unexpected files by upload time %v", uploaded)
+	}
+
+	// Updating metadata moves the file in the indexes
+	head.Expiry = past
+	err = b.PutMetadata("later.txt", head)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.Delete("expired.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expired, err = b.ListExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(expired, ",") != "later.txt" {
+		t.Fatalf("Unexpected expired files %v", expired)
+	}
+
+	if _, err := b.Head("expired.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr for deleted file, got %v", err)
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		b := newTestBackend(t, dedup)
+		b.compress = true
+
+		content := strings.Repeat("compressible text\n", 200)
+		m, err := b.Put("text.txt", strings.NewReader(content), backends.Metadata{Expiry: expiry.NeverExpire})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Encoding != encodingZstd {
+			t.Fatalf("Expected text upload to be compressed, got encoding %q", m.Encoding)
+		}
+
+		fileInfo, err := os.Stat(path.Join(b.filesPath, "text.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileInfo.Size() >= int64(len(content)) {
+			t.Fatalf("Stored file of %d bytes is not smaller than %d", fileInfo.Size(), len(content))
+		}
+
+		if size, _ := b.Size("text.txt"); size != int64(len(content)) {
+			t.Fatalf("Expected original size %d, got %d", len(content), size)
+		}
+		if readAll(t, b, "text.txt") != content {
+			t.Fatal("Decompressed contents do not match")
+		}
+
+		r, err := b.GetFrom("text.txt", 18)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := io.ReadAll(r)
+		r.Close()
+		if string(rest) != content[18:] {
+			t.Fatal("Contents from offset do not match")
+		}
+
+		err = b.Delete("text.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCompressSkipsSmallAndBinary(t *testing.T) {
+	b := newTestBackend(t, false)
+	b.compress = true
+
+	m, err := b.Put("small.txt", strings.NewReader("short text"), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Encoding != "" {
+		t.Fatalf("Small upload was compressed")
+	}
+
+	binary := append([]byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}, make([]byte, 4096)...)
+	m, err = b.Put("image.png", bytes.NewReader(binary), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Encoding != "" {
+		t.Fatalf("Upload of type %s was compressed", m.Mimetype)
+	}
+}
+
+func TestServeCompressed(t *testing.T) {
+	b := newTestBackend(t, false)
+	b.compress = true
+
+	content := strings.Repeat("compressible text\n", 200)
+	_, err := b.Put("text.txt", strings.NewReader(content), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(header, value string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/selif/text.txt", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		if err := b.ServeFile("text.txt", w, req); err != nil {
+			t.Fatal(err)
+		}
+		return w
+	}
+
+	w := serve("Accept-Encoding", "gzip, zstd")
+	if w.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("Expected zstd encoding, got %q", w.Header().Get("Content-Encoding"))
+	}
+	dec, err := zstd.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(dec)
+	dec.Close()
+	if string(got) != content {
+		t.Fatal("zstd response does not match")
+	}
+
+	w = serve("Accept-Encoding", "gzip, zstd;q=0")
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Expected gzip encoding, got %q", w.Header().Get("Content-Encoding"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = io.ReadAll(gz)
+	if string(got) != content {
+		t.Fatal("gzip response does not match")
+	}
+
+	w = serve("", "")
+	if w.Header().Get("Content-Encoding") != "" || w.Body.String() != content {
+		t.Fatal("Plain response does not match")
+	}
+
+	w = serve("Range", "bytes=18-35")
+	if w.Code != http.StatusPartialContent || w.Body.String() != content[18:36] {
+		t.Fatalf("Range response does not match, got status %d", w.Code)
+	}
+}
+
+func TestShardedLayout(t *testing.T) {
+	b := newTestBackend(t, false)
+	b = NewLocalfsBackend(LocalfsOptions{
+		MetaPath:   b.metaPath,
+		FilesPath:  b.filesPath,
+		ShardDepth: 2,
+	})
+
+	_, err := b.Put("a.txt", strings.NewReader("sharded"), backends.Metadata{Expiry: expiry.NeverExpire})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shardedPath := b.files.shardedPath("a.txt")
+	rel := strings.TrimPrefix(shardedPath, b.filesPath+"/")
+	if len(strings.Split(rel, "/")) != 3 {
+		t.Fatalf("Unexpected sharded path %s", shardedPath)
+	}
+	if _, err := os.Stat(shardedPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path.Join(b.metaPath, rel)); err != nil {
+		t.Fatalf("Metadata not stored in sharded layout: %v", err)
+	}
+
+	if readAll(t, b, "a.txt") != "sharded" {
+		t.Fatal("Sharded contents do not match")
+	}
+
+	files, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "a.txt" {
+		t.Fatalf("Unexpected file list %v", files)
+	}
+
+	err = b.Delete("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists, _ := b.Exists("a.txt"); exists {
+		t.Fatal("Sharded file was not deleted")
+	}
+}
+
+func TestMigrateShards(t *testing.T) {
+	flat := newTestBackend(t, true)
+
+	for _, key := range []string{"a.txt", "b.txt"} {
+		_, err := flat.Put(key, strings.NewReader("same content"), backends.Metadata{Expiry: expiry.NeverExpire, DeleteKey: key})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b := NewLocalfsBackend(LocalfsOptions{
+		MetaPath:   flat.metaPath,
+		FilesPath:  flat.filesPath,
+		Dedup:      true,
+		ShardDepth: 1,
+	})
+
+	// Files not moved yet are still found
+	m, err := b.Head("a.txt")
+	if err != nil || m.DeleteKey != "a.txt" {
+		t.Fatalf("Flat metadata not found: %v", err)
+	}
+	if readAll(t, b, "a.txt") != "same content" {
+		t.Fatal("Flat contents do not match")
+	}
+
+	for _, key := range []string{"a.txt", "b.txt"} {
+		moved, err := b.MigrateShards(key)
+		if err != nil || !moved {
+			t.Fatalf("Expected %s to be moved: %v", key, err)
+		}
+		if _, err := os.Stat(path.Join(b.filesPath, key)); !os.IsNotExist(err) {
+			t.Fatalf("%s left in flat layout", key)
+		}
+		if _, err := os.Stat(path.Join(b.metaPath, key)); !os.IsNotExist(err) {
+			t.Fatalf("Metadata of %s left in flat layout", key)
+		}
+	}
+
+	if moved, err := b.MigrateShards("a.txt"); err != nil || moved {
+		t.Fatalf("Expected nothing left to move: %v", err)
+	}
+
+	if readAll(t, b, "b.txt") != "same content" {
+		t.Fatal("Moved contents do not match")
+	}
+
+	// Moved files are still links to their blob
+	err = b.Delete("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Delete("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobPath := path.Join(b.filesPath, blobsDir, m.Sha256sum)
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Fatalf("Blob was not removed with its last name: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package localfs
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Persists the metadata of the files stored by LocalfsBackend
+type MetaStore interface {
+	Get(key string) (backends.Metadata, error)
+	Put(key string, m backends.Metadata) error
+	Delete(key string) error
+}
+
+// Implemented by metadata stores that index metadata by expiry
+type ExpiryIndex interface {
+	ExpiredBefore(t time.Time) ([]string, error)
+}
+
+type MetadataJSON struct {
+	DeleteKey    string   `json:"delete_key"`
+	AccessKey    string   `json:"access_key,omitempty"`
+	Sha256sum    string   `json:"sha256sum"`
+	Mimetype     string   `json:"mimetype"`
+	Size         int64    `json:"size"`
+	Expiry       int64    `json:"expiry"`
+	SrcIp        string   `json:"srcip,omitempty"`
+	OriginalName string   `json:"original_name,omitempty"`
+	ArchiveFiles []string `json:"archive_files,omitempty"`
+	MaxDownloads int64    `json:"max_downloads,omitempty"`
+	Downloads    int64    `json:"downloads,omitempty"`
+	Malware      string   `json:"malware,omitempty"`
+	Uploader     string   `json:"uploader,omitempty"`
+	Collection   string   `json:"collection,omitempty"`
+	Revision     int64    `json:"revision,omitempty"`
+	Encoding     string   `json:"encoding,omitempty"`
+	Envelope     string   `json:"envelope,omitempty"`
+}
+
+func metadataToJSON(metadata backends.Metadata) MetadataJSON {
+	return MetadataJSON{
+		DeleteKey:    metadata.DeleteKey,
+		AccessKey:    metadata.AccessKey,
+		Mimetype:     metadata.Mimetype,
+		ArchiveFiles: metadata.ArchiveFiles,
+		Sha256sum:    metadata.Sha256sum,
+		Expiry:       metadata.Expiry.Unix(),
+		Size:         metadata.Size,
+		SrcIp:        metadata.SrcIp,
+		OriginalName: metadata.OriginalName,
+		MaxDownloads: metadata.MaxDownloads,
+		Downloads:    metadata.Downloads,
+		Malware:      metadata.Malware,
+		Uploader:     metadata.Uploader,
+		Collection:   metadata.Collection,
+		Revision:     metadata.Revision,
+		Encoding:     metadata.Encoding,
+		Envelope:     metadata.Envelope,
+	}
+}
+
+func metadataFromJSON(mjson MetadataJSON) (metadata backends.Metadata) {
+	metadata.DeleteKey = mjson.DeleteKey
+	metadata.AccessKey = mjson.AccessKey
+	metadata.Mimetype = mjson.Mimetype
+	metadata.ArchiveFiles = mjson.ArchiveFiles
+	metadata.Sha256sum = mjson.Sha256sum
+	metadata.Expiry = time.Unix(mjson.Expiry, 0)
+	metadata.Size = mjson.Size
+	metadata.SrcIp = mjson.SrcIp
+	metadata.OriginalName = mjson.OriginalName
+	metadata.MaxDownloads = mjson.MaxDownloads
+	metadata.Downloads = mjson.Downloads
+	metadata.Malware = mjson.Malware
+	metadata.Uploader = mjson.Uploader
+	metadata.Collection = mjson.Collection
+	metadata.Revision = mjson.Revision
+	metadata.Encoding = mjson.Encoding
+	metadata.Envelope = mjson.Envelope
+
+	return
+}
+
+// Stores the metadata of each key as a JSON file in a directory, laid out
+// the same way as the files themselves
+type JSONMetaStore struct {
+	layout shardLayout
+}
+
+func (s JSONMetaStore) Get(key string) (metadata backends.Metadata, err error) {
+	f, err := os.Open(s.layout.path(key))
+	if os.IsNotExist(err) {
+		return metadata, backends.NotFoundErr
+	} else if err != nil {
+		return metadata, backends.BadMetadata
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+
+	mjson := MetadataJSON{}
+	if err := decoder.Decode(&mjson); err != nil {
+		return metadata, backends.BadMetadata
+	}
+
+	return metadataFromJSON(mjson), nil
+}
+
+func (s JSONMetaStore) Put(key string, metadata backends.Metadata) error {
+	metaPath, err := s.layout.createPath(key)
+	if err != nil {
+		return err
+	}
+
+	// Metadata is replaced at once, so that the previous metadata is kept
+	// if writing fails. Temporary files are hidden so they aren't listed.
+	dst, err := os.CreateTemp(path.Dir(metaPath), ".meta-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	encoder := json.NewEncoder(dst)
+	err = encoder.Encode(metadataToJSON(metadata))
+	if err != nil {
+		return err
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(dst.Name(), metaPath)
+	if err != nil {
+		return err
+	}
+
+	// Drop metadata left in the flat layout, which would otherwise become
+	// visible again once this is deleted
+	if metaPath != s.layout.flatPath(key) {
+		os.Remove(s.layout.flatPath(key))
+	}
+
+	return nil
+}
+
+func (s JSONMetaStore) Delete(key string) error {
+	return os.Remove(s.layout.path(key))
+}
+
+// List the keys that have metadata, along with when it was last written
+func (s JSONMetaStore) List() (map[string]time.Time, error) {
+	output := make(map[string]time.Time)
+
+	err := s.layout.walk(func(key string, entry fs.DirEntry) error {
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		output[key] = info.ModTime()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+// Move the metadata of key from the flat to the sharded layout
+func (s JSONMetaStore) migrate(key string) (bool, error) {
+	return s.layout.migrate(key)
+}
+
+// Metadata is spread over shardDepth levels of subdirectories, see
+// LocalfsOptions.ShardDepth
+func NewJSONMetaStore(metaPath string, shardDepth int) JSONMetaStore {
+	return JSONMetaStore{layout: shardLayout{dir: metaPath, depth: shardDepth}}
+}
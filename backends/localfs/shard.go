@@ -0,0 +1,138 @@
+package localfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Deepest supported fan-out, which already allows for 2^32 directories
+const MaxShardDepth = 4
+
+// Spreads the keys stored in a directory over nested subdirectories named
+// after the leading hex digits of the sha256 of each key, two per level, so
+// that key "name" is stored at "dir/ab/cd/name" with a depth of 2. Hashing
+// keeps the directories balanced even for similar names. A depth of 0 is
+// the flat layout.
+type shardLayout struct {
+	dir   string
+	depth int
+}
+
+func (l shardLayout) flatPath(key string) string {
+	return path.Join(l.dir, key)
+}
+
+func (l shardLayout) shardedPath(key string) string {
+	if l.depth == 0 {
+		return l.flatPath(key)
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	digits := hex.EncodeToString(sum[:l.depth])
+
+	elems := []string{l.dir}
+	for i := 0; i < l.depth; i++ {
+		elems = append(elems, digits[2*i:2*i+2])
+	}
+	return path.Join(append(elems, key)...)
+}
+
+// Path key is currently stored at. Stores that are still being migrated can
+// have it in the flat layout, and since a migration only ever moves a key
+// from its flat to its sharded path, the sharded path is the one to report
+// when the key is found at neither.
+func (l shardLayout) path(key string) string {
+	sharded := l.shardedPath(key)
+	if l.depth == 0 {
+		return sharded
+	}
+
+	if _, err := os.Lstat(sharded); err == nil {
+		return sharded
+	}
+	flat := l.flatPath(key)
+	if _, err := os.Lstat(flat); err == nil {
+		return flat
+	}
+	return sharded
+}
+
+// Path to write key to, with its parent directories created
+func (l shardLayout) createPath(key string) (string, error) {
+	sharded := l.shardedPath(key)
+	if l.depth == 0 {
+		return sharded, nil
+	}
+
+	err := os.MkdirAll(path.Dir(sharded), 0755)
+	if err != nil {
+		return "", err
+	}
+	return sharded, nil
+}
+
+// Move key from the flat to the sharded layout, if it is still in the flat
+// layout. The key is linked at its new path before being removed from the
+// old one, so that it can be found at all times by concurrent readers, and
+// a newer version written by the server in the meantime is never replaced.
+func (l shardLayout) migrate(key string) (moved bool, err error) {
+	if l.depth == 0 {
+		return false, nil
+	}
+
+	flat := l.flatPath(key)
+	if _, err = os.Lstat(flat); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return
+	}
+
+	sharded, err := l.createPath(key)
+	if err != nil {
+		return
+	}
+
+	err = os.Link(flat, sharded)
+	if err != nil && !os.IsExist(err) {
+		return
+	}
+
+	err = os.Remove(flat)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return
+	}
+
+	return true, nil
+}
+
+// Call fn for every key in either layout. Hidden files and directories, such
+// as temporary files and dedup blobs, are skipped.
+func (l shardLayout) walk(fn func(key string, entry fs.DirEntry) error) error {
+	return filepath.WalkDir(l.dir, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == l.dir {
+			return nil
+		}
+
+		if strings.HasPrefix(entry.Name(), ".") {
+			if entry.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		return fn(entry.Name(), entry)
+	})
+}
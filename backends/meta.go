@@ -6,14 +6,35 @@ import (
 )
 
 type Metadata struct {
-	DeleteKey    string
-	AccessKey    string
-	Sha256sum    string
-	Mimetype     string
-	Size         int64
-	Expiry       time.Time
-	SrcIp        string
+	DeleteKey string
+	AccessKey string
+	Sha256sum string
+	Mimetype  string
+	Size      int64
+	Expiry    time.Time
+	SrcIp     string
+	// Name the file was uploaded with, empty if it was stored under it
+	OriginalName string
 	ArchiveFiles []string
+	// Number of times the file can be downloaded before it is deleted, 0 if
+	// unlimited, and number of times it was downloaded so far
+	MaxDownloads int64
+	Downloads    int64
+	// Name of the malware a scanner found in the file, empty if none was
+	Malware string
+	// Label of the API key the file was uploaded with, empty if none
+	Uploader string
+	// ID of the collection the file was added to, empty if none
+	Collection string
+	// Number of the version of a paste that was edited, 0 if it never was.
+	// Earlier versions are kept as revisions.
+	Revision int64
+	// Content encoding the file is stored with, empty if stored as is.
+	// Size and Sha256sum always describe the original contents.
+	Encoding string
+	// Opaque data kept on behalf of a backend wrapping another one, such
+	// as the encrypted metadata of an EncryptedBackend
+	Envelope string
 }
 
 var BadMetadata = errors.New("Corrupted metadata.")
@@ -0,0 +1,348 @@
+package s3
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/helpers"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+type S3Backend struct {
+	bucket string
+	svc    *s3.S3
+}
+
+func (b S3Backend) Delete(key string) error {
+	_, err := b.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (b S3Backend) Exists(key string) (bool, error) {
+	_, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b S3Backend) Head(key string) (metadata backends.Metadata, err error) {
+	result, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return metadata, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	return unmapMetadata(result.Metadata)
+}
+
+func (b S3Backend) Get(key string) (metadata backends.Metadata, r io.ReadCloser, err error) {
+	result, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return metadata, nil, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	metadata, err = unmapMetadata(result.Metadata)
+	if err != nil {
+		result.Body.Close()
+		return
+	}
+
+	r = result.Body
+	return
+}
+
+func (b S3Backend) GetFrom(key string, offset int64) (io.ReadCloser, error) {
+	result, err := b.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String("bytes=" + strconv.FormatInt(offset, 10) + "-"),
+	})
+	if isNotFound(err) {
+		return nil, backends.NotFoundErr
+	} else if err != nil {
+		return nil, err
+	}
+
+	return result.Body, nil
+}
+
+func (b S3Backend) ServeFile(key string, w http.ResponseWriter, r *http.Request) (err error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	}
+
+	// Let S3 do the range handling, unless an If-Range precondition
+	// asks for the full file because it changed in the meantime
+	rangeHeader := r.Header.Get("Range")
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && ifRange != w.Header().Get("Etag") {
+		rangeHeader = ""
+	}
+	if rangeHeader != "" {
+		input.Range = aws.String(rangeHeader)
+	}
+
+	result, err := b.svc.GetObject(input)
+	if isNotFound(err) {
+		return backends.NotFoundErr
+	} else if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == http.StatusRequestedRangeNotSatisfiable {
+		w.Header().Set("Content-Range", "bytes */"+w.Header().Get("Content-Length"))
+		w.Header().Del("Content-Length")
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return nil
+	} else if err != nil {
+		return
+	}
+	defer result.Body.Close()
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	if result.ContentLength != nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(*result.ContentLength, 10))
+	}
+	if result.ContentRange != nil {
+		w.Header().Set("Content-Range", *result.ContentRange)
+		w.WriteHeader(http.StatusPartialContent)
+	}
+
+	_, err = io.Copy(w, result.Body)
+	return
+}
+
+func mapMetadata(m backends.Metadata) map[string]*string {
+	mapped := map[string]*string{
+		"Expiry":    aws.String(strconv.FormatInt(m.Expiry.Unix(), 10)),
+		"Deletekey": aws.String(m.DeleteKey),
+		"Accesskey": aws.String(m.AccessKey),
+		"Size":      aws.String(strconv.FormatInt(m.Size, 10)),
+		"Mimetype":  aws.String(m.Mimetype),
+		"Sha256sum": aws.String(m.Sha256sum),
+		"Srcip":     aws.String(m.SrcIp),
+		"Envelope":  aws.String(m.Envelope),
+	}
+	// Object metadata is sent as headers, which only allow ASCII
+	if m.OriginalName != "" {
+		mapped["Originalname"] = aws.String(url.PathEscape(m.OriginalName))
+	}
+	if m.MaxDownloads > 0 {
+		mapped["Maxdownloads"] = aws.String(strconv.FormatInt(m.MaxDownloads, 10))
+		mapped["Downloads"] = aws.String(strconv.FormatInt(m.Downloads, 10))
+	}
+	if m.Malware != "" {
+		mapped["Malware"] = aws.String(url.PathEscape(m.Malware))
+	}
+	if m.Uploader != "" {
+		mapped["Uploader"] = aws.String(url.PathEscape(m.Uploader))
+	}
+	if m.Collection != "" {
+		mapped["Collection"] = aws.String(m.Collection)
+	}
+	if m.Revision > 0 {
+		mapped["Revision"] = aws.String(strconv.FormatInt(m.Revision, 10))
+	}
+	return mapped
+}
+
+func unmapMetadata(input map[string]*string) (m backends.Metadata, err error) {
+	expiry, err := strconv.ParseInt(aws.StringValue(input["Expiry"]), 10, 64)
+	if err != nil {
+		return m, backends.BadMetadata
+	}
+	m.Expiry = time.Unix(expiry, 0)
+
+	m.Size, err = strconv.ParseInt(aws.StringValue(input["Size"]), 10, 64)
+	if err != nil {
+		return m, backends.BadMetadata
+	}
+
+	m.DeleteKey = aws.StringValue(input["Deletekey"])
+	m.AccessKey = aws.StringValue(input["Accesskey"])
+	m.Mimetype = aws.StringValue(input["Mimetype"])
+	m.Sha256sum = aws.StringValue(input["Sha256sum"])
+	m.SrcIp = aws.StringValue(input["Srcip"])
+	m.Envelope = aws.StringValue(input["Envelope"])
+	m.Collection = aws.StringValue(input["Collection"])
+
+	if originalName, ok := input["Originalname"]; ok {
+		m.OriginalName, err = url.PathUnescape(aws.StringValue(originalName))
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	// Only files with a download limit have their downloads counted
+	if maxDownloads, ok := input["Maxdownloads"]; ok {
+		m.MaxDownloads, err = strconv.ParseInt(aws.StringValue(maxDownloads), 10, 64)
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+		m.Downloads, err = strconv.ParseInt(aws.StringValue(input["Downloads"]), 10, 64)
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	if malware, ok := input["Malware"]; ok {
+		m.Malware, err = url.PathUnescape(aws.StringValue(malware))
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	if uploader, ok := input["Uploader"]; ok {
+		m.Uploader, err = url.PathUnescape(aws.StringValue(uploader))
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	if revision, ok := input["Revision"]; ok {
+		m.Revision, err = strconv.ParseInt(aws.StringValue(revision), 10, 64)
+		if err != nil {
+			return m, backends.BadMetadata
+		}
+	}
+
+	return
+}
+
+func (b S3Backend) Put(key string, r io.Reader, m backends.Metadata) (stored backends.Metadata, err error) {
+	tmpDst, err := os.CreateTemp("", "linx-server-upload")
+	if err != nil {
+		return m, err
+	}
+	defer tmpDst.Close()
+	defer os.Remove(tmpDst.Name())
+
+	// Object metadata has to be known before the upload starts, so the
+	// file is spooled to disk while its metadata is generated
+	mw := helpers.NewMetadataWriter()
+	defer mw.Close()
+
+	bytes, err := io.Copy(io.MultiWriter(tmpDst, mw), r)
+	if bytes == 0 {
+		return stored, backends.FileEmptyError
+	} else if err != nil {
+		return stored, err
+	}
+
+	// The object is created along with all of its metadata
+	m = mw.Complete(m, nil)
+	// Archive listings can easily exceed the 2KB that S3 allows for
+	// user-defined object metadata, so they are not stored.
+	m.ArchiveFiles = nil
+
+	_, err = tmpDst.Seek(0, 0)
+	if err != nil {
+		return stored, err
+	}
+
+	uploader := s3manager.NewUploaderWithClient(b.svc)
+	_, err = uploader.Upload(&s3manager.UploadInput{
+		Bucket:      aws.String(b.bucket),
+		Key:         aws.String(key),
+		Body:        tmpDst,
+		ContentType: aws.String(m.Mimetype),
+		Metadata:    mapMetadata(m),
+	})
+	if err != nil {
+		return
+	}
+
+	return m, nil
+}
+
+func (b S3Backend) PutMetadata(key string, m backends.Metadata) (err error) {
+	_, err = b.svc.CopyObject(&s3.CopyObjectInput{
+		Bucket:            aws.String(b.bucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(b.bucket + "/" + key),
+		ContentType:       aws.String(m.Mimetype),
+		Metadata:          mapMetadata(m),
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+	})
+	return
+}
+
+func (b S3Backend) Size(key string) (int64, error) {
+	result, err := b.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if isNotFound(err) {
+		return 0, backends.NotFoundErr
+	} else if err != nil {
+		return 0, err
+	}
+
+	return aws.Int64Value(result.ContentLength), nil
+}
+
+func (b S3Backend) List() ([]string, error) {
+	var output []string
+
+	err := b.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(b.bucket),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			output = append(output, aws.StringValue(object.Key))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return true
+		}
+	}
+	return false
+}
+
+func NewS3Backend(bucket string, region string, endpoint string, forcePathStyle bool) S3Backend {
+	awsConfig := &aws.Config{}
+	if region != "" {
+		awsConfig.Region = aws.String(region)
+	}
+	if endpoint != "" {
+		awsConfig.Endpoint = aws.String(endpoint)
+	}
+	if forcePathStyle {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sess := session.Must(session.NewSession(awsConfig))
+	svc := s3.New(sess)
+	return S3Backend{bucket: bucket, svc: svc}
+}
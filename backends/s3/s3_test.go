@@ -0,0 +1,194 @@
+package s3
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/johannesboyne/gofakes3"
+	"github.com/johannesboyne/gofakes3/backend/s3mem"
+)
+
+func newTestBackend(t *testing.T) S3Backend {
+	t.Setenv("AWS_ACCESS_KEY_ID", "linx")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "linx-secret")
+
+	faker := gofakes3.New(s3mem.New(), gofakes3.WithAutoBucket(true))
+	ts := httptest.NewServer(faker.Server())
+	t.Cleanup(ts.Close)
+
+	return NewS3Backend("linx", "us-east-1", ts.URL, true)
+}
+
+func TestPutHeadGet(t *testing.T) {
+	b := newTestBackend(t)
+
+	expiry := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	m, err := b.Put("test.txt", strings.NewReader("This is my test content"), backends.Metadata{Expiry: expiry, DeleteKey: "delkey", AccessKey: "acckey", SrcIp: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedSha256sum := "966152d20a77e739716a625373ee15af16e8f4aec631a329a27da41c204b0171"
+	if m.Sha256sum != expectedSha256sum {
+		t.Fatalf("Sha256sum was %q instead of expected value of %q", m.Sha256sum, expectedSha256sum)
+	}
+
+	head, err := b.Head("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if head.DeleteKey != "delkey" || head.AccessKey != "acckey" || head.SrcIp != "127.0.0.1" {
+		t.Fatalf("Unexpected keys in metadata: %+v", head)
+	}
+	if !head.Expiry.Equal(expiry) {
+		t.Fatalf("Expiry was %v instead of %v", head.Expiry, expiry)
+	}
+	if head.Size != 23 || head.Sha256sum != expectedSha256sum || head.Mimetype != m.Mimetype {
+		t.Fatalf("Unexpected file info in metadata: %+v", head)
+	}
+
+	_, r, err := b.Get("test.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(contents) != "This is my test content" {
+		t.Fatalf("Contents were %q", contents)
+	}
+}
+
+func TestPutEmpty(t *testing.T) {
+	b := newTestBackend(t)
+
+	_, err := b.Put("empty.txt", strings.NewReader(""), backends.Metadata{Expiry: time.Unix(0, 0)})
+	if err != backends.FileEmptyError {
+		t.Fatalf("Expected FileEmptyError, got %v", err)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	b := newTestBackend(t)
+
+	exists, err := b.Exists("missing.txt")
+	if err != nil || exists {
+		t.Fatalf("Exists returned %v, %v for a missing file", exists, err)
+	}
+
+	if _, err := b.Head("missing.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr from Head, got %v", err)
+	}
+
+	if _, _, err := b.Get("missing.txt"); err != backends.NotFoundErr {
+		t.Fatalf("Expected NotFoundErr from Get, got %v", err)
+	}
+}
+
+func TestServeFileRange(t *testing.T) {
+	b := newTestBackend(t)
+
+	_, err := b.Put("range.txt", strings.NewReader("0123456789"), backends.Metadata{Expiry: time.Unix(0, 0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/selif/range.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+
+	err = b.ServeFile("range.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("Expected 206, got %d", w.Code)
+	}
+	if w.Header().Get("Content-Range") != "bytes 2-5/10" {
+		t.Fatalf("Unexpected Content-Range %q", w.Header().Get("Content-Range"))
+	}
+	if w.Body.String() != "2345" {
+		t.Fatalf("Unexpected body %q", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/selif/range.txt", nil)
+	req.Header.Set("Range", "bytes=2-5")
+	req.Header.Set("If-Range", `"stale"`)
+
+	err = b.ServeFile("range.txt", w, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w.Code != http.StatusOK || w.Body.String() != "0123456789" {
+		t.Fatalf("Expected full file for stale If-Range, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestPutMetadataListDelete(t *testing.T) {
+	b := newTestBackend(t)
+
+	for _, key := range []string{"a.txt", "b.txt"} {
+		_, err := b.Put(key, strings.NewReader(key), backends.Metadata{Expiry: time.Unix(0, 0), DeleteKey: "delkey"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m, err := b.Head("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.AccessKey = "newkey"
+	m.MaxDownloads = 3
+	m.Downloads = 1
+	m.OriginalName = "Résumé (final).txt"
+	m.Malware = "Win.Test.EICAR_HDB-1"
+	m.Uploader = "ci bot"
+	m.Collection = "k2ctrs8"
+	m.Revision = 2
+	err = b.PutMetadata("a.txt", m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = b.Head("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.AccessKey != "newkey" || m.DeleteKey != "delkey" || m.MaxDownloads != 3 || m.Downloads != 1 || m.OriginalName != "Résumé (final).txt" ||
+		m.Malware != "Win.Test.EICAR_HDB-1" || m.Uploader != "ci bot" || m.Collection != "k2ctrs8" || m.Revision != 2 {
+		t.Fatalf("Metadata was not updated: %+v", m)
+	}
+
+	files, err := b.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	if strings.Join(files, ",") != "a.txt,b.txt" {
+		t.Fatalf("Unexpected file list %v", files)
+	}
+
+	err = b.Delete("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exists, err := b.Exists("a.txt")
+	if err != nil || exists {
+		t.Fatalf("File still exists after delete: %v, %v", exists, err)
+	}
+}
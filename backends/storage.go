@@ -4,7 +4,6 @@ import (
 	"errors"
 	"io"
 	"net/http"
-	"time"
 )
 
 type StorageBackend interface {
@@ -12,7 +11,10 @@ type StorageBackend interface {
 	Exists(key string) (bool, error)
 	Head(key string) (Metadata, error)
 	Get(key string) (Metadata, io.ReadCloser, error)
-	Put(key string, r io.Reader, expiry time.Time, deleteKey, accessKey string, srcIp string) (Metadata, error)
+	// Store a file along with its metadata, of which Sha256sum, Size and
+	// ArchiveFiles are generated from the contents, as is Mimetype unless
+	// it is given. The file is only served once its metadata is stored.
+	Put(key string, r io.Reader, m Metadata) (Metadata, error)
 	PutMetadata(key string, m Metadata) error
 	ServeFile(key string, w http.ResponseWriter, r *http.Request) error
 	Size(key string) (int64, error)
@@ -23,5 +25,17 @@ type MetaStorageBackend interface {
 	List() ([]string, error)
 }
 
+// Implemented by backends that can find expired files more cheaply than by
+// checking every file in List
+type ExpiryLister interface {
+	ListExpired() ([]string, error)
+}
+
+// Implemented by backends that can read a file from an offset without
+// reading everything before it
+type RangeGetter interface {
+	GetFrom(key string, offset int64) (io.ReadCloser, error)
+}
+
 var NotFoundErr = errors.New("File not found.")
 var FileEmptyError = errors.New("Empty file")
@@ -74,3 +74,11 @@ cd ..
 cd linx-cleanup
 build_binary "../binaries/""$version""/linx-cleanup-v""$version""_"
 cd ..
+
+cd linx-metaimport
+build_binary "../binaries/""$version""/linx-metaimport-v""$version""_"
+cd ..
+
+cd linx-shardmigrate
+build_binary "../binaries/""$version""/linx-shardmigrate-v""$version""_"
+cd ..
@@ -4,12 +4,25 @@ import (
 	"log"
 	"time"
 
-	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends"
 	"github.com/andreimarcu/linx-server/expiry"
 )
 
-func Cleanup(filesDir string, metaDir string, noLogs bool) {
-	fileBackend := localfs.NewLocalfsBackend(metaDir, filesDir)
+// Delete the files that expired, calling onDelete, if it isn't nil, with the
+// name and metadata of every file deleted
+func Cleanup(fileBackend backends.MetaStorageBackend, noLogs bool, onDelete func(filename string, metadata backends.Metadata)) {
+	if lister, ok := fileBackend.(backends.ExpiryLister); ok {
+		files, err := lister.ListExpired()
+		if err != nil {
+			panic(err)
+		}
+
+		for _, filename := range files {
+			metadata, _ := fileBackend.Head(filename)
+			deleteFile(fileBackend, filename, metadata, noLogs, onDelete)
+		}
+		return
+	}
 
 	files, err := fileBackend.List()
 	if err != nil {
@@ -25,23 +38,29 @@ func Cleanup(filesDir string, metaDir string, noLogs bool) {
 		}
 
 		if expiry.IsTsExpired(metadata.Expiry) {
-			if !noLogs {
-				log.Printf("Delete %s", filename)
-			}
-			err = fileBackend.Delete(filename)
-			if err != nil {
-				if !noLogs {
-					log.Printf("Failed to delete %s", filename)
-				}
-			}
+			deleteFile(fileBackend, filename, metadata, noLogs, onDelete)
+		}
+	}
+}
+
+func deleteFile(fileBackend backends.MetaStorageBackend, filename string, metadata backends.Metadata, noLogs bool, onDelete func(filename string, metadata backends.Metadata)) {
+	if !noLogs {
+		log.Printf("Delete %s", filename)
+	}
+	err := fileBackend.Delete(filename)
+	if err != nil {
+		if !noLogs {
+			log.Printf("Failed to delete %s", filename)
 		}
+	} else if onDelete != nil {
+		onDelete(filename, metadata)
 	}
 }
 
-func PeriodicCleanup(minutes time.Duration, filesDir string, metaDir string, noLogs bool) {
+func PeriodicCleanup(minutes time.Duration, fileBackend backends.MetaStorageBackend, noLogs bool, onDelete func(filename string, metadata backends.Metadata)) {
 	c := time.Tick(minutes)
 	for range c {
-		Cleanup(filesDir, metaDir, noLogs)
+		Cleanup(fileBackend, noLogs, onDelete)
 	}
 
 }
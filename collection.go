@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/auth/apikeys"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/dchest/uniuri"
+	"github.com/dustin/go-humanize"
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+)
+
+// Collections group files uploaded together under their own URL. A
+// collection is stored like a file under an internal key, so that it
+// expires and gets cleaned up like one.
+// Value of the Linx-Collection header that starts a new collection
+const newCollection = "new"
+
+var errCollectionNotFound = errors.New("Collection not found.")
+var errCollectionKey = errors.New("Delete key does not match the collection's.")
+
+// Serializes changes to collections within this process
+var collectionMutex sync.Mutex
+
+type Collection struct {
+	Files []string `json:"files"`
+}
+
+func collectionKey(id string) string {
+	return internalKey("collection", id)
+}
+
+func readCollection(id string) (collection Collection, metadata backends.Metadata, err error) {
+	if strings.Contains(id, ".") {
+		return collection, metadata, errCollectionNotFound
+	}
+
+	metadata, err = checkFile(collectionKey(id))
+	if err == backends.NotFoundErr {
+		return collection, metadata, errCollectionNotFound
+	} else if err != nil {
+		return
+	}
+
+	_, reader, err := storageBackend.Get(collectionKey(id))
+	if err != nil {
+		return
+	}
+	defer reader.Close()
+
+	err = json.NewDecoder(reader).Decode(&collection)
+	if err != nil {
+		return collection, metadata, backends.BadMetadata
+	}
+
+	return
+}
+
+func writeCollection(id string, collection Collection, expiry time.Time, deleteKey string, srcIp string) (metadata backends.Metadata, err error) {
+	contents, err := json.Marshal(collection)
+	if err != nil {
+		return
+	}
+
+	return storageBackend.Put(collectionKey(id), bytes.NewReader(contents), backends.Metadata{
+		Expiry:    expiry,
+		DeleteKey: deleteKey,
+		SrcIp:     srcIp,
+	})
+}
+
+// Create an empty collection with the expiry and delete key of an upload
+// request, generating the delete key if needed so that the files added to
+// the collection can share it
+func createCollection(upReq *UploadRequest) (id string, err error) {
+	if upReq.deleteKey == "" {
+		upReq.deleteKey = uniuri.NewLen(30)
+	}
+
+	collectionMutex.Lock()
+	defer collectionMutex.Unlock()
+
+	for {
+		id = generateBarename()
+		exists, err := storageBackend.Exists(collectionKey(id))
+		if err != nil {
+			return "", err
+		} else if !exists {
+			break
+		}
+	}
+
+	_, err = writeCollection(id, Collection{Files: []string{}}, uploadExpiry(0, upReq.expiry), upReq.deleteKey, upReq.srcIp)
+	return
+}
+
+// Check that files can be added to a collection with the given delete key
+func checkCollectionKey(id string, deleteKey string) error {
+	_, metadata, err := readCollection(id)
+	if err != nil {
+		return err
+	}
+
+	if metadata.DeleteKey != deleteKey {
+		return errCollectionKey
+	}
+	return nil
+}
+
+// Add a file to a collection, extending the collection's expiry to the
+// file's so that it lists the file for as long as it is there
+func addToCollection(id string, deleteKey string, filename string, fileExpiry time.Time) error {
+	collectionMutex.Lock()
+	defer collectionMutex.Unlock()
+
+	collection, metadata, err := readCollection(id)
+	if err != nil {
+		return err
+	}
+	if metadata.DeleteKey != deleteKey {
+		return errCollectionKey
+	}
+
+	collectionExpiry := extendedExpiry(metadata.Expiry, fileExpiry)
+
+	// Overwritten files are already part of the collection
+	added := true
+	for _, f := range collection.Files {
+		if f == filename {
+			added = false
+			break
+		}
+	}
+	if !added && collectionExpiry == metadata.Expiry {
+		return nil
+	} else if added {
+		collection.Files = append(collection.Files, filename)
+	}
+
+	_, err = writeCollection(id, collection, collectionExpiry, metadata.DeleteKey, metadata.SrcIp)
+	return err
+}
+
+// Extend the expiry of a collection to that of a file in it whose expiry
+// was changed
+func extendCollection(id string, fileExpiry time.Time) error {
+	collectionMutex.Lock()
+	defer collectionMutex.Unlock()
+
+	collection, metadata, err := readCollection(id)
+	if err != nil {
+		return err
+	}
+
+	collectionExpiry := extendedExpiry(metadata.Expiry, fileExpiry)
+	if collectionExpiry == metadata.Expiry {
+		return nil
+	}
+	_, err = writeCollection(id, collection, collectionExpiry, metadata.DeleteKey, metadata.SrcIp)
+	return err
+}
+
+// Expiry of a collection that lists a file with the given expiry
+func extendedExpiry(collectionExpiry, fileExpiry time.Time) time.Time {
+	if collectionExpiry != expiry.NeverExpire && (fileExpiry == expiry.NeverExpire || fileExpiry.After(collectionExpiry)) {
+		return fileExpiry
+	}
+	return collectionExpiry
+}
+
+// Prepare an upload request for the collection given with it, which is
+// either the ID of an existing collection, or "new" to create one
+func prepareCollection(collection string, upReq *UploadRequest) (id string, err error) {
+	if collection == "" {
+		return "", nil
+	} else if collection == newCollection {
+		return createCollection(upReq)
+	}
+
+	return collection, checkCollectionKey(collection, upReq.deleteKey)
+}
+
+func collectionURL(r *http.Request, id string) string {
+	return getSiteURL(r) + "collection/" + id
+}
+
+// Describe a collection as it is returned along with the files uploaded to
+// it
+func collectionJSON(r *http.Request, id string) map[string]string {
+	return map[string]string{
+		"collection":     id,
+		"collection_url": collectionURL(r, id),
+	}
+}
+
+type collectionFile struct {
+	Filename string
+	Mimetype string
+	Size     string
+	Expiry   string
+	Image    bool
+	Thumb    bool
+	Locked   bool
+}
+
+func collectionHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	id := c.URLParams["id"]
+
+	collection, metadata, err := readCollection(id)
+	if err == errCollectionNotFound {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt collection.")
+		return
+	}
+
+	// Files that were deleted or expired since they were added are left out
+	var files []collectionFile
+	var filesJSON []map[string]string
+	for _, filename := range collection.Files {
+		fileMetadata, err := checkFile(filename)
+		if err != nil {
+			continue
+		}
+
+		// Only the name of files whose access key wasn't given is shown
+		if _, err := checkAccessKey(r, &fileMetadata); err != nil {
+			files = append(files, collectionFile{Filename: filename, Locked: true})
+			filesJSON = append(filesJSON, map[string]string{
+				"filename": filename,
+				"locked":   "true",
+			})
+			continue
+		}
+
+		locked := fileMetadata.AccessKey != ""
+		file := collectionFile{
+			Filename: filename,
+			Mimetype: fileMetadata.Mimetype,
+			Size:     humanize.Bytes(uint64(fileMetadata.Size)),
+			// Previews would use up downloads of limited files
+			Image:  strings.HasPrefix(fileMetadata.Mimetype, "image/") && fileMetadata.MaxDownloads == 0,
+			Thumb:  hasThumbnail(fileMetadata),
+			Locked: locked,
+		}
+		if fileMetadata.Expiry != expiry.NeverExpire {
+			file.Expiry = humanize.RelTime(time.Now(), fileMetadata.Expiry, "", "")
+		}
+		files = append(files, file)
+
+		fileJSON := map[string]string{
+			"filename":   filename,
+			"url":        getSiteURL(r) + filename,
+			"direct_url": getSiteURL(r) + Config.selifPath + filename,
+			"expiry":     strconv.FormatInt(fileMetadata.Expiry.Unix(), 10),
+			"size":       strconv.FormatInt(fileMetadata.Size, 10),
+			"mimetype":   fileMetadata.Mimetype,
+			"locked":     strconv.FormatBool(locked),
+		}
+		if file.Thumb {
+			fileJSON["thumbnail_url"] = thumbnailURL(r, filename)
+		}
+		filesJSON = append(filesJSON, fileJSON)
+	}
+
+	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		js, _ := json.Marshal(map[string]interface{}{
+			"collection": id,
+			"url":        collectionURL(r, id),
+			"expiry":     strconv.FormatInt(metadata.Expiry.Unix(), 10),
+			"files":      filesJSON,
+		})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_, err := w.Write(js)
+		if err != nil {
+			oopsHandler(c, w, r, RespJSON, "")
+		}
+		return
+	}
+
+	var expiryHuman string
+	if metadata.Expiry != expiry.NeverExpire {
+		expiryHuman = humanize.RelTime(time.Now(), metadata.Expiry, "", "")
+	}
+
+	err = renderTemplate(Templates["collection.html"], pongo2.Context{
+		"collection": id,
+		"files":      files,
+		"expiry":     expiryHuman,
+	}, r, w)
+	if err != nil {
+		oopsHandler(c, w, r, RespHTML, "")
+	}
+}
+
+// Delete a collection along with the files in it that share its delete key
+func collectionDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	requestKey := r.Header.Get("Linx-Delete-Key")
+
+	id := c.URLParams["id"]
+
+	collectionMutex.Lock()
+	defer collectionMutex.Unlock()
+
+	collection, metadata, err := readCollection(id)
+	if err == errCollectionNotFound {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		unauthorizedHandler(c, w, r)
+		return
+	}
+
+	deleteAny := apikeys.RequestKey(c).HasScope(apikeys.ScopeDeleteAny)
+	if metadata.DeleteKey != requestKey && !deleteAny {
+		unauthorizedHandler(c, w, r)
+		return
+	}
+
+	for _, filename := range collection.Files {
+		fileMetadata, err := storageBackend.Head(filename)
+		if err == nil && (fileMetadata.DeleteKey == requestKey || deleteAny) && deleteFile(filename) == nil {
+			sendWebhook(webhookEventDelete, filename, fileMetadata)
+		}
+	}
+
+	err = storageBackend.Delete(collectionKey(id))
+	if err != nil {
+		oopsHandler(c, w, r, RespPLAIN, "Could not delete")
+		return
+	}
+
+	fmt.Fprintf(w, "DELETED")
+}
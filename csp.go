@@ -29,6 +29,13 @@ var defaultFileCSPOptions = CSPOptions{
 	referrerPolicy: "strict-origin",
 }
 
+// Pages that encrypt and decrypt pastes in the browser, which need their
+// scripts to
+var scriptCSPOptions = CSPOptions{
+	policy:         "default-src 'none'; script-src 'self'; connect-src 'self'; img-src 'self'; media-src 'self'; style-src 'self' 'unsafe-inline'; frame-ancestors 'self';",
+	referrerPolicy: "strict-origin",
+}
+
 func (c CSP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// only add a CSP if one is not already set
 	if w.Header().Get(cspHeader) == "" {
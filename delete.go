@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/andreimarcu/linx-server/auth/apikeys"
 	"github.com/andreimarcu/linx-server/backends"
 	"github.com/zenazn/goji/web"
 )
@@ -27,12 +28,17 @@ func deleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if metadata.DeleteKey == requestKey {
-		err := storageBackend.Delete(filename)
+	// Keys allowed to delete any file don't need its delete key, though
+	// they can't delete the objects the server stores for files
+	deleteAny := apikeys.RequestKey(c).HasScope(apikeys.ScopeDeleteAny) && !isReservedKey(filename)
+
+	if metadata.DeleteKey == requestKey || deleteAny {
+		err := deleteFile(filename)
 		if err != nil {
 			oopsHandler(c, w, r, RespPLAIN, "Could not delete")
 			return
 		}
+		sendWebhook(webhookEventDelete, filename, metadata)
 
 		fmt.Fprintf(w, "DELETED")
 		return
@@ -42,3 +48,23 @@ func deleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 }
+
+// Delete a file along with its thumbnail and revisions, if it has any
+func deleteFile(filename string) error {
+	metadata, _ := storageBackend.Head(filename)
+	err := storageBackend.Delete(filename)
+	if err != nil {
+		return err
+	}
+
+	deleteThumbnail(filename)
+	deleteRevisions(filename, metadata.Revision)
+	keyQuotas.remove(filename)
+	return nil
+}
+
+// Called with each file the periodic cleanup deleted
+func cleanedUp(filename string, metadata backends.Metadata) {
+	keyQuotas.remove(filename)
+	sendWebhook(webhookEventExpire, filename, metadata)
+}
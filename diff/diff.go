@@ -0,0 +1,146 @@
+// Package diff compares texts line by line
+package diff
+
+import (
+	"strings"
+)
+
+type Op int
+
+const (
+	Equal Op = iota
+	Delete
+	Insert
+)
+
+// A line of either text, and whether it is in both or only in one of them
+type Line struct {
+	Op   Op
+	Text string
+}
+
+// Largest number of lines to delete and insert looked for, beyond which the
+// lines in between the common prefix and suffix of the texts are shown as
+// all deleted and inserted, as the work grows with its square
+const maxEdits = 1000
+
+// Compare two texts line by line
+func Texts(a, b string) []Line {
+	return Lines(splitLines(a), splitLines(b))
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// Find the shortest list of lines to delete from and insert into a to turn
+// it into b, with Myers' algorithm
+func Lines(a, b []string) []Line {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	var lines []Line
+	for _, text := range a[:prefix] {
+		lines = append(lines, Line{Equal, text})
+	}
+	lines = append(lines, myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, text := range a[len(a)-suffix:] {
+		lines = append(lines, Line{Equal, text})
+	}
+	return lines
+}
+
+func myers(a, b []string) []Line {
+	n, m := len(a), len(b)
+	limit := min(n+m, maxEdits)
+
+	// Furthest x reached on each diagonal k = x - y, at v[offset+k]
+	offset := limit + 1
+	v := make([]int, 2*limit+3)
+	// Diagonals from -d to d before each step d, to find the way back
+	var trace [][]int
+
+	for d := 0; d <= limit; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+
+			if x >= n && y >= m {
+				return backtrack(a, b, trace)
+			}
+		}
+	}
+
+	// Too many differences
+	var lines []Line
+	for _, text := range a {
+		lines = append(lines, Line{Delete, text})
+	}
+	for _, text := range b {
+		lines = append(lines, Line{Insert, text})
+	}
+	return lines
+}
+
+func backtrack(a, b []string, trace [][]int) []Line {
+	x, y := len(a), len(b)
+	var lines []Line
+
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+
+		var prevK int
+		if k == -d || (k != d && v[k-1+d] < v[k+1+d]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := v[prevK+d]
+		prevY := prevX - prevK
+
+		for x > prevX && y > prevY {
+			x--
+			y--
+			lines = append(lines, Line{Equal, a[x]})
+		}
+		if x == prevX {
+			y--
+			lines = append(lines, Line{Insert, b[y]})
+		} else {
+			x--
+			lines = append(lines, Line{Delete, a[x]})
+		}
+	}
+	for x > 0 && y > 0 {
+		x--
+		y--
+		lines = append(lines, Line{Equal, a[x]})
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
@@ -0,0 +1,85 @@
+package diff
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// Turn a list of lines back into both texts
+func apply(lines []Line) (a, b []string) {
+	for _, line := range lines {
+		if line.Op != Insert {
+			a = append(a, line.Text)
+		}
+		if line.Op != Delete {
+			b = append(b, line.Text)
+		}
+	}
+	return
+}
+
+func edits(lines []Line) (n int) {
+	for _, line := range lines {
+		if line.Op != Equal {
+			n++
+		}
+	}
+	return
+}
+
+func TestTexts(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		edits int
+	}{
+		{"", "", 0},
+		{"a\nb\nc\n", "a\nb\nc\n", 0},
+		{"", "a\nb\n", 2},
+		{"a\nb\n", "", 2},
+		{"a\nb\nc\n", "a\nc\n", 1},
+		{"a\nc\n", "a\nb\nc\n", 1},
+		{"a\nb\nc\na\nb\nb\na\n", "c\nb\na\nb\na\nc\n", 5},
+		{"restart the server\ncheck the logs\n", "check the logs\nrestart the server\ncall for help\n", 3},
+	}
+
+	for _, test := range tests {
+		lines := Texts(test.a, test.b)
+		a, b := apply(lines)
+		if strings.Join(a, "\n") != strings.TrimSuffix(test.a, "\n") || strings.Join(b, "\n") != strings.TrimSuffix(test.b, "\n") {
+			t.Fatalf("Diff of %q and %q does not give them back: %v", test.a, test.b, lines)
+		}
+		if edits(lines) != test.edits {
+			t.Fatalf("Diff of %q and %q has %d edits, expected %d", test.a, test.b, edits(lines), test.edits)
+		}
+	}
+}
+
+func TestLinesRandom(t *testing.T) {
+	words := []string{"a", "b", "c", "d"}
+	rng := rand.New(rand.NewSource(1))
+	random := func(n int) []string {
+		lines := make([]string, n)
+		for i := range lines {
+			lines[i] = words[rng.Intn(len(words))]
+		}
+		return lines
+	}
+
+	for i := 0; i < 200; i++ {
+		x, y := random(rng.Intn(30)), random(rng.Intn(30))
+		a, b := apply(Lines(x, y))
+		if strings.Join(a, "\n") != strings.Join(x, "\n") || strings.Join(b, "\n") != strings.Join(y, "\n") {
+			t.Fatalf("Diff of %v and %v does not give them back", x, y)
+		}
+	}
+
+	// Texts too different are shown as replaced
+	x, y := make([]string, 2*maxEdits), make([]string, 2*maxEdits)
+	for i := range x {
+		x[i], y[i] = "a", "b"
+	}
+	if edits(Lines(x, y)) != 4*maxEdits {
+		t.Fatal("Texts too different are not shown as replaced")
+	}
+}
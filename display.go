@@ -32,14 +32,28 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 	extension := strings.TrimPrefix(filepath.Ext(fileName), ".")
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		js, _ := json.Marshal(map[string]string{
+		info := map[string]string{
 			"filename":   fileName,
 			"direct_url": getSiteURL(r) + Config.selifPath + fileName,
 			"expiry":     strconv.FormatInt(metadata.Expiry.Unix(), 10),
 			"size":       strconv.FormatInt(metadata.Size, 10),
 			"mimetype":   metadata.Mimetype,
 			"sha256sum":  metadata.Sha256sum,
-		})
+		}
+		if metadata.OriginalName != "" {
+			info["original_name"] = metadata.OriginalName
+		}
+		if hasThumbnail(metadata) {
+			info["thumbnail_url"] = thumbnailURL(r, fileName)
+		}
+		if metadata.Malware != "" {
+			info["malware"] = metadata.Malware
+		}
+		if metadata.MaxDownloads > 0 {
+			info["max_downloads"] = strconv.FormatInt(metadata.MaxDownloads, 10)
+			info["downloads"] = strconv.FormatInt(metadata.Downloads, 10)
+		}
+		js, _ := json.Marshal(info)
 		_, err := w.Write(js)
 		if err != nil {
 			oopsHandler(c, w, r, RespHTML, "")
@@ -49,8 +63,37 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 
 	var tpl *pongo2.Template
 
-	if strings.HasPrefix(metadata.Mimetype, "image/") {
+	if isEncryptedPaste(metadata) {
+		// Encrypted pastes can only be read on their page, so it is where
+		// their downloads are counted
+		metadata, reader, err := getDownload(fileName)
+		if err != nil {
+			oopsHandler(c, w, r, RespHTML, err.Error())
+			return
+		}
+		defer reader.Close()
+
+		if metadata.Size < maxDisplayFileSizeBytes {
+			bytes, err := io.ReadAll(reader)
+			if err == nil {
+				extra["extension"] = extension
+				extra["lang_hl"] = extensionToHlLang(extension)
+				extra["contents"] = string(bytes)
+				tpl = Templates["display/encrypted.html"]
+
+				// The paste is decrypted by its page's scripts
+				if !Config.disableSecurityHeaders {
+					w.Header().Set(cspHeader, scriptCSPOptions.policy)
+				}
+			}
+		}
+
+	} else if strings.HasPrefix(metadata.Mimetype, "image/") {
 		tpl = Templates["display/image.html"]
+		// Thumbnails of animated GIFs would only show their first frame
+		if hasThumbnail(metadata) && metadata.Mimetype != "image/gif" {
+			extra["thumbnail"] = "true"
+		}
 
 	} else if strings.HasPrefix(metadata.Mimetype, "video/") {
 		tpl = Templates["display/video.html"]
@@ -116,16 +159,19 @@ func fileDisplayHandler(c web.C, w http.ResponseWriter, r *http.Request, fileNam
 	}
 
 	err := renderTemplate(tpl, pongo2.Context{
-		"mime":        metadata.Mimetype,
-		"filename":    fileName,
-		"size":        sizeHuman,
-		"expiry":      expiryHuman,
-		"expirylist":  listExpirationTimes(),
-		"extra":       extra,
-		"forcerandom": Config.forceRandomFilename,
-		"lines":       lines,
-		"files":       metadata.ArchiveFiles,
-		"siteurl":     strings.TrimSuffix(getSiteURL(r), "/"),
+		"mime":         metadata.Mimetype,
+		"filename":     fileName,
+		"originalname": metadata.OriginalName,
+		"malware":      metadata.Malware,
+		"size":         sizeHuman,
+		"expiry":       expiryHuman,
+		"expirylist":   listExpirationTimes(),
+		"extra":        extra,
+		"forcerandom":  Config.forceRandomFilename,
+		"lines":        lines,
+		"files":        metadata.ArchiveFiles,
+		"revision":     metadata.Revision,
+		"siteurl":      strings.TrimSuffix(getSiteURL(r), "/"),
 	}, r, w)
 
 	if err != nil {
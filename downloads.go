@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"sync"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Serializes download counting within this process, so that a file is
+// never served more times than it allows
+var downloadMutex sync.Mutex
+
+// Parse the number of downloads a file is limited to, 0 for no limit
+func parseMaxDownloads(maxStr string) int64 {
+	maxDownloads, err := strconv.ParseInt(maxStr, 10, 64)
+	if err != nil || maxDownloads < 0 {
+		return 0
+	}
+	return maxDownloads
+}
+
+// Count a download of a file that has a download limit. The last download
+// allowed opens the file and deletes it before it gets served, so that it is
+// gone even if the client never reads it all, and its reader is returned.
+// The reader is nil for any other download, which should be served as
+// usual.
+func countDownload(filename string) (metadata backends.Metadata, last io.ReadCloser, err error) {
+	downloadMutex.Lock()
+	defer downloadMutex.Unlock()
+
+	metadata, err = checkFile(filename)
+	if err != nil {
+		return
+	}
+
+	metadata.Downloads++
+	if metadata.Downloads < metadata.MaxDownloads {
+		err = storageBackend.PutMetadata(filename, metadata)
+		return
+	}
+
+	metadata, last, err = storageBackend.Get(filename)
+	if err != nil {
+		return
+	}
+
+	err = deleteFile(filename)
+	if err != nil {
+		last.Close()
+		return metadata, nil, err
+	}
+	sendWebhook(webhookEventExpire, filename, metadata)
+
+	return
+}
+
+// Open a file for reading, counting the download if it has a limit
+func getDownload(filename string) (metadata backends.Metadata, r io.ReadCloser, err error) {
+	metadata, err = storageBackend.Head(filename)
+	if err != nil {
+		return
+	}
+
+	if metadata.MaxDownloads > 0 {
+		metadata, r, err = countDownload(filename)
+		if err != nil {
+			return
+		}
+	}
+
+	if r == nil {
+		metadata, r, err = storageBackend.Get(filename)
+		if err != nil {
+			return
+		}
+	}
+
+	sendWebhook(webhookEventAccess, filename, metadata)
+	return
+}
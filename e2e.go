@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+
+	"github.com/andreimarcu/linx-server/backends"
+)
+
+// Pastes encrypted in the browser are stored with this mimetype, which is
+// never sniffed from uploads. They are the base64 of a 12 byte AES-GCM
+// nonce followed by the ciphertext, and the key is only ever in the
+// fragment of their URL, which browsers don't send to the server.
+const encryptedPasteMimetype = "application/x-linx-encrypted"
+
+// Shortest encrypted paste, with its nonce and the GCM tag
+const minEncryptedPasteSize = 12 + 16
+
+var errInvalidEncryptedPaste = errors.New("Invalid encrypted paste, which must be the base64 of its nonce and ciphertext.")
+
+func isEncryptedPaste(metadata backends.Metadata) bool {
+	return metadata.Mimetype == encryptedPasteMimetype
+}
+
+// Check that an encrypted paste is what the browser makes, so that pastes
+// the server can read aren't displayed as if they were encrypted. It is
+// read whole, as it has to be displayed whole anyway.
+func readEncryptedPaste(r io.Reader) ([]byte, error) {
+	paste, err := io.ReadAll(io.LimitReader(r, maxDisplayFileSizeBytes))
+	if err != nil {
+		return nil, err
+	}
+	if len(paste) >= maxDisplayFileSizeBytes {
+		return nil, FileTooLargeError
+	}
+
+	paste = bytes.TrimSpace(paste)
+	ciphertext, err := base64.StdEncoding.DecodeString(string(paste))
+	if err != nil || len(ciphertext) < minEncryptedPasteSize {
+		return nil, errInvalidEncryptedPaste
+	}
+	return paste, nil
+}
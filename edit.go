@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/andreimarcu/linx-server/auth/apikeys"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/zenazn/goji/web"
+)
+
+// Fields of a file's metadata that can be changed after it was uploaded.
+// Fields left out are kept as they are, and empty ones are removed, except
+// for the expiry which follows the syntax of Linx-Expiry.
+type metadataEdit struct {
+	Expiry       *string `json:"expiry"`
+	AccessKey    *string `json:"access_key"`
+	OriginalName *string `json:"original_name"`
+	MaxDownloads *string `json:"max_downloads"`
+}
+
+var errInvalidMaxDownloads = errors.New("Invalid max_downloads, which must be a number of downloads, 0 for unlimited.")
+
+func editHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	requestKey := r.Header.Get("Linx-Delete-Key")
+
+	if len(r.URL.Query().Get("linx-delete-key")) > 0 {
+		requestKey = r.URL.Query().Get("linx-delete-key")
+	}
+
+	filename := c.URLParams["name"]
+	if isReservedKey(filename) {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	// Ensure that file exists and delete key is correct
+	metadata, err := checkFile(filename)
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		unauthorizedHandler(c, w, r)
+		return
+	}
+	if metadata.DeleteKey != requestKey && !apikeys.RequestKey(c).HasScope(apikeys.ScopeAdmin) {
+		unauthorizedHandler(c, w, r)
+		return
+	}
+
+	var edit metadataEdit
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16))
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&edit)
+	if err != nil {
+		badRequestHandler(c, w, r, RespJSON, "Invalid metadata: "+err.Error())
+		return
+	}
+
+	err = editMetadata(filename, &metadata, edit, apikeys.RequestKey(c))
+	if err != nil {
+		badRequestHandler(c, w, r, RespJSON, err.Error())
+		return
+	}
+
+	err = storageBackend.PutMetadata(filename, metadata)
+	if err != nil {
+		oopsHandler(c, w, r, RespJSON, "Could not update metadata.")
+		return
+	}
+
+	// The thumbnail is made again with the new expiry and access key
+	deleteThumbnail(filename)
+	updateRevisions(filename, metadata.Revision-1, metadata.Expiry)
+	if metadata.Collection != "" {
+		extendCollection(metadata.Collection, metadata.Expiry)
+	}
+
+	js := generateJSONresponse(Upload{Filename: filename, Metadata: metadata}, r)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Write(js)
+}
+
+// Apply an edit to the metadata of a file, within the limits uploads are
+// subject to
+func editMetadata(filename string, metadata *backends.Metadata, edit metadataEdit, key *apikeys.Key) error {
+	if edit.Expiry != nil {
+		fileExpiry, err := parseExpiry(*edit.Expiry)
+		if err != nil {
+			return err
+		}
+		metadata.Expiry = uploadExpiry(metadata.Size, limitKeyExpiry(key, fileExpiry))
+	}
+
+	if edit.AccessKey != nil && !Config.disableAccessKey {
+		metadata.AccessKey = *edit.AccessKey
+	}
+
+	if edit.OriginalName != nil {
+		metadata.OriginalName = cleanOriginalName(*edit.OriginalName)
+		if metadata.OriginalName == filename {
+			metadata.OriginalName = ""
+		}
+	}
+
+	if edit.MaxDownloads != nil {
+		maxDownloads, err := strconv.ParseInt(*edit.MaxDownloads, 10, 64)
+		if err != nil || maxDownloads < 0 {
+			return errInvalidMaxDownloads
+		}
+		metadata.MaxDownloads = maxDownloads
+	}
+
+	return nil
+}
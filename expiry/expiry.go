@@ -1,13 +1,91 @@
 package expiry
 
 import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var NeverExpire = time.Unix(0, 0)
 
+var (
+	ErrInvalid = errors.New("Invalid expiry, which must be a number of seconds, a duration such as 2h, 3d or 1w, an RFC3339 time such as 2006-01-02T15:04:05Z, or never.")
+	ErrInPast  = errors.New("Expiry is in the past.")
+
+	ErrInvalidDuration = errors.New("Invalid duration, which must be a number of seconds, a duration such as 2h, 3d or 1w, or never.")
+)
+
+var (
+	durationRe     = regexp.MustCompile(`^(\d+[smhdw])+$`)
+	durationPartRe = regexp.MustCompile(`(\d+)([smhdw])`)
+)
+
+var units = map[string]uint64{
+	"s": 1,
+	"m": 60,
+	"h": 60 * 60,
+	"d": 24 * 60 * 60,
+	"w": 7 * 24 * 60 * 60,
+}
+
+// Longest expiry that fits in a time.Duration, in seconds
+const maxSeconds = math.MaxInt64 / uint64(time.Second)
+
 // Determine if a file with expiry set to "ts" has expired yet
 func IsTsExpired(ts time.Time) bool {
 	now := time.Now()
 	return ts != NeverExpire && now.After(ts)
 }
+
+// Parse an expiry given as a number of seconds, a duration such as 2h, 3d
+// or 1d12h, an RFC3339 time or never, into the time left from now until
+// it, 0 if it never comes
+func Parse(s string, now time.Time) (time.Duration, error) {
+	d, err := ParseDuration(s)
+	if err == nil {
+		return d, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, strings.ToUpper(strings.TrimSpace(s)))
+	if err != nil {
+		return 0, ErrInvalid
+	}
+	if !t.After(now) {
+		return 0, ErrInPast
+	}
+	return t.Sub(now), nil
+}
+
+// Parse an expiry given relative to now, as a number of seconds, a
+// duration or never, 0 if it never comes
+func ParseDuration(s string) (time.Duration, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	var seconds uint64
+	switch {
+	case s == "never":
+		return 0, nil
+	case durationRe.MatchString(s):
+		for _, part := range durationPartRe.FindAllStringSubmatch(s, -1) {
+			n, err := strconv.ParseUint(part[1], 10, 64)
+			if err != nil || n > (maxSeconds-seconds)/units[part[2]] {
+				return 0, ErrInvalidDuration
+			}
+			seconds += n * units[part[2]]
+		}
+	default:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, ErrInvalidDuration
+		}
+		seconds = n
+	}
+
+	if seconds > maxSeconds {
+		return 0, ErrInvalidDuration
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
@@ -0,0 +1,74 @@
+package expiry
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	tests := []struct {
+		s        string
+		expected time.Duration
+		err      error
+	}{
+		{"0", 0, nil},
+		{"3600", time.Hour, nil},
+		{" 60 ", time.Minute, nil},
+		{"90s", 90 * time.Second, nil},
+		{"15m", 15 * time.Minute, nil},
+		{"2h", 2 * time.Hour, nil},
+		{"3d", 3 * 24 * time.Hour, nil},
+		{"1W", 7 * 24 * time.Hour, nil},
+		{"1d12h", 36 * time.Hour, nil},
+		{"never", 0, nil},
+		{"Never", 0, nil},
+		{"2020-01-02T16:04:05Z", time.Hour, nil},
+		{"2020-01-02T16:04:05+01:00", 0, ErrInPast},
+		{"2020-01-02T15:04:05Z", 0, ErrInPast},
+		{"2019-01-01T00:00:00Z", 0, ErrInPast},
+		{"-60", 0, ErrInvalid},
+		{"1.5h", 0, ErrInvalid},
+		{"2y", 0, ErrInvalid},
+		{"h", 0, ErrInvalid},
+		{"2h 30m", 0, ErrInvalid},
+		{"tomorrow", 0, ErrInvalid},
+		{"2020-01-03", 0, ErrInvalid},
+		{"99999999999999999999", 0, ErrInvalid},
+		{"100000000000w", 0, ErrInvalid},
+	}
+
+	for _, test := range tests {
+		d, err := Parse(test.s, now)
+		if err != test.err {
+			t.Errorf("Parse(%q): expected error %v, got %v", test.s, test.err, err)
+		} else if d != test.expected {
+			t.Errorf("Parse(%q): expected %v, got %v", test.s, test.expected, d)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		s        string
+		expected time.Duration
+		err      error
+	}{
+		{"3600", time.Hour, nil},
+		{"1d12h", 36 * time.Hour, nil},
+		{"never", 0, nil},
+		{"2030-01-02T16:04:05Z", 0, ErrInvalidDuration},
+		{"tomorrow", 0, ErrInvalidDuration},
+		{"100000000000w", 0, ErrInvalidDuration},
+	}
+
+	for _, test := range tests {
+		d, err := ParseDuration(test.s)
+		if err != test.err {
+			t.Errorf("ParseDuration(%q): expected error %v, got %v", test.s, test.err, err)
+		} else if d != test.expected {
+			t.Errorf("ParseDuration(%q): expected %v, got %v", test.s, test.expected, d)
+		}
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -17,6 +19,11 @@ import (
 func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	fileName := c.URLParams["name"]
 
+	if isReservedKey(fileName) {
+		notFoundHandler(c, w, r)
+		return
+	}
+
 	metadata, err := checkFile(fileName)
 	if err == backends.NotFoundErr {
 		notFoundHandler(c, w, r)
@@ -52,8 +59,13 @@ func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Content-Type", metadata.Mimetype)
 	w.Header().Set("Content-Length", strconv.FormatInt(metadata.Size, 10))
+	w.Header().Set("Content-Disposition", contentDisposition(r, fileName, metadata))
 	w.Header().Set("Etag", fmt.Sprintf("\"%s\"", metadata.Sha256sum))
-	w.Header().Set("Cache-Control", "public, no-cache")
+	if metadata.MaxDownloads > 0 {
+		w.Header().Set("Cache-Control", "no-store")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
 
 	modtime := time.Unix(0, 0)
 	if done := httputil.CheckPreconditions(w, r, modtime); done {
@@ -61,6 +73,33 @@ func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method != "HEAD" {
+		if metadata.MaxDownloads > 0 {
+			// Every request counts as a download, so limited files are
+			// always served whole
+			r.Header.Del("Range")
+
+			_, last, err := countDownload(fileName)
+			if err == backends.NotFoundErr {
+				notFoundHandler(c, w, r)
+				return
+			} else if err != nil {
+				oopsHandler(c, w, r, RespAUTO, err.Error())
+				return
+			}
+
+			if last != nil {
+				sendWebhook(webhookEventAccess, fileName, metadata)
+				defer last.Close()
+				_, _ = io.Copy(w, last)
+				return
+			}
+		}
+
+		// Players fetch media in many ranges, of which only the first
+		// counts as an access
+		if rangeHeader := r.Header.Get("Range"); rangeHeader == "" || strings.HasPrefix(rangeHeader, "bytes=0-") {
+			sendWebhook(webhookEventAccess, fileName, metadata)
+		}
 
 		err = storageBackend.ServeFile(fileName, w, r)
 		if err != nil {
@@ -70,6 +109,22 @@ func fileServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Content-Disposition header naming a file as it was uploaded, which forces
+// a download when the request has a download parameter
+func contentDisposition(r *http.Request, fileName string, metadata backends.Metadata) string {
+	disposition := "inline"
+	if r.URL.Query().Get("download") != "" {
+		disposition = "attachment"
+	}
+
+	name := metadata.OriginalName
+	if name == "" {
+		name = fileName
+	}
+
+	return mime.FormatMediaType(disposition, map[string]string{"filename": name})
+}
+
 func staticHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	if path[len(path)-1:] == "/" {
@@ -101,10 +156,11 @@ func checkFile(filename string) (metadata backends.Metadata, err error) {
 	}
 
 	if expiry.IsTsExpired(metadata.Expiry) {
-		err = storageBackend.Delete(filename)
+		err = deleteFile(filename)
 		if err != nil {
 			return
 		}
+		sendWebhook(webhookEventExpire, filename, metadata)
 		err = backends.NotFoundErr
 		return
 	}
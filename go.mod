@@ -6,25 +6,34 @@ toolchain go1.22.2
 
 require (
 	github.com/GeertJohan/go.rice v1.0.3
+	github.com/aws/aws-sdk-go v1.55.8
 	github.com/dchest/uniuri v1.2.0
 	github.com/dustin/go-humanize v1.0.1
 	github.com/flosch/pongo2 v0.0.0-20200913210552-0d938eb266f3
 	github.com/gabriel-vasile/mimetype v1.4.3
+	github.com/johannesboyne/gofakes3 v0.0.0-20230506070712-04da935ef877
+	github.com/klauspost/compress v1.17.11
 	github.com/microcosm-cc/bluemonday v1.0.26
 	github.com/minio/sha256-simd v1.0.1
 	github.com/russross/blackfriday v1.6.0
 	github.com/vharitonsky/iniflags v0.0.0-20180513140207-a33cd0b5f3de
 	github.com/zenazn/goji v1.0.1
+	go.etcd.io/bbolt v1.3.10
 	golang.org/x/crypto v0.22.0
+	golang.org/x/image v0.18.0
 )
 
 require (
 	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/daaku/go.zipexe v1.0.2 // indirect
 	github.com/gorilla/css v1.0.1 // indirect
+	github.com/jmespath/go-jmespath v0.4.0 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.7 // indirect
 	github.com/kr/text v0.2.0 // indirect
+	github.com/ryszard/goskiplist v0.0.0-20150312221310-2dfbae5fcf46 // indirect
+	github.com/shabbyrobe/gocovmerge v0.0.0-20190829150210-3e036491d500 // indirect
 	golang.org/x/net v0.24.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
+	golang.org/x/tools v0.8.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
 )
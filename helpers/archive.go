@@ -9,62 +9,56 @@ import (
 	"sort"
 )
 
-type ReadSeekerAt interface {
-	io.Reader
-	io.Seeker
-	io.ReaderAt
+// Whether the files in an archive of this type can be listed while reading
+// it from start to end
+func streamableArchive(mimetype string) bool {
+	switch mimetype {
+	case "application/x-tar", "application/gzip", "application/x-gzip", "application/x-bzip", "application/x-bzip2":
+		return true
+	}
+	return false
 }
 
-func ListArchiveFiles(mimetype string, size int64, r ReadSeekerAt) (files []string, err error) {
-	if mimetype == "application/x-tar" {
-		tReadr := tar.NewReader(r)
-		for {
-			hdr, err := tReadr.Next()
-			if err == io.EOF || err != nil {
-				break
-			}
-			if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
-				files = append(files, hdr.Name)
-			}
-		}
-		sort.Strings(files)
-	} else if mimetype == "application/x-gzip" {
+func listTarFiles(mimetype string, r io.Reader) (files []string) {
+	switch mimetype {
+	case "application/x-tar":
+	case "application/gzip", "application/x-gzip":
 		gzf, err := gzip.NewReader(r)
-		if err == nil {
-			tReadr := tar.NewReader(gzf)
-			for {
-				hdr, err := tReadr.Next()
-				if err == io.EOF || err != nil {
-					break
-				}
-				if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
-					files = append(files, hdr.Name)
-				}
-			}
-			sort.Strings(files)
+		if err != nil {
+			return
+		}
+		r = gzf
+	case "application/x-bzip", "application/x-bzip2":
+		r = bzip2.NewReader(r)
+	default:
+		return
+	}
+
+	tReadr := tar.NewReader(r)
+	for {
+		hdr, err := tReadr.Next()
+		if err != nil {
+			break
 		}
-	} else if mimetype == "application/x-bzip" {
-		bzf := bzip2.NewReader(r)
-		tReadr := tar.NewReader(bzf)
-		for {
-			hdr, err := tReadr.Next()
-			if err == io.EOF || err != nil {
-				break
-			}
-			if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
-				files = append(files, hdr.Name)
-			}
+		if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeReg {
+			files = append(files, hdr.Name)
 		}
-		sort.Strings(files)
-	} else if mimetype == "application/zip" {
-		zf, err := zip.NewReader(r, size)
-		if err == nil {
-			for _, f := range zf.File {
-				files = append(files, f.Name)
-			}
+	}
+	sort.Strings(files)
+
+	return
+}
+
+// Zip archives are listed from the central directory at their end, which
+// needs random access
+func listZipFiles(r io.ReaderAt, size int64) (files []string) {
+	zf, err := zip.NewReader(r, size)
+	if err == nil {
+		for _, f := range zf.File {
+			files = append(files, f.Name)
 		}
-		sort.Strings(files)
 	}
+	sort.Strings(files)
 
 	return
 }
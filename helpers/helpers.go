@@ -1,8 +1,8 @@
 package helpers
 
 import (
-	"bytes"
 	"encoding/hex"
+	"hash"
 	"io"
 
 	"github.com/andreimarcu/linx-server/backends"
@@ -10,44 +10,136 @@ import (
 	"github.com/minio/sha256-simd"
 )
 
+// Number of leading bytes used for mimetype detection
+const mimetypeHeaderSize = 512
+
 func GenerateMetadata(r io.Reader) (m backends.Metadata, err error) {
-	// Since we don't have the ability to seek within a file, we can use a
-	// Buffer in combination with a TeeReader to keep a copy of the bytes
-	// we read when detecting the file type. These bytes are still needed
-	// to hash the file and determine its size and cannot be discarded.
-	var buf bytes.Buffer
-	teeReader := io.TeeReader(r, &buf)
-
-	// Get first 512 bytes for mimetype detection
-	header := make([]byte, 512)
-	headerlen, err := teeReader.Read(header)
+	w := NewMetadataWriter()
+	defer w.Close()
+
+	readLen, err := io.Copy(w, r)
 	if err != nil {
 		return
+	} else if readLen == 0 {
+		return m, io.EOF
 	}
 
-	// Create a Hash and a MultiReader that includes the Buffer we created
-	// above along with the original Reader, which will have the rest of
-	// the file.
-	hasher := sha256.New()
-	multiReader := io.MultiReader(&buf, r)
+	return w.Metadata(nil), nil
+}
 
-	// Copy everything into the Hash, then use the number of bytes written
-	// as the file size.
-	var readLen int64
-	readLen, err = io.Copy(hasher, multiReader)
-	if err != nil {
-		return
-	} else {
-		m.Size += readLen
+// Generates the metadata of a file from its contents as they are written
+// to it, so that storing a file takes a single pass over its contents. The
+// contents are hashed and counted as they go, the mimetype is detected as
+// soon as the header is complete, and tar archives are listed by a
+// goroutine that reads along.
+type MetadataWriter struct {
+	hasher   hash.Hash
+	size     int64
+	header   []byte
+	mimetype string
+	closed   bool
+
+	archive      *io.PipeWriter
+	archiveDone  chan []string
+	archiveFiles []string
+}
+
+func NewMetadataWriter() *MetadataWriter {
+	return &MetadataWriter{
+		hasher: sha256.New(),
+		header: make([]byte, 0, mimetypeHeaderSize),
 	}
+}
 
-	// Get the hex-encoded string version of the Hash checksum
-	m.Sha256sum = hex.EncodeToString(hasher.Sum(nil))
+func (w *MetadataWriter) Write(p []byte) (int, error) {
+	w.hasher.Write(p)
+	w.size += int64(len(p))
 
-	// Use the bytes we extracted earlier and attempt to determine the file
-	// type
-	kind := mimetype.Detect(header[:headerlen])
-	m.Mimetype = kind.String()
+	rest := p
+	if w.mimetype == "" {
+		n := min(len(rest), cap(w.header)-len(w.header))
+		w.header = append(w.header, rest[:n]...)
+		rest = rest[n:]
+
+		if len(w.header) < cap(w.header) {
+			return len(p), nil
+		}
+		w.detect()
+	}
+
+	if w.archive != nil && len(rest) > 0 {
+		w.archive.Write(rest)
+	}
+
+	return len(p), nil
+}
+
+func (w *MetadataWriter) detect() {
+	w.mimetype = mimetype.Detect(w.header).String()
+
+	if streamableArchive(w.mimetype) {
+		pr, pw := io.Pipe()
+		w.archive = pw
+		w.archiveDone = make(chan []string, 1)
+
+		go func(mimetype string) {
+			files := listTarFiles(mimetype, pr)
+			// Keep reading so that writes don't block once listing stops
+			_, _ = io.Copy(io.Discard, pr)
+			w.archiveDone <- files
+		}(w.mimetype)
+
+		w.archive.Write(w.header)
+	}
+}
+
+// Mark the end of the contents. This must be called when writing is done
+// or abandoned, to stop listing archives, and is called by Metadata.
+func (w *MetadataWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.mimetype == "" {
+		w.detect()
+	}
+
+	if w.archive != nil {
+		w.archive.Close()
+		w.archiveFiles = <-w.archiveDone
+	}
+
+	return nil
+}
+
+// Metadata of everything that was written. Zip archives can only be listed
+// with random access, from r when it isn't nil.
+func (w *MetadataWriter) Metadata(r io.ReaderAt) (m backends.Metadata) {
+	w.Close()
+
+	m.Sha256sum = hex.EncodeToString(w.hasher.Sum(nil))
+	m.Mimetype = w.mimetype
+	m.Size = w.size
+	m.ArchiveFiles = w.archiveFiles
+
+	if m.Mimetype == "application/zip" && r != nil {
+		m.ArchiveFiles = listZipFiles(r, m.Size)
+	}
 
 	return
 }
+
+// Complete the metadata a file is stored with by what was written, keeping
+// its mimetype if it has one
+func (w *MetadataWriter) Complete(m backends.Metadata, r io.ReaderAt) backends.Metadata {
+	generated := w.Metadata(r)
+
+	m.Sha256sum = generated.Sha256sum
+	m.Size = generated.Size
+	m.ArchiveFiles = generated.ArchiveFiles
+	if m.Mimetype == "" {
+		m.Mimetype = generated.Mimetype
+	}
+	return m
+}
@@ -1,7 +1,11 @@
 package helpers
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"io"
 	"strings"
 	"testing"
 	"unicode/utf16"
@@ -71,3 +75,65 @@ func TestTextCharsets(t *testing.T) {
 		}
 	}
 }
+
+func TestMetadataWriter(t *testing.T) {
+	content := bytes.Repeat([]byte("This is my test content\n"), 1000)
+
+	expected, err := GenerateMetadata(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes of any size, including ones splitting the header
+	for _, chunk := range []int{1, 7, 511, 512, 4096} {
+		w := NewMetadataWriter()
+		for i := 0; i < len(content); i += chunk {
+			w.Write(content[i:min(i+chunk, len(content))])
+		}
+
+		m := w.Metadata(nil)
+		if m.Sha256sum != expected.Sha256sum || m.Mimetype != expected.Mimetype || m.Size != expected.Size {
+			t.Fatalf("[%d] Metadata %+v does not match %+v", chunk, m, expected)
+		}
+	}
+}
+
+func TestMetadataWriterArchives(t *testing.T) {
+	var tarBuf bytes.Buffer
+	gz := gzip.NewWriter(&tarBuf)
+	tw := tar.NewWriter(gz)
+	for _, name := range []string{"b.txt", "a.txt"} {
+		contents := strings.Repeat("archived ", 10000)
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(contents))
+	}
+	tw.Close()
+	gz.Close()
+
+	tarGz := tarBuf.Bytes()
+
+	w := NewMetadataWriter()
+	io.Copy(w, &tarBuf)
+	m := w.Metadata(nil)
+	if m.Mimetype != "application/gzip" || strings.Join(m.ArchiveFiles, ",") != "a.txt,b.txt" {
+		t.Fatalf("Unexpected tar.gz metadata %s %v", m.Mimetype, m.ArchiveFiles)
+	}
+
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	f, _ := zw.Create("c.txt")
+	f.Write([]byte("zipped"))
+	zw.Close()
+
+	w = NewMetadataWriter()
+	w.Write(zipBuf.Bytes())
+	m = w.Metadata(bytes.NewReader(zipBuf.Bytes()))
+	if m.Mimetype != "application/zip" || strings.Join(m.ArchiveFiles, ",") != "c.txt" {
+		t.Fatalf("Unexpected zip metadata %s %v", m.Mimetype, m.ArchiveFiles)
+	}
+
+	// Abandoned uploads don't leave the archive listing waiting
+	w = NewMetadataWriter()
+	w.Write(tarGz[:100])
+	w.Close()
+}
@@ -0,0 +1,298 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+// Most read ahead of the meta box, and largest meta box read
+const (
+	maxHEIFReadAhead = 1 << 20
+	maxHEIFMetaBox   = 16 << 20
+)
+
+// Part of a HEIF file to blank out
+type heifRange struct {
+	offset int64
+	length int64
+}
+
+// HEIF files keep metadata as items of the meta box, whose data is located
+// by absolute offsets, so rather than being removed it is overwritten with
+// zeroes, which leaves every offset valid. The meta box normally precedes
+// the image data, and is read in full to find out which ranges to blank.
+// Files with more than maxHEIFReadAhead bytes ahead of it are left as they
+// are.
+func stripHEIF(w io.Writer, br *bufio.Reader) error {
+	var head bytes.Buffer
+	for {
+		boxType, boxSize, ok := peekHEIFBox(br)
+		if !ok || (boxType != "meta" && int64(head.Len())+boxSize > maxHEIFReadAhead) || boxSize > maxHEIFMetaBox {
+			break
+		}
+
+		box := make([]byte, boxSize)
+		ok, err := readFull(&head, br, box)
+		if !ok {
+			if err != nil {
+				return err
+			}
+			break
+		}
+		head.Write(box)
+
+		if boxType != "meta" {
+			continue
+		}
+
+		offset := int64(head.Len())
+		ranges := heifMetadataRanges(offset-boxSize, box)
+		zeroHEIFRanges(head.Bytes(), 0, ranges)
+		_, err = head.WriteTo(w)
+		if err != nil {
+			return err
+		}
+
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := br.Read(buf)
+			zeroHEIFRanges(buf[:n], offset, ranges)
+			offset += int64(n)
+
+			_, werr := w.Write(buf[:n])
+			if werr != nil {
+				return werr
+			}
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Without a meta box up front there is nothing to strip
+	_, err := head.WriteTo(w)
+	if err != nil {
+		return err
+	}
+	return copyRest(w, br)
+}
+
+func peekHEIFBox(br *bufio.Reader) (boxType string, size int64, ok bool) {
+	header, err := br.Peek(8)
+	if err != nil {
+		return
+	}
+
+	boxType = string(header[4:8])
+	size = int64(binary.BigEndian.Uint32(header))
+	if size == 1 {
+		header, err = br.Peek(16)
+		if err != nil {
+			return
+		}
+		size = int64(binary.BigEndian.Uint64(header[8:]))
+	}
+
+	// A size of 0 extends the box to the end of the file
+	return boxType, size, size >= 8
+}
+
+func zeroHEIFRanges(buf []byte, offset int64, ranges []heifRange) {
+	for _, r := range ranges {
+		start := max(r.offset-offset, 0)
+		end := min(r.offset+r.length-offset, int64(len(buf)))
+		for i := start; i < end; i++ {
+			buf[i] = 0
+		}
+	}
+}
+
+// Reads the fields of a box, remembering when it runs out
+type heifFields struct {
+	b   []byte
+	bad bool
+}
+
+func (f *heifFields) uint(n int) uint64 {
+	if f.bad || n > len(f.b) {
+		f.bad = true
+		return 0
+	}
+
+	var v uint64
+	for _, c := range f.b[:n] {
+		v = v<<8 | uint64(c)
+	}
+	f.b = f.b[n:]
+	return v
+}
+
+func (f *heifFields) string() string {
+	for i, c := range f.b {
+		if c == 0 {
+			s := string(f.b[:i])
+			f.b = f.b[i+1:]
+			return s
+		}
+	}
+	f.bad = true
+	return ""
+}
+
+// Child boxes of a box's contents, by type, along with their offsets within
+// it
+func heifChildren(contents []byte) map[string][]int64 {
+	children := make(map[string][]int64)
+	for offset := int64(0); offset+8 <= int64(len(contents)); {
+		size := int64(binary.BigEndian.Uint32(contents[offset:]))
+		if size < 8 || offset+size > int64(len(contents)) {
+			break
+		}
+		boxType := string(contents[offset+4 : offset+8])
+		children[boxType] = append(children[boxType], offset)
+		offset += size
+	}
+	return children
+}
+
+func heifBox(contents []byte, offset int64) []byte {
+	size := int64(binary.BigEndian.Uint32(contents[offset:]))
+	return contents[offset+8 : offset+size]
+}
+
+// Ranges of the file holding the data of the EXIF and XMP items listed in
+// its meta box, which starts at metaOffset
+func heifMetadataRanges(metaOffset int64, meta []byte) (ranges []heifRange) {
+	// The meta box is a full box, with a version and flags
+	if len(meta) < 12 {
+		return nil
+	}
+	contentsOffset := metaOffset + 12
+	contents := meta[12:]
+	children := heifChildren(contents)
+
+	if len(children["iinf"]) == 0 || len(children["iloc"]) == 0 {
+		return nil
+	}
+	items := heifMetadataItems(heifBox(contents, children["iinf"][0]))
+	if len(items) == 0 {
+		return nil
+	}
+
+	var idatOffset int64 = -1
+	if len(children["idat"]) > 0 {
+		idatOffset = contentsOffset + children["idat"][0] + 8
+	}
+
+	f := heifFields{b: heifBox(contents, children["iloc"][0])}
+	version := f.uint(1)
+	f.uint(3)
+	sizes := f.uint(1)
+	offsetSize, lengthSize := int(sizes>>4), int(sizes&0xf)
+	sizes = f.uint(1)
+	baseOffsetSize, indexSize := int(sizes>>4), int(sizes&0xf)
+	if version == 0 {
+		indexSize = 0
+	}
+
+	var itemCount uint64
+	if version < 2 {
+		itemCount = f.uint(2)
+	} else {
+		itemCount = f.uint(4)
+	}
+
+	for i := uint64(0); i < itemCount && !f.bad; i++ {
+		var itemID uint64
+		if version < 2 {
+			itemID = f.uint(2)
+		} else {
+			itemID = f.uint(4)
+		}
+
+		var constructionMethod uint64
+		if version > 0 {
+			constructionMethod = f.uint(2) & 0xf
+		}
+		dataReference := f.uint(2)
+		baseOffset := int64(f.uint(baseOffsetSize))
+		extentCount := f.uint(2)
+
+		for j := uint64(0); j < extentCount && !f.bad; j++ {
+			f.uint(indexSize)
+			extentOffset := int64(f.uint(offsetSize))
+			extentLength := int64(f.uint(lengthSize))
+
+			if !items[itemID] || dataReference != 0 {
+				continue
+			}
+
+			switch {
+			case constructionMethod == 0:
+				ranges = append(ranges, heifRange{baseOffset + extentOffset, extentLength})
+			case constructionMethod == 1 && idatOffset >= 0:
+				ranges = append(ranges, heifRange{idatOffset + baseOffset + extentOffset, extentLength})
+			}
+		}
+	}
+
+	// Extents of length 0 span the rest of the file, which is never the
+	// case for metadata, so there is no way to tell what they are
+	var valid []heifRange
+	for _, r := range ranges {
+		if r.length > 0 && r.offset >= 0 {
+			valid = append(valid, r)
+		}
+	}
+	return valid
+}
+
+// IDs of the EXIF and XMP items in the contents of an iinf box
+func heifMetadataItems(iinf []byte) map[uint64]bool {
+	items := make(map[uint64]bool)
+
+	f := heifFields{b: iinf}
+	version := f.uint(1)
+	f.uint(3)
+	if version == 0 {
+		f.uint(2)
+	} else {
+		f.uint(4)
+	}
+	if f.bad {
+		return items
+	}
+
+	children := heifChildren(f.b)
+	for _, offset := range children["infe"] {
+		infe := heifFields{b: heifBox(f.b, offset)}
+		version := infe.uint(1)
+		infe.uint(3)
+		if version < 2 {
+			continue
+		}
+
+		var itemID uint64
+		if version == 2 {
+			itemID = infe.uint(2)
+		} else {
+			itemID = infe.uint(4)
+		}
+		infe.uint(2)
+		itemType := string([]byte{byte(infe.uint(1)), byte(infe.uint(1)), byte(infe.uint(1)), byte(infe.uint(1))})
+		infe.string()
+
+		switch itemType {
+		case "Exif":
+			items[itemID] = !infe.bad
+		case "mime":
+			items[itemID] = infe.string() == "application/rdf+xml" && !infe.bad
+		}
+	}
+
+	return items
+}
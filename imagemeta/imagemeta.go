@@ -0,0 +1,132 @@
+// Package imagemeta removes the EXIF, XMP and IPTC metadata images carry
+// alongside their pixels, by rewriting their containers without decoding
+// the images themselves. It also reads the EXIF orientation images need to
+// be displayed the right way up.
+package imagemeta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+var stripFuncs = map[string]func(w io.Writer, br *bufio.Reader) error{
+	"image/jpeg": stripJPEG,
+	"image/png":  stripPNG,
+	"image/webp": stripWebP,
+	"image/heic": stripHEIF,
+	"image/heif": stripHEIF,
+}
+
+// Check whether metadata can be stripped from images of a mimetype
+func Supported(mimetype string) bool {
+	_, ok := stripFuncs[mimetype]
+	return ok
+}
+
+// Copy an image from r to w without its metadata, except for the EXIF
+// orientation needed to display it the right way up. Images of unsupported
+// types, and the rest of images that stop making sense partway through,
+// are copied as they are.
+func Strip(mimetype string, w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+
+	strip, ok := stripFuncs[mimetype]
+	if !ok {
+		return copyRest(w, br)
+	}
+	return strip(w, br)
+}
+
+var orientationFuncs = map[string]func(br *bufio.Reader) uint16{
+	"image/jpeg": jpegOrientation,
+	"image/png":  pngOrientation,
+}
+
+// Read the EXIF orientation of an image, which says how to turn it to
+// display it the right way up. It is 0 when the image has none, or is of a
+// type that keeps its metadata after the image data.
+func Orientation(mimetype string, r io.Reader) uint16 {
+	orientation, ok := orientationFuncs[mimetype]
+	if !ok {
+		return 0
+	}
+	return orientation(bufio.NewReader(r))
+}
+
+func copyRest(w io.Writer, br *bufio.Reader) error {
+	_, err := io.Copy(w, br)
+	return err
+}
+
+// Read as much of a structure as there is, writing it out as is when the
+// image ends early. The returned ok is false in that case, and the error is
+// only set when reading or writing fails.
+func readFull(w io.Writer, br *bufio.Reader, buf []byte) (ok bool, err error) {
+	n, err := io.ReadFull(br, buf)
+	if err == nil {
+		return true, nil
+	} else if err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+
+	_, err = w.Write(buf[:n])
+	return false, err
+}
+
+const exifOrientationTag = 0x0112
+
+// Read the orientation from the first IFD of TIFF structured EXIF data, 0
+// if it has none
+func exifOrientation(tiff []byte) uint16 {
+	if len(tiff) < 8 {
+		return 0
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+
+	offset := int64(order.Uint32(tiff[4:8]))
+	if offset+2 > int64(len(tiff)) {
+		return 0
+	}
+
+	count := int64(order.Uint16(tiff[offset:]))
+	for i := int64(0); i < count; i++ {
+		entry := offset + 2 + 12*i
+		if entry+12 > int64(len(tiff)) {
+			return 0
+		}
+
+		// The orientation is a single SHORT
+		if order.Uint16(tiff[entry:]) == exifOrientationTag && order.Uint16(tiff[entry+2:]) == 3 {
+			return order.Uint16(tiff[entry+8:])
+		}
+	}
+	return 0
+}
+
+// TIFF structured EXIF data holding nothing but an orientation, or nil when
+// the orientation is the default one or not a valid one
+func orientationExif(orientation uint16) []byte {
+	if orientation < 2 || orientation > 8 {
+		return nil
+	}
+
+	tiff := []byte{
+		'M', 'M', 0, 42, // Big endian TIFF header
+		0, 0, 0, 8, // Offset of the first IFD
+		0, 1, // One entry
+		0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 0, 0, 0, // Orientation, one SHORT
+		0, 0, 0, 0, // No next IFD
+	}
+	binary.BigEndian.PutUint16(tiff[18:], orientation)
+	return tiff
+}
@@ -0,0 +1,319 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 16), uint8(y * 16), 128, 255})
+		}
+	}
+	return img
+}
+
+// Little endian TIFF data with an orientation and a GPS IFD pointer, followed
+// by something that stands for the coordinates
+func testExif(orientation uint16) []byte {
+	tiff := []byte{'I', 'I', 42, 0, 8, 0, 0, 0, 2, 0}
+	tiff = binary.LittleEndian.AppendUint16(tiff, exifOrientationTag)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 3)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint32(tiff, uint32(orientation))
+	tiff = binary.LittleEndian.AppendUint16(tiff, 0x8825)
+	tiff = binary.LittleEndian.AppendUint16(tiff, 4)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 1)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 38)
+	tiff = binary.LittleEndian.AppendUint32(tiff, 0)
+	return append(tiff, "SECRET-GPS"...)
+}
+
+func jpegSegment(marker byte, payload []byte) []byte {
+	segment := []byte{0xff, marker, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	return append(segment, payload...)
+}
+
+func pngChunk(chunkType string, data []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	chunk = append(chunk, chunkType...)
+	chunk = append(chunk, data...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+func strip(t *testing.T, mimetype string, input []byte) []byte {
+	var output bytes.Buffer
+	err := Strip(mimetype, &output, bytes.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(output.Bytes(), []byte("SECRET")) {
+		t.Fatalf("Metadata was left in the stripped %s", mimetype)
+	}
+	return output.Bytes()
+}
+
+func samePixels(t *testing.T, a, b image.Image) {
+	if a.Bounds() != b.Bounds() {
+		t.Fatalf("Bounds changed from %v to %v", a.Bounds(), b.Bounds())
+	}
+	for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+		for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+			if a.At(x, y) != b.At(x, y) {
+				t.Fatalf("Pixel %d,%d changed", x, y)
+			}
+		}
+	}
+}
+
+func TestStripJPEG(t *testing.T) {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := encoded.Bytes()
+
+	input := append([]byte{}, original[:2]...)
+	input = append(input, jpegSegment(jpegAPP1, append([]byte("Exif\x00\x00"), testExif(6)...))...)
+	input = append(input, jpegSegment(jpegAPP1, []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>SECRET-XMP</x:xmpmeta>"))...)
+	input = append(input, jpegSegment(jpegAPP13, []byte("Photoshop 3.0\x008BIM SECRET-IPTC"))...)
+	input = append(input, original[2:]...)
+
+	output := strip(t, "image/jpeg", input)
+
+	exif := jpegSegment(jpegAPP1, append([]byte("Exif\x00\x00"), orientationExif(6)...))
+	if !bytes.Equal(output, append(append(original[:2:2], exif...), original[2:]...)) {
+		t.Fatalf("Stripped JPEG is not the original one with only its orientation")
+	}
+
+	decoded, err := jpeg.Decode(bytes.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decodedOriginal, _ := jpeg.Decode(bytes.NewReader(original))
+	samePixels(t, decodedOriginal, decoded)
+}
+
+func TestStripPNG(t *testing.T) {
+	var encoded bytes.Buffer
+	err := png.Encode(&encoded, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := encoded.Bytes()
+
+	// After the signature and the IHDR chunk
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	comment := pngChunk("tEXt", []byte("Comment\x00kept"))
+
+	input := append([]byte{}, original[:ihdrEnd]...)
+	input = append(input, pngChunk("eXIf", testExif(3))...)
+	input = append(input, pngChunk("iTXt", []byte("XML:com.adobe.xmp\x00\x00\x00\x00\x00<x:xmpmeta>SECRET-XMP</x:xmpmeta>"))...)
+	input = append(input, comment...)
+	input = append(input, original[ihdrEnd:]...)
+
+	output := strip(t, "image/png", input)
+
+	expected := append([]byte{}, original[:ihdrEnd]...)
+	expected = append(expected, pngChunk("eXIf", orientationExif(3))...)
+	expected = append(expected, comment...)
+	expected = append(expected, original[ihdrEnd:]...)
+	if !bytes.Equal(output, expected) {
+		t.Fatalf("Stripped PNG is not the original one with only its orientation and comment")
+	}
+
+	decoded, err := png.Decode(bytes.NewReader(output))
+	if err != nil {
+		t.Fatal(err)
+	}
+	samePixels(t, testImage(), decoded)
+}
+
+func TestStripWebP(t *testing.T) {
+	riffChunk := func(fourcc string, data []byte) []byte {
+		chunk := append([]byte(fourcc), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(chunk[4:], uint32(len(data)))
+		chunk = append(chunk, data...)
+		if len(data)%2 == 1 {
+			chunk = append(chunk, 0)
+		}
+		return chunk
+	}
+	riff := func(chunks ...[]byte) []byte {
+		body := []byte("WEBP")
+		for _, chunk := range chunks {
+			body = append(body, chunk...)
+		}
+		header := []byte("RIFF\x00\x00\x00\x00")
+		binary.LittleEndian.PutUint32(header[4:], uint32(len(body)))
+		return append(header, body...)
+	}
+
+	vp8x := []byte{0x10 | webpFlagExif | webpFlagXMP, 0, 0, 0, 15, 0, 0, 15, 0, 0}
+	bitstream := riffChunk("VP8L", []byte("PIXEL"))
+
+	input := riff(riffChunk("VP8X", vp8x), bitstream, riffChunk("EXIF", testExif(1)), riffChunk("XMP ", []byte("SECRET-XMP")))
+	output := strip(t, "image/webp", input)
+
+	vp8x[0] = 0x10
+	if !bytes.Equal(output, riff(riffChunk("VP8X", vp8x), bitstream)) {
+		t.Fatalf("Stripped WebP is not the original one without metadata chunks")
+	}
+
+	// Simple format images can't have metadata
+	simple := riff(bitstream)
+	if !bytes.Equal(strip(t, "image/webp", simple), simple) {
+		t.Fatalf("Simple WebP was changed")
+	}
+}
+
+func TestStripHEIF(t *testing.T) {
+	box := func(boxType string, contents ...[]byte) []byte {
+		b := append([]byte{0, 0, 0, 0}, boxType...)
+		for _, c := range contents {
+			b = append(b, c...)
+		}
+		binary.BigEndian.PutUint32(b, uint32(len(b)))
+		return b
+	}
+	fullBox := func(boxType string, version byte, contents ...[]byte) []byte {
+		return box(boxType, append([][]byte{{version, 0, 0, 0}}, contents...)...)
+	}
+	u16 := func(v int) []byte { return binary.BigEndian.AppendUint16(nil, uint16(v)) }
+	u32 := func(v int) []byte { return binary.BigEndian.AppendUint32(nil, uint32(v)) }
+
+	infe := func(id int, itemType string, extra string) []byte {
+		return fullBox("infe", 2, u16(id), u16(0), []byte(itemType), []byte("\x00"), []byte(extra))
+	}
+	iinf := fullBox("iinf", 0, u16(3),
+		infe(1, "hvc1", ""),
+		infe(2, "Exif", ""),
+		infe(3, "mime", "application/rdf+xml\x00"))
+
+	ftyp := box("ftyp", []byte("heic\x00\x00\x00\x00mif1heic"))
+	xmp := []byte("<x:xmpmeta>SECRET-XMP</x:xmpmeta>")
+	exif := append([]byte{0, 0, 0, 0}, testExif(1)...)
+	pixels := []byte("PIXELS")
+
+	// Items are located with 4 byte offsets and lengths, the image and EXIF
+	// data in mdat and the XMP data in idat
+	iloc := func(mdatData int) []byte {
+		return fullBox("iloc", 1, []byte{0x44, 0x00}, u16(3),
+			u16(1), u16(0), u16(0), u16(1), u32(mdatData), u32(len(pixels)),
+			u16(2), u16(0), u16(0), u16(1), u32(mdatData+len(pixels)), u32(len(exif)),
+			u16(3), u16(1), u16(0), u16(1), u32(0), u32(len(xmp)))
+	}
+	build := func(mdatData int) []byte {
+		meta := fullBox("meta", 0, fullBox("hdlr", 0, u32(0), []byte("pict"), make([]byte, 13)), iinf, iloc(mdatData), box("idat", xmp))
+		file := append(append([]byte{}, ftyp...), meta...)
+		return append(file, box("mdat", pixels, exif)...)
+	}
+	// The offsets depend on the size of the boxes before mdat's data
+	input := build(len(build(0)) - len(pixels) - len(exif))
+
+	output := strip(t, "image/heic", input)
+	if len(output) != len(input) {
+		t.Fatalf("Stripped HEIF changed size from %d to %d", len(input), len(output))
+	}
+
+	expected := bytes.Replace(input, xmp, make([]byte, len(xmp)), 1)
+	expected = bytes.Replace(expected, exif, make([]byte, len(exif)), 1)
+	if !bytes.Equal(output, expected) || !bytes.Contains(output, pixels) {
+		t.Fatalf("Stripped HEIF is not the original one with blanked metadata")
+	}
+
+	// Many small boxes ahead of the meta box are only read ahead up to a
+	// point, past which the file is streamed as it is
+	leading := bytes.Repeat(box("free"), maxHEIFReadAhead/8+1000)
+	input = append(append(append([]byte{}, ftyp...), leading...), input[len(ftyp):]...)
+	r := bytes.NewReader(input)
+	var readAhead int64 = -1
+	var buffered bytes.Buffer
+	w := writerFunc(func(p []byte) (int, error) {
+		if readAhead < 0 {
+			readAhead = r.Size() - int64(r.Len())
+		}
+		return buffered.Write(p)
+	})
+	err := Strip("image/heic", w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffered.Bytes(), input) {
+		t.Fatalf("HEIF with many leading boxes was changed")
+	}
+	if readAhead > maxHEIFReadAhead+64*1024 {
+		t.Fatalf("Read %d bytes ahead of the meta box", readAhead)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestStripUnknown(t *testing.T) {
+	input := []byte("SECRET but not an image")
+
+	for _, mimetype := range []string{"image/jpeg", "image/png", "image/webp", "image/heic", "image/gif"} {
+		var output bytes.Buffer
+		err := Strip(mimetype, &output, bytes.NewReader(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(output.Bytes(), input) {
+			t.Fatalf("Unrecognized %s data was changed", mimetype)
+		}
+	}
+
+	if Supported("image/gif") || !Supported("image/jpeg") {
+		t.Fatalf("Unexpected supported mimetypes")
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, testImage(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := encoded.Bytes()
+
+	input := append([]byte{}, original[:2]...)
+	input = append(input, jpegSegment(jpegAPP1, append([]byte("Exif\x00\x00"), testExif(6)...))...)
+	input = append(input, original[2:]...)
+	if o := Orientation("image/jpeg", bytes.NewReader(input)); o != 6 {
+		t.Fatalf("JPEG orientation is %d instead of 6", o)
+	}
+	if o := Orientation("image/jpeg", bytes.NewReader(original)); o != 0 {
+		t.Fatalf("JPEG without EXIF has orientation %d", o)
+	}
+
+	encoded.Reset()
+	err = png.Encode(&encoded, testImage())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ihdrEnd := len(pngSignature) + 8 + 13 + 4
+	input = append([]byte{}, encoded.Bytes()[:ihdrEnd]...)
+	input = append(input, pngChunk("eXIf", testExif(8))...)
+	input = append(input, encoded.Bytes()[ihdrEnd:]...)
+	if o := Orientation("image/png", bytes.NewReader(input)); o != 8 {
+		t.Fatalf("PNG orientation is %d instead of 8", o)
+	}
+
+	if o := Orientation("image/gif", bytes.NewReader(input)); o != 0 {
+		t.Fatalf("Unsupported image has orientation %d", o)
+	}
+}
@@ -0,0 +1,145 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	jpegSOI   = 0xd8
+	jpegEOI   = 0xd9
+	jpegSOS   = 0xda
+	jpegAPP1  = 0xe1 // EXIF and XMP
+	jpegAPP13 = 0xed // Photoshop resources, including IPTC
+)
+
+var jpegExifHeader = []byte("Exif\x00\x00")
+
+// Remove the APP1 and APP13 segments preceding the image data, putting
+// back an EXIF segment with only the orientation when there was one
+func stripJPEG(w io.Writer, br *bufio.Reader) error {
+	soi, err := br.Peek(2)
+	if err != nil || soi[0] != 0xff || soi[1] != jpegSOI {
+		return copyRest(w, br)
+	}
+
+	exifDone := false
+	for {
+		marker, err := br.Peek(2)
+		if err != nil || marker[0] != 0xff {
+			return copyRest(w, br)
+		}
+
+		// Markers without a segment only appear in or after the image data,
+		// which has no metadata to strip
+		switch marker[1] {
+		case jpegSOI:
+			_, err = w.Write([]byte{0xff, jpegSOI})
+			if err != nil {
+				return err
+			}
+			_, err = br.Discard(2)
+			if err != nil {
+				return err
+			}
+			continue
+		case jpegSOS, jpegEOI, 0x01, 0xff:
+			return copyRest(w, br)
+		}
+		if marker[1] >= 0xd0 && marker[1] <= 0xd7 {
+			return copyRest(w, br)
+		}
+
+		header := make([]byte, 4)
+		ok, err := readFull(w, br, header)
+		if !ok {
+			return err
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			_, err = w.Write(header)
+			if err != nil {
+				return err
+			}
+			return copyRest(w, br)
+		}
+
+		payload := make([]byte, length-2)
+		ok, err = readFull(w, br, payload)
+		if !ok {
+			return err
+		}
+
+		switch header[1] {
+		case jpegAPP1:
+			if !exifDone && bytes.HasPrefix(payload, jpegExifHeader) {
+				exifDone = true
+				err = writeJPEGOrientation(w, exifOrientation(payload[len(jpegExifHeader):]))
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		case jpegAPP13:
+			continue
+		}
+
+		_, err = w.Write(header)
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(payload)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func writeJPEGOrientation(w io.Writer, orientation uint16) error {
+	tiff := orientationExif(orientation)
+	if tiff == nil {
+		return nil
+	}
+
+	segment := []byte{0xff, jpegAPP1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(2+len(jpegExifHeader)+len(tiff)))
+	segment = append(segment, jpegExifHeader...)
+	segment = append(segment, tiff...)
+
+	_, err := w.Write(segment)
+	return err
+}
+
+func jpegOrientation(br *bufio.Reader) uint16 {
+	soi := make([]byte, 2)
+	_, err := io.ReadFull(br, soi)
+	if err != nil || soi[0] != 0xff || soi[1] != jpegSOI {
+		return 0
+	}
+
+	for {
+		header := make([]byte, 4)
+		_, err := io.ReadFull(br, header)
+		if err != nil || header[0] != 0xff || header[1] == jpegSOS || header[1] == jpegEOI {
+			return 0
+		}
+
+		length := int(binary.BigEndian.Uint16(header[2:]))
+		if length < 2 {
+			return 0
+		}
+
+		payload := make([]byte, length-2)
+		_, err = io.ReadFull(br, payload)
+		if err != nil {
+			return 0
+		}
+
+		if header[1] == jpegAPP1 && bytes.HasPrefix(payload, jpegExifHeader) {
+			return exifOrientation(payload[len(jpegExifHeader):])
+		}
+	}
+}
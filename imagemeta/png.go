@@ -0,0 +1,155 @@
+package imagemeta
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// Largest text chunk read to check its keyword, bigger ones are kept
+const maxPNGTextChunk = 16 << 20
+
+// Keywords of the text chunks that hold XMP, or EXIF and IPTC as written
+// by ImageMagick
+var pngMetadataKeywords = map[string]bool{
+	"XML:com.adobe.xmp":     true,
+	"Raw profile type exif": true,
+	"Raw profile type APP1": true,
+	"Raw profile type iptc": true,
+	"Raw profile type xmp":  true,
+	"Raw profile type 8bim": true,
+}
+
+// Remove the eXIf chunk, putting back one with only the orientation, and
+// the text chunks holding metadata
+func stripPNG(w io.Writer, br *bufio.Reader) error {
+	signature, err := br.Peek(len(pngSignature))
+	if err != nil || !bytes.Equal(signature, pngSignature) {
+		return copyRest(w, br)
+	}
+
+	_, err = w.Write(pngSignature)
+	if err != nil {
+		return err
+	}
+	_, err = br.Discard(len(pngSignature))
+	if err != nil {
+		return err
+	}
+
+	for {
+		header := make([]byte, 8)
+		ok, err := readFull(w, br, header)
+		if !ok {
+			return err
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		chunkType := string(header[4:])
+
+		if (chunkType == "eXIf" || chunkType == "tEXt" || chunkType == "zTXt" || chunkType == "iTXt") && length <= maxPNGTextChunk {
+			// Data along with the CRC
+			data := make([]byte, length+4)
+			ok, err = readFull(w, br, data)
+			if !ok {
+				return err
+			}
+
+			if chunkType == "eXIf" {
+				err = writePNGOrientation(w, exifOrientation(data[:length]))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			keyword, _, _ := bytes.Cut(data[:length], []byte{0})
+			if pngMetadataKeywords[string(keyword)] {
+				continue
+			}
+
+			_, err = w.Write(header)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = w.Write(header)
+		if err != nil {
+			return err
+		}
+		_, err = io.CopyN(w, br, length+4)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if chunkType == "IEND" {
+			return copyRest(w, br)
+		}
+	}
+}
+
+func writePNGOrientation(w io.Writer, orientation uint16) error {
+	tiff := orientationExif(orientation)
+	if tiff == nil {
+		return nil
+	}
+
+	chunk := make([]byte, 8, 12+len(tiff))
+	binary.BigEndian.PutUint32(chunk, uint32(len(tiff)))
+	copy(chunk[4:], "eXIf")
+	chunk = append(chunk, tiff...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+
+	_, err := w.Write(chunk)
+	return err
+}
+
+func pngOrientation(br *bufio.Reader) uint16 {
+	signature := make([]byte, len(pngSignature))
+	_, err := io.ReadFull(br, signature)
+	if err != nil || !bytes.Equal(signature, pngSignature) {
+		return 0
+	}
+
+	// The eXIf chunk has to come before the image data
+	for {
+		header := make([]byte, 8)
+		_, err := io.ReadFull(br, header)
+		if err != nil {
+			return 0
+		}
+
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		switch string(header[4:]) {
+		case "IDAT", "IEND":
+			return 0
+		case "eXIf":
+			if length > maxPNGTextChunk {
+				return 0
+			}
+			data := make([]byte, length)
+			_, err = io.ReadFull(br, data)
+			if err != nil {
+				return 0
+			}
+			return exifOrientation(data)
+		}
+
+		_, err = br.Discard(int(length + 4))
+		if err != nil {
+			return 0
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package imagemeta
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// Flags of the VP8X chunk announcing metadata chunks
+const (
+	webpFlagExif = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// Remove the EXIF and XMP chunks of an extended format WebP image. These
+// come after the image data, but the RIFF header needs the size of what is
+// left, so the rest of the image is spooled to a temporary file.
+func stripWebP(w io.Writer, br *bufio.Reader) error {
+	// The RIFF header, followed by the header of the first chunk and the
+	// flags, if that is a VP8X chunk
+	header, err := br.Peek(21)
+	if err != nil || string(header[:4]) != "RIFF" || string(header[8:12]) != "WEBP" ||
+		string(header[12:16]) != "VP8X" || header[20]&(webpFlagExif|webpFlagXMP) == 0 {
+		return copyRest(w, br)
+	}
+
+	tmp, err := os.CreateTemp("", "linx-server-strip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = br.Discard(12)
+	if err != nil {
+		return err
+	}
+
+chunks:
+	for {
+		chunkHeader := make([]byte, 8)
+		ok, err := readFull(tmp, br, chunkHeader)
+		if !ok {
+			if err != nil {
+				return err
+			}
+			break chunks
+		}
+
+		fourcc := string(chunkHeader[:4])
+		length := int64(binary.LittleEndian.Uint32(chunkHeader[4:]))
+		// Chunks are padded to an even size
+		length += length & 1
+
+		switch fourcc {
+		case "EXIF", "XMP ":
+			_, err = br.Discard(int(length))
+			if err == io.EOF {
+				break chunks
+			} else if err != nil {
+				return err
+			}
+			continue
+		}
+
+		_, err = tmp.Write(chunkHeader)
+		if err != nil {
+			return err
+		}
+
+		if fourcc == "VP8X" && length > 0 {
+			flags, err := br.ReadByte()
+			if err == io.EOF {
+				break chunks
+			} else if err != nil {
+				return err
+			}
+
+			err = binary.Write(tmp, binary.LittleEndian, flags&^(webpFlagExif|webpFlagXMP))
+			if err != nil {
+				return err
+			}
+			length--
+		}
+
+		_, err = io.CopyN(tmp, br, length)
+		if err == io.EOF {
+			break chunks
+		} else if err != nil {
+			return err
+		}
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	riffHeader := []byte("RIFF\x00\x00\x00\x00WEBP")
+	binary.LittleEndian.PutUint32(riffHeader[4:], uint32(size+4))
+	_, err = w.Write(riffHeader)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, tmp)
+	return err
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/auth/apikeys"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+)
+
+var errQuotaExceeded = errors.New("Storage quota of the API key exceeded.")
+
+// Apply the limits of the API key an upload was made with, on top of
+// those of the server
+func applyKeyLimits(upReq *UploadRequest) error {
+	key := upReq.apiKey
+	if key == nil {
+		return nil
+	}
+
+	if key.MaxSize > 0 && upReq.size > key.MaxSize {
+		return FileTooLargeError
+	}
+	upReq.expiry = limitKeyExpiry(key, upReq.expiry)
+	if key.ForceRandom {
+		upReq.randomBarename = true
+	}
+	return nil
+}
+
+// Cap the time until a file expires, 0 if never, to the maximum expiry of
+// a key
+func limitKeyExpiry(key *apikeys.Key, expiry time.Duration) time.Duration {
+	if key != nil && key.MaxExpiry > 0 && (expiry == 0 || expiry > key.MaxExpiry) {
+		return key.MaxExpiry
+	}
+	return expiry
+}
+
+// Storage used by the files uploaded with each API key that has a quota,
+// by label. It is loaded from the metadata of every file the first time it
+// is needed and kept up to date as files are uploaded and deleted, then
+// loaded again periodically, as files can be deleted without going through
+// this server. Uploads in progress reserve their size until they are
+// counted.
+type keyUsage struct {
+	mu       sync.Mutex
+	loaded   bool
+	files    map[string]keyFile
+	totals   map[string]int64
+	reserved map[string]int64
+}
+
+type keyFile struct {
+	label string
+	size  int64
+}
+
+var keyQuotas keyUsage
+
+// Read the usage of every key from the metadata of the stored files
+func scanKeyUsage() (map[string]keyFile, map[string]int64, error) {
+	files := make(map[string]keyFile)
+	totals := make(map[string]int64)
+
+	metaBackend, ok := storageBackend.(backends.MetaStorageBackend)
+	if !ok {
+		return files, totals, nil
+	}
+
+	filenames, err := metaBackend.List()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, filename := range filenames {
+		metadata, err := metaBackend.Head(filename)
+		if err != nil || metadata.Uploader == "" || expiry.IsTsExpired(metadata.Expiry) {
+			continue
+		}
+		files[filename] = keyFile{metadata.Uploader, metadata.Size}
+		totals[metadata.Uploader] += metadata.Size
+	}
+	return files, totals, nil
+}
+
+// Load the usage again if it was loaded already, without holding up the
+// uploads in the meantime
+func (u *keyUsage) reload() error {
+	u.mu.Lock()
+	loaded := u.loaded
+	u.mu.Unlock()
+	if !loaded {
+		return nil
+	}
+
+	files, totals, err := scanKeyUsage()
+	if err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.loaded {
+		u.files, u.totals = files, totals
+	}
+	return nil
+}
+
+func (u *keyUsage) periodicReload(interval time.Duration) {
+	for range time.Tick(interval) {
+		u.reload()
+	}
+}
+
+// Reserve the size of an upload in the quota of a key, returning the
+// storage that was left to the key beforehand and how much was reserved.
+// Uploads of unknown size reserve all of it until they are stored.
+func (u *keyUsage) reserve(key *apikeys.Key, size int64) (remaining, reserved int64, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.loaded {
+		files, totals, err := scanKeyUsage()
+		if err != nil {
+			return 0, 0, err
+		}
+		u.files, u.totals, u.loaded = files, totals, true
+	}
+	if u.reserved == nil {
+		u.reserved = make(map[string]int64)
+	}
+
+	remaining = key.Quota - u.totals[key.Label] - u.reserved[key.Label]
+	if remaining <= 0 || size > remaining {
+		return 0, 0, errQuotaExceeded
+	}
+	reserved = size
+	if size <= 0 {
+		reserved = remaining
+	}
+	u.reserved[key.Label] += reserved
+	return remaining, reserved, nil
+}
+
+// Release the storage reserved by an upload once it is counted or failed
+func (u *keyUsage) release(label string, reserved int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.reserved[label] -= reserved
+}
+
+// Count a file uploaded with a key, in place of the file it overwrote
+func (u *keyUsage) add(label, filename string, size int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if !u.loaded {
+		return
+	}
+	u.removeLocked(filename)
+	if label != "" {
+		u.files[filename] = keyFile{label, size}
+		u.totals[label] += size
+	}
+}
+
+// Stop counting a file once it is deleted
+func (u *keyUsage) remove(filename string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.loaded {
+		u.removeLocked(filename)
+	}
+}
+
+func (u *keyUsage) removeLocked(filename string) {
+	if f, ok := u.files[filename]; ok {
+		u.totals[f.label] -= f.size
+		delete(u.files, filename)
+	}
+}
+
+// Forget the usage, so that it gets loaded again from the storage backend
+func (u *keyUsage) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.loaded = false
+	u.files, u.totals = nil, nil
+}
+
+// Check that an upload fits in the quota of the key it was made with and
+// reserve its size there, returning the number of bytes it can be stored
+// with, 0 if unlimited, and a function to release the reservation with
+// once the upload is counted or failed. Thumbnails and revisions of the
+// upload aren't counted.
+func checkKeyQuota(key *apikeys.Key, size int64) (int64, func(), error) {
+	if key == nil || key.Quota <= 0 {
+		return 0, func() {}, nil
+	}
+
+	remaining, reserved, err := keyQuotas.reserve(key, size)
+	if err != nil {
+		return 0, nil, err
+	}
+	return remaining, func() { keyQuotas.release(key.Label, reserved) }, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andreimarcu/linx-server/auth/apikeys"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+)
+
+// Short links are stored like files whose content is the URL they lead to,
+// with this mimetype, which is never sniffed from uploads. They have no
+// extension, so that they are as short as they can be and don't take the
+// names of files.
+const linkMimetype = "text/uri-list"
+
+// Longest URL a link can lead to
+const maxLinkLength = 2048
+
+var errInvalidLink = errors.New("Invalid link, which must be an http or https URL.")
+
+// Names of pages of the site, which links can't take as they have no
+// extension, along with those of the custom pages
+var linkBlacklist = map[string]bool{
+	"api":        true,
+	"archive":    true,
+	"auth":       true,
+	"collection": true,
+	"delete":     true,
+	"link":       true,
+	"paste":      true,
+	"static":     true,
+	"upload":     true,
+}
+
+func isLinkBlacklisted(name string) bool {
+	if linkBlacklist[name] || name == strings.Trim(Config.selifPath, "/") {
+		return true
+	}
+	for page := range customPages {
+		if strings.EqualFold(page, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLink(metadata backends.Metadata) bool {
+	return metadata.Mimetype == linkMimetype
+}
+
+// Check that a link leads to a web page, returning it cleaned up
+func parseLink(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if len(s) > maxLinkLength {
+		return "", errInvalidLink
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", errInvalidLink
+	}
+	return u.String(), nil
+}
+
+func readLink(r io.Reader) (string, error) {
+	target, err := io.ReadAll(io.LimitReader(r, maxLinkLength+1))
+	if err != nil {
+		return "", err
+	}
+	return parseLink(string(target))
+}
+
+func linkPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	upReq := UploadRequest{apiKey: apikeys.RequestKey(c), link: true}
+	uploadHeaderProcess(r, &upReq)
+
+	defer r.Body.Close()
+	target, err := readLink(r.Body)
+
+	var upload Upload
+	if err == nil {
+		upReq.filename = c.URLParams["name"]
+		upReq.src = strings.NewReader(target)
+		upReq.size = int64(len(target))
+		upReq.srcIp = r.Header.Get("X-Forwarded-For")
+		upload, err = processUpload(upReq)
+	}
+
+	uploadPutResponse(c, w, r, upload, err)
+}
+
+// Follow a link, after a page showing where it leads to if the server is
+// configured to show one, or if it can only be followed a few times
+func linkHandler(c web.C, w http.ResponseWriter, r *http.Request, fileName string, metadata backends.Metadata) {
+	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		fileDisplayHandler(c, w, r, fileName, metadata)
+		return
+	}
+
+	confirmed := r.PostFormValue("download") != ""
+	cliAgent := cliUserAgentRe.MatchString(r.Header.Get("User-Agent"))
+	if !confirmed && (metadata.MaxDownloads > 0 || (Config.linkInterstitial && !cliAgent)) {
+		var target string
+		// Where links that can only be followed a few times lead to is
+		// only shown when following them
+		if metadata.MaxDownloads == 0 {
+			_, reader, err := storageBackend.Get(fileName)
+			if err != nil {
+				oopsHandler(c, w, r, RespHTML, err.Error())
+				return
+			}
+			target, err = readLink(reader)
+			reader.Close()
+			if err != nil {
+				oopsHandler(c, w, r, RespHTML, "Corrupt link.")
+				return
+			}
+		}
+
+		err := renderTemplate(Templates["link.html"], pongo2.Context{
+			"filename":  fileName,
+			"target":    target,
+			"remaining": max(metadata.MaxDownloads-metadata.Downloads, 0),
+		}, r, w)
+		if err != nil {
+			oopsHandler(c, w, r, RespHTML, "")
+		}
+		return
+	}
+
+	_, reader, err := getDownload(fileName)
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, err.Error())
+		return
+	}
+	target, err := readLink(reader)
+	reader.Close()
+	if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt link.")
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	code := http.StatusFound
+	if r.Method == "POST" {
+		code = http.StatusSeeOther
+	}
+	http.Redirect(w, r, target, code)
+}
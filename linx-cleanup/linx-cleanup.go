@@ -2,22 +2,66 @@ package main
 
 import (
 	"flag"
+	"log"
 
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/s3"
 	"github.com/andreimarcu/linx-server/cleanup"
 )
 
 func main() {
 	var filesDir string
 	var metaDir string
+	var metaDB string
+	var shardDepth int
+	var s3Endpoint string
+	var s3Region string
+	var s3Bucket string
+	var s3ForcePathStyle bool
 	var noLogs bool
 
 	flag.StringVar(&filesDir, "filespath", "files/",
 		"path to files directory")
 	flag.StringVar(&metaDir, "metapath", "meta/",
 		"path to metadata directory")
+	flag.StringVar(&metaDB, "metadb", "",
+		"path to the metadata database, if used instead of metapath")
+	flag.IntVar(&shardDepth, "shard-depth", 0,
+		"levels of subdirectories files and metadata are spread over")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "",
+		"S3 endpoint")
+	flag.StringVar(&s3Region, "s3-region", "",
+		"S3 region")
+	flag.StringVar(&s3Bucket, "s3-bucket", "",
+		"S3 bucket to use for files and metadata")
+	flag.BoolVar(&s3ForcePathStyle, "s3-force-path-style", false,
+		"Force path-style addressing for S3 (e.g. https://s3.amazonaws.com/linx/example.txt)")
 	flag.BoolVar(&noLogs, "nologs", false,
 		"don't log deleted files")
 	flag.Parse()
 
-	cleanup.Cleanup(filesDir, metaDir, noLogs)
+	var fileBackend backends.MetaStorageBackend
+	if s3Bucket != "" {
+		fileBackend = s3.NewS3Backend(s3Bucket, s3Region, s3Endpoint, s3ForcePathStyle)
+	} else {
+		var metaStore localfs.MetaStore
+		if metaDB != "" {
+			store, err := localfs.NewBoltMetaStore(metaDB)
+			if err != nil {
+				log.Fatal("Could not open metadata database: ", err)
+			}
+			defer store.Close()
+			metaStore = store
+		}
+
+		fileBackend = localfs.NewLocalfsBackend(localfs.LocalfsOptions{
+			MetaPath:   metaDir,
+			FilesPath:  filesDir,
+			ShardDepth: shardDepth,
+			MetaStore:  metaStore,
+		})
+	}
+
+	cleanup.Cleanup(fileBackend, noLogs, nil)
 }
@@ -2,19 +2,10 @@ package main
 
 import (
 	"bufio"
-	"encoding/base64"
 	"fmt"
 	"os"
 
-	"golang.org/x/crypto/scrypt"
-)
-
-const (
-	scryptSalt   = "linx-server"
-	scryptN      = 16384
-	scryptr      = 8
-	scryptp      = 1
-	scryptKeyLen = 32
+	"github.com/andreimarcu/linx-server/auth/apikeys"
 )
 
 func main() {
@@ -23,10 +14,10 @@ func main() {
 	scanner := bufio.NewScanner(os.Stdin)
 	scanner.Scan()
 
-	checkKey, err := scrypt.Key([]byte(scanner.Text()), []byte(scryptSalt), scryptN, scryptr, scryptp, scryptKeyLen)
+	hash, err := apikeys.HashKey(scanner.Text())
 	if err != nil {
 		return
 	}
 
-	fmt.Println(base64.StdEncoding.EncodeToString(checkKey))
+	fmt.Println(hash)
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends/localfs"
+)
+
+func main() {
+	var metaDir string
+	var metaDB string
+	var shardDepth int
+	var noLogs bool
+
+	flag.StringVar(&metaDir, "metapath", "meta/",
+		"path to metadata directory to import")
+	flag.StringVar(&metaDB, "metadb", "",
+		"path to the metadata database to import into")
+	flag.IntVar(&shardDepth, "shard-depth", 0,
+		"levels of subdirectories the metadata directory is spread over")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log imported files")
+	flag.Parse()
+
+	if metaDB == "" {
+		log.Fatal("-metadb is required")
+	}
+
+	store, err := localfs.NewBoltMetaStore(metaDB)
+	if err != nil {
+		log.Fatal("Could not open metadata database: ", err)
+	}
+	defer store.Close()
+
+	jsonStore := localfs.NewJSONMetaStore(metaDir, shardDepth)
+	keys, err := jsonStore.List()
+	if err != nil {
+		log.Fatal("Could not list metadata directory: ", err)
+	}
+
+	imported := 0
+	for key, modTime := range keys {
+		metadata, err := jsonStore.Get(key)
+		if err != nil {
+			log.Printf("Failed to read metadata for %s: %v", key, err)
+			continue
+		}
+
+		err = store.Import(key, metadata, modTime)
+		if err != nil {
+			log.Printf("Failed to import %s: %v", key, err)
+			continue
+		}
+
+		if !noLogs {
+			log.Printf("Imported %s", key)
+		}
+		imported++
+	}
+
+	log.Printf("Imported %d of %d files", imported, len(keys))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends/localfs"
+)
+
+func main() {
+	var filesDir string
+	var metaDir string
+	var shardDepth int
+	var noLogs bool
+
+	flag.StringVar(&filesDir, "filespath", "files/",
+		"path to files directory")
+	flag.StringVar(&metaDir, "metapath", "meta/",
+		"path to metadata directory")
+	flag.IntVar(&shardDepth, "shard-depth", 0,
+		"levels of subdirectories to spread files and metadata over")
+	flag.BoolVar(&noLogs, "nologs", false,
+		"don't log moved files")
+	flag.Parse()
+
+	if shardDepth < 1 || shardDepth > localfs.MaxShardDepth {
+		log.Fatalf("-shard-depth must be between 1 and %d", localfs.MaxShardDepth)
+	}
+
+	fileBackend := localfs.NewLocalfsBackend(localfs.LocalfsOptions{
+		MetaPath:   metaDir,
+		FilesPath:  filesDir,
+		ShardDepth: shardDepth,
+	})
+
+	keys, err := fileBackend.List()
+	if err != nil {
+		log.Fatal("Could not list files directory: ", err)
+	}
+
+	moved := 0
+	for _, key := range keys {
+		ok, err := fileBackend.MigrateShards(key)
+		if err != nil {
+			log.Printf("Failed to move %s: %v", key, err)
+			continue
+		}
+
+		if ok {
+			if !noLogs {
+				log.Printf("Moved %s", key)
+			}
+			moved++
+		}
+	}
+
+	log.Printf("Moved %d of %d files", moved, len(keys))
+}
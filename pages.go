@@ -25,6 +25,7 @@ func indexHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		"expirylist":    listExpirationTimes(),
 		"expirydefault": Config.defaultExpiry,
 		"forcerandom":   Config.forceRandomFilename,
+		"stripmetadata": Config.stripMetadata,
 	}, r, w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -32,6 +33,10 @@ func indexHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 func pasteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !Config.disableSecurityHeaders {
+		w.Header().Set(cspHeader, scriptCSPOptions.policy)
+	}
+
 	err := renderTemplate(Templates["paste.html"], pongo2.Context{
 		"expirylist":    listExpirationTimes(),
 		"expirydefault": Config.defaultExpiry,
@@ -44,8 +49,13 @@ func pasteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 
 func apiDocHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	err := renderTemplate(Templates["API.html"], pongo2.Context{
-		"siteurl":     getSiteURL(r),
-		"forcerandom": Config.forceRandomFilename,
+		"siteurl":          getSiteURL(r),
+		"forcerandom":      Config.forceRandomFilename,
+		"tus":              Config.tusDir != "",
+		"stripmetadata":    Config.stripMetadata,
+		"thumbnailsize":    Config.thumbnailSize,
+		"pasterevisions":   Config.pasteRevisions,
+		"linkinterstitial": Config.linkInterstitial,
 	}, r, w)
 	if err != nil {
 		oopsHandler(c, w, r, RespHTML, "")
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+var errTypeNotAllowed = errors.New("File type not allowed.")
+
+// Rules about which files can be uploaded, matched against the mimetype
+// sniffed from their contents and against their extension. Mimetypes are
+// matched by globs such as video/*, and the deny lists take precedence
+// over the allow lists, which allow everything when empty.
+type typePolicy struct {
+	allowMimetypes  []string
+	denyMimetypes   []string
+	allowExtensions []string
+	denyExtensions  []string
+	maxSizes        []mimetypeMaxSize
+}
+
+// Largest size of the files whose mimetype matches a glob
+type mimetypeMaxSize struct {
+	pattern string
+	size    int64
+}
+
+// Policy uploads are checked against
+var uploadTypePolicy typePolicy
+
+// Parse the comma-separated lists of a policy. Maximum sizes are listed as
+// glob=size, with sizes such as 200MB, and the first glob a mimetype
+// matches sets its maximum size.
+func parseTypePolicy(allowMimetypes, denyMimetypes, allowExtensions, denyExtensions, maxSizes string) (p typePolicy, err error) {
+	p.allowMimetypes, err = parseMimetypeGlobs(allowMimetypes)
+	if err != nil {
+		return
+	}
+	p.denyMimetypes, err = parseMimetypeGlobs(denyMimetypes)
+	if err != nil {
+		return
+	}
+	p.allowExtensions = parseExtensions(allowExtensions)
+	p.denyExtensions = parseExtensions(denyExtensions)
+
+	for _, item := range splitList(maxSizes) {
+		pattern, sizeStr, ok := strings.Cut(item, "=")
+		if !ok {
+			return p, fmt.Errorf("maximum size %q is not glob=size", item)
+		}
+
+		globs, err := parseMimetypeGlobs(pattern)
+		if err != nil {
+			return p, err
+		}
+		if len(globs) != 1 {
+			return p, fmt.Errorf("maximum size %q has no mimetype glob", item)
+		}
+		size, err := humanize.ParseBytes(strings.TrimSpace(sizeStr))
+		if err != nil {
+			return p, fmt.Errorf("maximum size %q: %v", item, err)
+		}
+		p.maxSizes = append(p.maxSizes, mimetypeMaxSize{globs[0], int64(size)})
+	}
+
+	return
+}
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+func parseMimetypeGlobs(list string) ([]string, error) {
+	globs := splitList(strings.ToLower(list))
+	for _, glob := range globs {
+		_, err := path.Match(glob, "")
+		if err != nil {
+			return nil, fmt.Errorf("mimetype glob %q: %v", glob, err)
+		}
+	}
+	return globs, nil
+}
+
+func parseExtensions(list string) (extensions []string) {
+	for _, extension := range splitList(strings.ToLower(list)) {
+		extensions = append(extensions, strings.TrimLeft(extension, "."))
+	}
+	return
+}
+
+// Mimetypes are matched without their parameters, such as the charset
+func matchMimetype(globs []string, mimetype string) bool {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	mimetype = strings.ToLower(strings.TrimSpace(mimetype))
+
+	for _, glob := range globs {
+		if ok, _ := path.Match(glob, mimetype); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Extensions match the whole extension of a file, or its last part, so
+// that gz matches tar.gz
+func matchExtension(extensions []string, extension string) bool {
+	for _, e := range extensions {
+		if extension == e || strings.HasSuffix(extension, "."+e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check whether a file with a mimetype and an extension can be uploaded
+func (p typePolicy) check(mimetype, extension string) error {
+	if matchMimetype(p.denyMimetypes, mimetype) || matchExtension(p.denyExtensions, extension) {
+		return errTypeNotAllowed
+	}
+	if len(p.allowMimetypes) > 0 && !matchMimetype(p.allowMimetypes, mimetype) {
+		return errTypeNotAllowed
+	}
+	if len(p.allowExtensions) > 0 && !matchExtension(p.allowExtensions, extension) {
+		return errTypeNotAllowed
+	}
+	return nil
+}
+
+// Largest size of files of a mimetype, 0 if only the maximum size of every
+// upload applies
+func (p typePolicy) maxSize(mimetype string) int64 {
+	for _, m := range p.maxSizes {
+		if matchMimetype([]string{m.pattern}, mimetype) {
+			return m.size
+		}
+	}
+	return 0
+}
+
+// Reads through to a reader, failing with err once more than n bytes were
+// read
+type maxSizeReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.n -= int64(n)
+	if m.n < 0 {
+		return n, m.err
+	}
+	return n, err
+}
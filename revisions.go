@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/diff"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/dustin/go-humanize"
+	"github.com/flosch/pongo2"
+	"github.com/zenazn/goji/web"
+)
+
+// Earlier versions of pastes are stored like files under an internal key
+// named after the paste and their number. They get the paste's expiry, so
+// that they expire and get cleaned up along with it.
+func revisionKey(filename string, revision int64) string {
+	return internalKey("rev", fmt.Sprintf("%s.%d", filename, revision))
+}
+
+// Check whether a file is a paste, which keeps its earlier versions when it
+// is overwritten with its delete key
+func isPaste(filename, mimetype string, size int64) bool {
+	if mimetype == linkMimetype || mimetype == encryptedPasteMimetype {
+		return false
+	}
+	extension := strings.TrimPrefix(filepath.Ext(filename), ".")
+	return size < maxDisplayFileSizeBytes && (strings.HasPrefix(mimetype, "text/") || supportedBinExtension(extension))
+}
+
+// Number of the current version of a file, counted from 1
+func currentRevision(metadata backends.Metadata) int64 {
+	return max(metadata.Revision, 1)
+}
+
+// Keep the current version of a paste that is being overwritten as a
+// revision, returning the number of the new version. Revisions beyond those
+// kept are only deleted with updateRevisions once the new version is stored.
+func keepRevision(filename string, previous backends.Metadata, fileExpiry time.Time) (int64, error) {
+	revision := currentRevision(previous)
+
+	_, reader, err := storageBackend.Get(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	_, err = storageBackend.Put(revisionKey(filename, revision), reader, backends.Metadata{
+		Expiry:    fileExpiry,
+		DeleteKey: previous.DeleteKey,
+		SrcIp:     previous.SrcIp,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return revision + 1, nil
+}
+
+// Give the revisions of a paste up to the latest one its expiry, deleting
+// those beyond the number of revisions kept
+func updateRevisions(filename string, latest int64, fileExpiry time.Time) {
+	for n := latest; n >= 1; n-- {
+		key := revisionKey(filename, n)
+		metadata, err := storageBackend.Head(key)
+		if err != nil {
+			// Older revisions were deleted already
+			return
+		}
+
+		if n <= latest-Config.pasteRevisions {
+			storageBackend.Delete(key)
+		} else if !metadata.Expiry.Equal(fileExpiry) {
+			metadata.Expiry = fileExpiry
+			storageBackend.PutMetadata(key, metadata)
+		}
+	}
+}
+
+func deleteRevisions(filename string, revision int64) {
+	for n := revision - 1; n >= 1; n-- {
+		if storageBackend.Delete(revisionKey(filename, n)) != nil {
+			return
+		}
+	}
+}
+
+// Look up the paste a request about its revisions is for, checking its
+// access key. The response is written if it can't be served.
+func revisionPaste(c web.C, w http.ResponseWriter, r *http.Request) (filename string, metadata backends.Metadata, ok bool) {
+	filename = c.URLParams["name"]
+	if isReservedKey(filename) {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	metadata, err := checkFile(filename)
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt metadata.")
+		return
+	}
+
+	if src, err := checkAccessKey(r, &metadata); err != nil {
+		// remove invalid cookie
+		if src == accessKeySourceCookie {
+			setAccessKeyCookies(w, getSiteURL(r), filename, "", time.Unix(0, 0))
+		}
+		unauthorizedHandler(c, w, r)
+		return
+	}
+
+	// Pastes that can only be downloaded a few times have no revisions, as
+	// they would be read without using up a download
+	if !isPaste(filename, metadata.Mimetype, metadata.Size) || metadata.MaxDownloads > 0 {
+		notFoundHandler(c, w, r)
+		return
+	}
+	return filename, metadata, true
+}
+
+func parseRevision(revStr string, metadata backends.Metadata) (int64, bool) {
+	revision, err := strconv.ParseInt(revStr, 10, 64)
+	return revision, err == nil && revision >= 1 && revision <= currentRevision(metadata)
+}
+
+// Key a version of a paste is stored under
+func revisionStorageKey(filename string, metadata backends.Metadata, revision int64) string {
+	if revision == currentRevision(metadata) {
+		return filename
+	}
+	return revisionKey(filename, revision)
+}
+
+func readRevision(filename string, metadata backends.Metadata, revision int64) (backends.Metadata, string, error) {
+	revMetadata, reader, err := storageBackend.Get(revisionStorageKey(filename, metadata, revision))
+	if err != nil {
+		return revMetadata, "", err
+	}
+	defer reader.Close()
+
+	contents, err := io.ReadAll(io.LimitReader(reader, maxDisplayFileSizeBytes))
+	return revMetadata, string(contents), err
+}
+
+type revisionInfo struct {
+	Number    int64
+	Size      int64
+	SizeHuman string
+	// Revision before this one, 0 if it wasn't kept
+	Previous int64
+}
+
+func revisionListHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	filename, metadata, ok := revisionPaste(c, w, r)
+	if !ok {
+		return
+	}
+
+	current := currentRevision(metadata)
+	revisions := []revisionInfo{{current, metadata.Size, humanize.Bytes(uint64(metadata.Size)), 0}}
+	for n := current - 1; n >= 1; n-- {
+		revMetadata, err := storageBackend.Head(revisionKey(filename, n))
+		if err != nil {
+			break
+		}
+		revisions[len(revisions)-1].Previous = n
+		revisions = append(revisions, revisionInfo{n, revMetadata.Size, humanize.Bytes(uint64(revMetadata.Size)), 0})
+	}
+
+	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		var list []map[string]string
+		for _, revision := range revisions {
+			list = append(list, map[string]string{
+				"revision": strconv.FormatInt(revision.Number, 10),
+				"size":     strconv.FormatInt(revision.Size, 10),
+				"url":      getSiteURL(r) + filename + "/rev/" + strconv.FormatInt(revision.Number, 10),
+			})
+		}
+		js, _ := json.Marshal(map[string]interface{}{
+			"filename":  filename,
+			"revisions": list,
+		})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		w.Write(js)
+		return
+	}
+
+	err := renderTemplate(Templates["revisions.html"], pongo2.Context{
+		"filename":  filename,
+		"expiry":    relativeExpiry(metadata),
+		"current":   current,
+		"revisions": revisions,
+	}, r, w)
+	if err != nil {
+		oopsHandler(c, w, r, RespHTML, "")
+	}
+}
+
+func revisionHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	filename, metadata, ok := revisionPaste(c, w, r)
+	if !ok {
+		return
+	}
+	revision, ok := parseRevision(c.URLParams["rev"], metadata)
+	if !ok {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	revMetadata, contents, err := readRevision(filename, metadata, revision)
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespHTML, err.Error())
+		return
+	}
+
+	extension := strings.TrimPrefix(filepath.Ext(filename), ".")
+	err = renderTemplate(Templates["display/bin.html"], pongo2.Context{
+		"mime":         revMetadata.Mimetype,
+		"filename":     filename,
+		"originalname": metadata.OriginalName,
+		"size":         humanize.Bytes(uint64(revMetadata.Size)),
+		"expiry":       relativeExpiry(metadata),
+		"expirylist":   listExpirationTimes(),
+		"extra": map[string]string{
+			"extension": extension,
+			"lang_hl":   extensionToHlLang(extension),
+			"contents":  contents,
+		},
+		"forcerandom":  Config.forceRandomFilename,
+		"revision":     currentRevision(metadata),
+		"viewrevision": revision,
+		"siteurl":      strings.TrimSuffix(getSiteURL(r), "/"),
+	}, r, w)
+	if err != nil {
+		oopsHandler(c, w, r, RespHTML, "")
+	}
+}
+
+// Serve a version of a paste as it is
+func revisionServeHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	filename, metadata, ok := revisionPaste(c, w, r)
+	if !ok {
+		return
+	}
+	revision, ok := parseRevision(c.URLParams["rev"], metadata)
+	if !ok {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	key := revisionStorageKey(filename, metadata, revision)
+	revMetadata, err := storageBackend.Head(key)
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt metadata.")
+		return
+	}
+
+	if !Config.disableSecurityHeaders {
+		w.Header().Set(cspHeader, defaultFileCSPOptions.policy)
+		w.Header().Set(rpHeader, defaultFileCSPOptions.referrerPolicy)
+	}
+	w.Header().Set("Content-Type", revMetadata.Mimetype)
+	w.Header().Set("Content-Length", strconv.FormatInt(revMetadata.Size, 10))
+	w.Header().Set("Etag", fmt.Sprintf("\"%s\"", revMetadata.Sha256sum))
+	w.Header().Set("Cache-Control", "public, no-cache")
+
+	if r.Method != "HEAD" {
+		err = storageBackend.ServeFile(key, w, r)
+		if err != nil {
+			oopsHandler(c, w, r, RespAUTO, err.Error())
+		}
+	}
+}
+
+type diffLine struct {
+	Class string
+	Text  string
+}
+
+func revisionDiffHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	filename, metadata, ok := revisionPaste(c, w, r)
+	if !ok {
+		return
+	}
+	from, okFrom := parseRevision(c.URLParams["from"], metadata)
+	to, okTo := parseRevision(c.URLParams["to"], metadata)
+	if !okFrom || !okTo {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	_, fromContents, err := readRevision(filename, metadata, from)
+	var toContents string
+	if err == nil {
+		_, toContents, err = readRevision(filename, metadata, to)
+	}
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespHTML, err.Error())
+		return
+	}
+
+	var lines []diffLine
+	for _, line := range diff.Texts(fromContents, toContents) {
+		switch line.Op {
+		case diff.Delete:
+			lines = append(lines, diffLine{"diff-delete", "-" + line.Text})
+		case diff.Insert:
+			lines = append(lines, diffLine{"diff-insert", "+" + line.Text})
+		default:
+			lines = append(lines, diffLine{"", " " + line.Text})
+		}
+	}
+
+	err = renderTemplate(Templates["diff.html"], pongo2.Context{
+		"filename": filename,
+		"expiry":   relativeExpiry(metadata),
+		"from":     from,
+		"to":       to,
+		"lines":    lines,
+	}, r, w)
+	if err != nil {
+		oopsHandler(c, w, r, RespHTML, "")
+	}
+}
+
+func relativeExpiry(metadata backends.Metadata) string {
+	if metadata.Expiry == expiry.NeverExpire {
+		return ""
+	}
+	return humanize.RelTime(time.Now(), metadata.Expiry, "", "")
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/scanner"
+)
+
+// What happens to uploads the scanner finds malware in: they are either
+// refused, stored where they are never served so they can be looked into,
+// or stored as usual with the name of the malware in their metadata
+const (
+	scanPolicyReject     = "reject"
+	scanPolicyQuarantine = "quarantine"
+	scanPolicyFlag       = "flag"
+)
+
+var errMalwareFound = errors.New("File was rejected by the malware scanner.")
+
+// Scanner uploads are checked with, nil if they aren't
+var uploadScanner scanner.Scanner
+
+// Quarantined uploads are stored like files under an internal key named
+// after the name they would have had, so that they expire and get cleaned
+// up like them, but never get served.
+func quarantineKey(filename string) string {
+	return internalKey("quarantine", filename)
+}
+
+// Reads through to a reader, keeping the error it fails with
+type recordingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (rr *recordingReader) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	if err != nil && err != io.EOF {
+		rr.err = err
+	}
+	return n, err
+}
+
+// Temporary file removed once it is closed
+type spoolFile struct {
+	*os.File
+}
+
+func (f spoolFile) Close() error {
+	defer os.Remove(f.Name())
+	return f.File.Close()
+}
+
+// Scan an upload as it gets spooled to a temporary file, which is returned
+// to be stored in its place, along with the name of the malware found in
+// it. Uploads are spooled since they can only be read once, and must not be
+// stored before they are known to be clean.
+func scanUpload(r io.Reader) (spooled io.ReadCloser, malware string, err error) {
+	tmp, err := os.CreateTemp("", "linx-server-scan")
+	if err != nil {
+		return nil, "", err
+	}
+	spool := spoolFile{tmp}
+
+	src := &recordingReader{r: r}
+	tee := io.TeeReader(src, spool)
+	malware, err = uploadScanner.Scan(tee)
+	if err == nil {
+		// Make sure nothing was left unread
+		_, err = io.Copy(io.Discard, tee)
+	}
+	if src.err != nil {
+		// Errors reading the upload, such as it being too large, are
+		// reported as they are rather than as scanning errors
+		err = src.err
+	}
+	if err != nil {
+		spool.Close()
+		return nil, "", err
+	}
+
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		spool.Close()
+		return nil, "", err
+	}
+
+	return spool, malware, nil
+}
+
+// Store an upload found to be malware where it won't be served
+func quarantineUpload(filename string, r io.Reader, malware string, expiry time.Time, deleteKey, srcIp string) error {
+	_, err := storageBackend.Put(quarantineKey(filename), r, backends.Metadata{
+		Expiry:    expiry,
+		DeleteKey: deleteKey,
+		SrcIp:     srcIp,
+		Malware:   malware,
+	})
+	if err != nil {
+		return err
+	}
+
+	if !Config.noLogs {
+		log.Printf("Quarantined upload %s from %s: %s", filename, srcIp, malware)
+	}
+	return nil
+}
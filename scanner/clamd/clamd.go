@@ -0,0 +1,111 @@
+// Package clamd scans files with a ClamAV daemon, streaming them over its
+// unix or TCP socket.
+package clamd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/andreimarcu/linx-server/scanner"
+)
+
+// Size of the chunks files are streamed to clamd in
+const chunkSize = 64 * 1024
+
+type ClamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+// Make a scanner for the clamd listening at address, which is the path of a
+// unix socket if it starts with a slash, and a host and port otherwise.
+// The timeout applies to connecting and to each exchange with clamd, 0 for
+// none.
+func NewClamdScanner(address string, timeout time.Duration) ClamdScanner {
+	network := "tcp"
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+	return ClamdScanner{network: network, address: address, timeout: timeout}
+}
+
+func (s ClamdScanner) Scan(r io.Reader) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", scanner.ScanFailedErr, err)
+	}
+	defer conn.Close()
+
+	err = s.stream(conn, r)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", scanner.ScanFailedErr, err)
+	}
+
+	// Replies to z prefixed commands end with a null byte
+	conn.SetDeadline(s.deadline())
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", scanner.ScanFailedErr, err)
+	}
+
+	return parseReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+func (s ClamdScanner) deadline() time.Time {
+	if s.timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(s.timeout)
+}
+
+// Send a file with the INSTREAM command, as chunks preceded by their
+// length and followed by an empty one
+func (s ClamdScanner) stream(conn net.Conn, r io.Reader) error {
+	conn.SetDeadline(s.deadline())
+	_, err := conn.Write([]byte("zINSTREAM\x00"))
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, 4+chunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf[4:])
+		if n > 0 {
+			binary.BigEndian.PutUint32(buf, uint32(n))
+			conn.SetDeadline(s.deadline())
+			_, err = conn.Write(buf[:4+n])
+			if err != nil {
+				return err
+			}
+		}
+
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		} else if rerr != nil {
+			return rerr
+		}
+	}
+
+	_, err = conn.Write([]byte{0, 0, 0, 0})
+	return err
+}
+
+// Replies look like "stream: OK", "stream: Eicar-Signature FOUND" or
+// "INSTREAM size limit exceeded. ERROR"
+func parseReply(reply string) (string, error) {
+	reply = strings.TrimPrefix(reply, "stream: ")
+
+	switch {
+	case reply == "OK":
+		return "", nil
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSuffix(reply, " FOUND"), nil
+	}
+	return "", fmt.Errorf("%w: clamd replied %q", scanner.ScanFailedErr, reply)
+}
@@ -0,0 +1,109 @@
+package clamd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andreimarcu/linx-server/scanner"
+)
+
+// Serve a single INSTREAM command like clamd, replying with what reply
+// makes of the streamed file
+func fakeClamd(t *testing.T, reply func(file []byte) string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		command := make([]byte, len("zINSTREAM\x00"))
+		_, err = io.ReadFull(conn, command)
+		if err != nil || string(command) != "zINSTREAM\x00" {
+			return
+		}
+
+		var file []byte
+		for {
+			var length uint32
+			err = binary.Read(conn, binary.BigEndian, &length)
+			if err != nil {
+				return
+			}
+			if length == 0 {
+				break
+			}
+			chunk := make([]byte, length)
+			_, err = io.ReadFull(conn, chunk)
+			if err != nil {
+				return
+			}
+			file = append(file, chunk...)
+		}
+
+		conn.Write([]byte(reply(file) + "\x00"))
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestScan(t *testing.T) {
+	// Large enough to be streamed in several chunks
+	clean := bytes.Repeat([]byte("clean "), chunkSize)
+	infected := append(append([]byte{}, clean...), "EICAR"...)
+
+	for _, file := range [][]byte{clean, infected} {
+		var received []byte
+		address := fakeClamd(t, func(f []byte) string {
+			received = f
+			if bytes.HasSuffix(f, []byte("EICAR")) {
+				return "stream: Eicar-Signature FOUND"
+			}
+			return "stream: OK"
+		})
+
+		malware, err := NewClamdScanner(address, 5*time.Second).Scan(bytes.NewReader(file))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(received, file) {
+			t.Fatalf("clamd received %d bytes instead of %d", len(received), len(file))
+		}
+
+		expected := ""
+		if bytes.Equal(file, infected) {
+			expected = "Eicar-Signature"
+		}
+		if malware != expected {
+			t.Fatalf("Found %q instead of %q", malware, expected)
+		}
+	}
+}
+
+func TestScanError(t *testing.T) {
+	address := fakeClamd(t, func(f []byte) string {
+		return "INSTREAM size limit exceeded. ERROR"
+	})
+
+	_, err := NewClamdScanner(address, 5*time.Second).Scan(strings.NewReader("file"))
+	if !errors.Is(err, scanner.ScanFailedErr) {
+		t.Fatalf("Scan did not fail, but returned %v", err)
+	}
+
+	_, err = NewClamdScanner("/nonexistent/clamd.sock", 5*time.Second).Scan(strings.NewReader("file"))
+	if !errors.Is(err, scanner.ScanFailedErr) {
+		t.Fatalf("Scan did not fail without clamd, but returned %v", err)
+	}
+}
@@ -0,0 +1,16 @@
+// Package scanner defines the malware scanners uploads are checked with
+// before they are stored.
+package scanner
+
+import (
+	"errors"
+	"io"
+)
+
+type Scanner interface {
+	// Read a file to its end, and return the name of the malware found in
+	// it, empty if none was
+	Scan(r io.Reader) (string, error)
+}
+
+var ScanFailedErr = errors.New("Could not scan file.")
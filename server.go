@@ -14,8 +14,11 @@ import (
 	rice "github.com/GeertJohan/go.rice"
 	"github.com/andreimarcu/linx-server/auth/apikeys"
 	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/backends/encrypted"
 	"github.com/andreimarcu/linx-server/backends/localfs"
+	"github.com/andreimarcu/linx-server/backends/s3"
 	"github.com/andreimarcu/linx-server/cleanup"
+	"github.com/andreimarcu/linx-server/scanner/clamd"
 	"github.com/flosch/pongo2"
 	"github.com/vharitonsky/iniflags"
 	"github.com/zenazn/goji/graceful"
@@ -38,6 +41,17 @@ var Config struct {
 	bind                   string
 	filesDir               string
 	metaDir                string
+	metaDB                 string
+	dedup                  bool
+	compress               bool
+	shardDepth             int
+	s3Endpoint             string
+	s3Region               string
+	s3Bucket               string
+	s3ForcePathStyle       bool
+	encryptionKeyFile      string
+	tusDir                 string
+	tusExpiry              uint64
 	siteName               string
 	siteURL                string
 	sitePath               string
@@ -53,6 +67,7 @@ var Config struct {
 	allowHotlink           bool
 	basicAuth              bool
 	authFile               string
+	private                bool
 	addHeaders             headerList
 	noDirectAgents         bool
 	forceRandomFilename    bool
@@ -64,6 +79,22 @@ var Config struct {
 	maxDurationSize        int64
 	disableAccessKey       bool
 	defaultRandomFilename  bool
+	stripMetadata          bool
+	thumbnailSize          int
+	pasteRevisions         int64
+	linkInterstitial       bool
+	clamdAddress           string
+	clamdTimeout           uint64
+	scanPolicy             string
+	allowMimetypes         string
+	denyMimetypes          string
+	allowExtensions        string
+	denyExtensions         string
+	mimetypeMaxSizes       string
+	webhookURLs            headerList
+	webhookSecret          string
+	webhookQueuePath       string
+	webhookEvents          string
 }
 
 var Templates = make(map[string]*pongo2.Template)
@@ -98,26 +129,24 @@ func setup() *web.Mux {
 	mux.Use(AddHeaders(Config.addHeaders))
 
 	if Config.authFile != "" {
+		// Private instances can only be read with a key
+		unauthMethods := []string{"GET", "HEAD", "OPTIONS", "TRACE"}
+		unauthRequest := isFileAccessPost
+		if Config.private {
+			unauthMethods = []string{"OPTIONS"}
+			unauthRequest = nil
+		}
+
 		mux.Use(apikeys.NewApiKeysMiddleware(apikeys.AuthOptions{
 			AuthFile:      Config.authFile,
-			UnauthMethods: []string{"GET", "HEAD", "OPTIONS", "TRACE"},
+			UnauthMethods: unauthMethods,
+			UnauthRequest: unauthRequest,
 			BasicAuth:     Config.basicAuth,
 			SiteName:      Config.siteName,
 			SitePath:      Config.sitePath,
 		}))
 	}
 
-	// make directories if needed
-	err := os.MkdirAll(Config.filesDir, 0755)
-	if err != nil {
-		log.Fatal("Could not create files directory:", err)
-	}
-
-	err = os.MkdirAll(Config.metaDir, 0700)
-	if err != nil {
-		log.Fatal("Could not create metadata directory:", err)
-	}
-
 	if Config.siteURL != "" {
 		// ensure siteURL ends wth '/'
 		if lastChar := Config.siteURL[len(Config.siteURL)-1:]; lastChar != "/" {
@@ -139,9 +168,82 @@ func setup() *web.Mux {
 		Config.selifPath = Config.selifPath + "/"
 	}
 
-	storageBackend = localfs.NewLocalfsBackend(Config.metaDir, Config.filesDir)
+	var metaBackend backends.MetaStorageBackend
+	if Config.s3Bucket != "" {
+		metaBackend = s3.NewS3Backend(Config.s3Bucket, Config.s3Region, Config.s3Endpoint, Config.s3ForcePathStyle)
+	} else {
+		// make directories if needed
+		err := os.MkdirAll(Config.filesDir, 0755)
+		if err != nil {
+			log.Fatal("Could not create files directory:", err)
+		}
+
+		err = os.MkdirAll(Config.metaDir, 0700)
+		if err != nil {
+			log.Fatal("Could not create metadata directory:", err)
+		}
+
+		if Config.shardDepth < 0 || Config.shardDepth > localfs.MaxShardDepth {
+			log.Fatalf("shard-depth must be between 0 and %d", localfs.MaxShardDepth)
+		}
+
+		var metaStore localfs.MetaStore
+		if Config.metaDB != "" {
+			metaStore, err = localfs.NewBoltMetaStore(Config.metaDB)
+			if err != nil {
+				log.Fatal("Could not open metadata database:", err)
+			}
+		}
+
+		metaBackend = localfs.NewLocalfsBackend(localfs.LocalfsOptions{
+			MetaPath:   Config.metaDir,
+			FilesPath:  Config.filesDir,
+			Dedup:      Config.dedup,
+			Compress:   Config.compress,
+			ShardDepth: Config.shardDepth,
+			MetaStore:  metaStore,
+		})
+	}
+
+	if Config.encryptionKeyFile != "" {
+		keys, err := encrypted.ReadKeyFile(Config.encryptionKeyFile)
+		if err != nil {
+			log.Fatal("Could not read encryption key file:", err)
+		}
+		metaBackend = encrypted.NewEncryptedBackend(metaBackend, keys)
+	}
+
+	storageBackend = metaBackend
+
+	var err error
+	uploadTypePolicy, err = parseTypePolicy(Config.allowMimetypes, Config.denyMimetypes,
+		Config.allowExtensions, Config.denyExtensions, Config.mimetypeMaxSizes)
+	if err != nil {
+		log.Fatal("Could not parse upload policy:", err)
+	}
+
+	if Config.clamdAddress != "" {
+		switch Config.scanPolicy {
+		case scanPolicyReject, scanPolicyQuarantine, scanPolicyFlag:
+		default:
+			log.Fatal("scan-policy must be reject, quarantine or flag")
+		}
+		uploadScanner = clamd.NewClamdScanner(Config.clamdAddress, time.Duration(Config.clamdTimeout)*time.Second)
+	} else {
+		uploadScanner = nil
+	}
+
+	setupWebhooks()
+	keyQuotas.reset()
+
 	if Config.cleanupEveryMinutes > 0 {
-		go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, Config.filesDir, Config.metaDir, Config.noLogs)
+		go cleanup.PeriodicCleanup(time.Duration(Config.cleanupEveryMinutes)*time.Minute, metaBackend, Config.noLogs, cleanedUp)
+	}
+	if Config.tusDir != "" {
+		go periodicTusCleanup(periodicInterval())
+	}
+	if Config.authFile != "" {
+		go keyQuotas.periodicReload(periodicInterval())
 	}
 
 	// Template setup
@@ -164,40 +266,74 @@ func setup() *web.Mux {
 	selifRe := regexp.MustCompile("^" + Config.sitePath + Config.selifPath + `(?P<name>[a-z0-9-\.]+)$`)
 	selifIndexRe := regexp.MustCompile("^" + Config.sitePath + Config.selifPath + `$`)
 
+	// Keys need a scope for each route, which requests the API key
+	// middleware lets through without a key don't
+	read := func(h web.HandlerFunc) web.HandlerFunc {
+		return apikeys.RequireScope(h, apikeys.ScopeReadPrivate)
+	}
+	upload := func(h web.HandlerFunc) web.HandlerFunc {
+		return apikeys.RequireScope(h, apikeys.ScopeUpload)
+	}
+	deletion := func(h web.HandlerFunc) web.HandlerFunc {
+		return apikeys.RequireScope(h, apikeys.ScopeUpload, apikeys.ScopeDeleteAny)
+	}
+
 	if Config.authFile == "" || Config.basicAuth {
-		mux.Get(Config.sitePath, indexHandler)
-		mux.Get(Config.sitePath+"paste/", pasteHandler)
+		mux.Get(Config.sitePath, read(indexHandler))
+		mux.Get(Config.sitePath+"paste/", read(pasteHandler))
 	} else {
 		mux.Get(Config.sitePath, http.RedirectHandler(Config.sitePath+"API", 303))
 		mux.Get(Config.sitePath+"paste/", http.RedirectHandler(Config.sitePath+"API/", 303))
 	}
 	mux.Get(Config.sitePath+"paste", http.RedirectHandler(Config.sitePath+"paste/", 301))
 
-	mux.Get(Config.sitePath+"API/", apiDocHandler)
+	mux.Get(Config.sitePath+"API/", read(apiDocHandler))
 	mux.Get(Config.sitePath+"API", http.RedirectHandler(Config.sitePath+"API/", 301))
 
-	mux.Post(Config.sitePath+"upload", uploadPostHandler)
-	mux.Post(Config.sitePath+"upload/", uploadPostHandler)
-	mux.Put(Config.sitePath+"upload", uploadPutHandler)
-	mux.Put(Config.sitePath+"upload/", uploadPutHandler)
-	mux.Put(Config.sitePath+"upload/:name", uploadPutHandler)
+	if Config.tusDir != "" {
+		mux.Options(Config.sitePath+"upload/tus/", tusOptionsHandler)
+		mux.Post(Config.sitePath+"upload/tus/", upload(tusCreateHandler))
+		mux.Head(Config.sitePath+"upload/tus/:id", upload(tusHeadHandler))
+		mux.Patch(Config.sitePath+"upload/tus/:id", upload(tusPatchHandler))
+		mux.Delete(Config.sitePath+"upload/tus/:id", upload(tusDeleteHandler))
+	}
 
-	mux.Delete(Config.sitePath+":name", deleteHandler)
+	mux.Post(Config.sitePath+"upload", upload(uploadPostHandler))
+	mux.Post(Config.sitePath+"upload/", upload(uploadPostHandler))
+	mux.Put(Config.sitePath+"upload", upload(uploadPutHandler))
+	mux.Put(Config.sitePath+"upload/", upload(uploadPutHandler))
+	mux.Put(Config.sitePath+"upload/:name", upload(uploadPutHandler))
+	mux.Put(Config.sitePath+"link", upload(linkPutHandler))
+	mux.Put(Config.sitePath+"link/", upload(linkPutHandler))
+	mux.Put(Config.sitePath+"link/:name", upload(linkPutHandler))
+
+	mux.Get(Config.sitePath+"collection/:id", read(collectionHandler))
+	mux.Get(Config.sitePath+"collection/:id/:format", read(collectionArchiveHandler))
+	mux.Get(Config.sitePath+"archive/:format", read(archiveHandler))
+	mux.Delete(Config.sitePath+"collection/:id", deletion(collectionDeleteHandler))
+
+	mux.Delete(Config.sitePath+":name", deletion(deleteHandler))
+	mux.Patch(Config.sitePath+":name", upload(editHandler))
+	mux.Get(Config.sitePath+":name/rev/", read(revisionListHandler))
+	mux.Get(Config.sitePath+":name/rev/:rev", read(revisionHandler))
+	mux.Get(Config.sitePath+":name/diff/:from/:to", read(revisionDiffHandler))
+	mux.Get(Config.sitePath+Config.selifPath+":name/rev/:rev", read(revisionServeHandler))
 	// Adding new delete path method to make linx-server usable with ShareX.
-	mux.Get(Config.sitePath+"delete/:name", deleteHandler)
+	mux.Get(Config.sitePath+"delete/:name", deletion(deleteHandler))
 
 	mux.Get(Config.sitePath+"static/*", staticHandler)
 	mux.Get(Config.sitePath+"favicon.ico", staticHandler)
 	mux.Get(Config.sitePath+"robots.txt", staticHandler)
-	mux.Get(nameRe, fileAccessHandler)
-	mux.Post(nameRe, fileAccessHandler)
-	mux.Get(selifRe, fileServeHandler)
+	mux.Get(nameRe, read(fileAccessHandler))
+	mux.Post(nameRe, read(fileAccessHandler))
+	mux.Get(Config.sitePath+Config.selifPath+"thumb/:name", read(thumbnailHandler))
+	mux.Get(selifRe, read(fileServeHandler))
 	mux.Get(selifIndexRe, unauthorizedHandler)
 	if Config.customPagesDir != "" {
 		initializeCustomPages(Config.customPagesDir)
 		for fileName := range customPagesNames {
-			mux.Get(Config.sitePath+fileName, makeCustomPageHandler(fileName))
-			mux.Get(Config.sitePath+fileName+"/", makeCustomPageHandler(fileName))
+			mux.Get(Config.sitePath+fileName, read(makeCustomPageHandler(fileName)))
+			mux.Get(Config.sitePath+fileName+"/", read(makeCustomPageHandler(fileName)))
 		}
 	}
 
@@ -206,6 +342,16 @@ func setup() *web.Mux {
 	return mux
 }
 
+// How often the other periodic tasks run, such as looking for expired
+// partial uploads, which is as often as expired files are cleaned up when
+// they are cleaned up periodically
+func periodicInterval() time.Duration {
+	if Config.cleanupEveryMinutes > 0 {
+		return time.Duration(Config.cleanupEveryMinutes) * time.Minute
+	}
+	return time.Hour
+}
+
 func main() {
 	flag.StringVar(&Config.bind, "bind", "127.0.0.1:8080",
 		"host to bind to (default: 127.0.0.1:8080)")
@@ -213,8 +359,32 @@ func main() {
 		"path to files directory")
 	flag.StringVar(&Config.metaDir, "metapath", "meta/",
 		"path to metadata directory")
+	flag.StringVar(&Config.metaDB, "metadb", "",
+		"path to a database to keep metadata in instead of metapath (local filesystem only)")
+	flag.BoolVar(&Config.dedup, "dedup", false,
+		"store identical uploads only once (local filesystem only)")
+	flag.BoolVar(&Config.compress, "compress", false,
+		"compress stored text uploads with zstd (local filesystem only)")
+	flag.IntVar(&Config.shardDepth, "shard-depth", 0,
+		"levels of subdirectories to spread files and metadata over, 0 for a flat layout (local filesystem only)")
+	flag.StringVar(&Config.s3Endpoint, "s3-endpoint", "",
+		"S3 endpoint")
+	flag.StringVar(&Config.s3Region, "s3-region", "",
+		"S3 region")
+	flag.StringVar(&Config.s3Bucket, "s3-bucket", "",
+		"S3 bucket to use for files and metadata")
+	flag.BoolVar(&Config.s3ForcePathStyle, "s3-force-path-style", false,
+		"Force path-style addressing for S3 (e.g. https://s3.amazonaws.com/linx/example.txt)")
+	flag.StringVar(&Config.encryptionKeyFile, "encryption-keyfile", "",
+		"path to a file of keys to encrypt stored files and metadata with")
+	flag.StringVar(&Config.tusDir, "tuspath", "",
+		"path to keep partial resumable uploads in, or empty to disable resumable uploads")
+	flag.Uint64Var(&Config.tusExpiry, "tus-expiry", 86400,
+		"time in seconds after which inactive partial resumable uploads are removed (default is 86400, which is 1 day)")
 	flag.BoolVar(&Config.basicAuth, "basicauth", false,
 		"allow logging by basic auth password")
+	flag.BoolVar(&Config.private, "private", false,
+		"require a key with the read-private scope to view files and pages, when an authfile is used")
 	flag.BoolVar(&Config.noLogs, "nologs", false,
 		"remove stdout output for each request")
 	flag.BoolVar(&Config.allowHotlink, "allowhotlink", false,
@@ -256,6 +426,38 @@ func main() {
 	flag.Int64Var(&Config.maxDurationSize, "max-duration-size", 4*1024*1024*1024, "Size of file before max-duration-time is used to determine expiry max time. (Default is 4GB)")
 	flag.BoolVar(&Config.disableAccessKey, "disable-access-key", false, "Disables access key usage. (Default is false.)")
 	flag.BoolVar(&Config.defaultRandomFilename, "default-random-filename", true, "Makes it so the random filename is not default if set false. (Default is true.)")
+	flag.BoolVar(&Config.stripMetadata, "strip-metadata", false,
+		"Strip EXIF, XMP and IPTC metadata from uploaded JPEG, PNG, WebP and HEIC images unless the upload asks to keep it")
+	flag.IntVar(&Config.thumbnailSize, "thumbnail-size", 0,
+		"largest width and height in pixels of the thumbnails of JPEG, PNG, GIF and WebP images, 0 to disable thumbnails")
+	flag.Int64Var(&Config.pasteRevisions, "paste-revisions", 0,
+		"number of earlier versions kept when a paste is overwritten with its delete key, 0 to disable revisions")
+	flag.BoolVar(&Config.linkInterstitial, "link-interstitial", false,
+		"show a page with the URL short links lead to instead of redirecting to it")
+	flag.StringVar(&Config.clamdAddress, "clamd-address", "",
+		"scan uploads for malware with the clamd listening at this unix socket path or host:port")
+	flag.Uint64Var(&Config.clamdTimeout, "clamd-timeout", 60,
+		"timeout in seconds for connecting to clamd and for each exchange with it, 0 for none")
+	flag.StringVar(&Config.scanPolicy, "scan-policy", scanPolicyReject,
+		"what to do with uploads found to be malware: reject them, quarantine them where they aren't served, or flag them in their metadata")
+	flag.StringVar(&Config.allowMimetypes, "allow-mimetypes", "",
+		"comma-separated mimetypes or globs such as video/* that uploads must have, sniffed from their contents (default allows all)")
+	flag.StringVar(&Config.denyMimetypes, "deny-mimetypes", "",
+		"comma-separated mimetypes or globs such as application/x-msdownload that uploads can't have, sniffed from their contents")
+	flag.StringVar(&Config.allowExtensions, "allow-extensions", "",
+		"comma-separated extensions that uploads must have (default allows all)")
+	flag.StringVar(&Config.denyExtensions, "deny-extensions", "",
+		"comma-separated extensions that uploads can't have")
+	flag.StringVar(&Config.mimetypeMaxSizes, "mimetype-max-sizes", "",
+		"comma-separated maximum sizes of uploads by mimetype glob, such as video/*=200MB, the first matching glob applying")
+	flag.Var(&Config.webhookURLs, "webhook-url",
+		"URL to post JSON events about files to. This option can be used multiple times.")
+	flag.StringVar(&Config.webhookSecret, "webhook-secret", "",
+		"key to sign webhook events with, as an HMAC-SHA256 in the Linx-Signature header")
+	flag.StringVar(&Config.webhookQueuePath, "webhook-queue-path", "webhook-queue/",
+		"path to keep webhook events that haven't been delivered yet in")
+	flag.StringVar(&Config.webhookEvents, "webhook-events", "upload,delete,expire,access",
+		"comma-separated events to send to webhooks")
 	iniflags.Parse()
 
 	mux := setup()
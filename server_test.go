@@ -1,19 +1,40 @@
 package main
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/andreimarcu/linx-server/auth/apikeys"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/cleanup"
+	"github.com/andreimarcu/linx-server/webhooks"
+	"github.com/zenazn/goji/web"
 )
 
 type RespOkJSON struct {
@@ -28,6 +49,13 @@ type RespErrJSON struct {
 	Error string
 }
 
+type respCollectionJSON struct {
+	Collection     string
+	Collection_Url string
+	Delete_Key     string
+	Files          []RespOkJSON
+}
+
 func TestSetup(t *testing.T) {
 	Config.siteURL = "http://linx.example.org/"
 	Config.filesDir = path.Join(os.TempDir(), generateBarename())
@@ -1280,6 +1308,2272 @@ func TestInferSiteURLHTTPS(t *testing.T) {
 	Config.certFile = oldCertFile
 }
 
+func TestPostMultipleFilesCollection(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filenames := []string{generateBarename() + ".txt", generateBarename() + ".txt"}
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	for _, filename := range filenames {
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte("File content of " + filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	var created respCollectionJSON
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Collection == "" || created.Delete_Key == "" {
+		t.Fatalf("Missing collection or delete key in %s", w.Body.String())
+	}
+	if created.Collection_Url != Config.siteURL+"collection/"+created.Collection {
+		t.Fatalf("Unexpected collection url %s", created.Collection_Url)
+	}
+	if len(created.Files) != 2 {
+		t.Fatalf("Expected 2 files, got %d", len(created.Files))
+	}
+	for i, file := range created.Files {
+		if file.Filename != filenames[i] {
+			t.Fatalf("Expected file %s, got %s", filenames[i], file.Filename)
+		}
+		if file.Delete_Key != created.Delete_Key {
+			t.Fatalf("File %s does not share the collection's delete key", file.Filename)
+		}
+	}
+
+	// The collection lists both files
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/collection/"+created.Collection, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var listed respCollectionJSON
+	err = json.Unmarshal(w.Body.Bytes(), &listed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed.Files) != 2 || listed.Files[0].Filename != filenames[0] || listed.Files[1].Filename != filenames[1] {
+		t.Fatalf("Collection does not list the uploaded files: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/collection/"+created.Collection, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 || !strings.Contains(w.Body.String(), filenames[1]) {
+		t.Fatalf("Collection page did not render the files, got %d", w.Code)
+	}
+}
+
+func TestPutToCollection(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	req, err := http.NewRequest("PUT", "/upload/"+generateBarename()+".txt", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Collection", "new")
+	req.Header.Set("Linx-Delete-Key", "collectionkey")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	var first map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collection := first["collection"]
+	if collection == "" {
+		t.Fatalf("No collection was created: %s", w.Body.String())
+	}
+
+	// Adding to the collection requires its delete key
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/upload/"+generateBarename()+".txt", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Collection", collection)
+	req.Header.Set("Linx-Delete-Key", "wrongkey")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("PUT", "/upload/"+generateBarename()+".txt", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Collection", collection)
+	req.Header.Set("Linx-Delete-Key", "collectionkey")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	var second map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deleting the collection deletes its files
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/collection/"+collection, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Delete-Key", "wrongkey")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 401 {
+		t.Fatalf("Status code is not 401, but %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req.Header.Set("Linx-Delete-Key", "collectionkey")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	for _, filename := range []string{first["filename"], second["filename"]} {
+		w = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/"+filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 404 {
+			t.Fatalf("File %s was not deleted with its collection", filename)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/collection/"+collection, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+}
+
+func TestArchiveDownload(t *testing.T) {
+	mux := setup()
+
+	contents := map[string]string{
+		generateBarename() + ".txt": "First file content",
+		generateBarename() + ".txt": "Second file content",
+	}
+	var filenames []string
+	for filename, content := range contents {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(filenames) == 0 {
+			req.Header.Set("Linx-Access-Key", "archivekey")
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d", w.Code)
+		}
+		filenames = append(filenames, filename)
+	}
+
+	archiveURL := "/archive/zip?file=" + filenames[0] + "&file=" + filenames[1]
+
+	// The whole archive is refused without the access key of a file in it
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", archiveURL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 401 {
+		t.Fatalf("Status code is not 401, but %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", archiveURL+"&access_key=archivekey", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Unexpected content type %s", w.Header().Get("Content-Type"))
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 {
+		t.Fatalf("Expected 2 files in the zip, got %d", len(zr.File))
+	}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != contents[f.Name] {
+			t.Fatalf("Unexpected content %q for %s", content, f.Name)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/archive/rar?file="+filenames[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/archive/zip?file=doesnotexist.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+}
+
+func TestCollectionArchiveDownload(t *testing.T) {
+	mux := setup()
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	contents := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		filename := generateBarename() + ".txt"
+		contents[filename] = "File content of " + filename
+		fw, err := mw.CreateFormFile("file", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = fw.Write([]byte(contents[filename]))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	mw.Close()
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+	mux.ServeHTTP(w, req)
+
+	var created respCollectionJSON
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/collection/"+created.Collection+"/tar.gz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if !strings.Contains(w.Header().Get("Content-Disposition"), created.Collection+".tar.gz") {
+		t.Fatalf("Unexpected disposition %s", w.Header().Get("Content-Disposition"))
+	}
+
+	gr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	found := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != contents[header.Name] {
+			t.Fatalf("Unexpected content %q for %s", content, header.Name)
+		}
+		found++
+	}
+	if found != 2 {
+		t.Fatalf("Expected 2 files in the tarball, got %d", found)
+	}
+}
+
+func TestMaxDownloads(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	filename := generateBarename() + ".txt"
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Max-Downloads", "2")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myjson["max_downloads"] != "2" {
+		t.Fatalf("Unexpected max_downloads %q", myjson["max_downloads"])
+	}
+
+	for i, expected := range []int{200, 200, 404} {
+		w = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/"+Config.selifPath+filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Code != expected {
+			t.Fatalf("Download %d: status code is not %d, but %d", i+1, expected, w.Code)
+		}
+		if w.Code == 200 && w.Body.String() != "File content" {
+			t.Fatalf("Download %d: unexpected content %q", i+1, w.Body.String())
+		}
+	}
+}
+
+func TestBurnAfterReadingPaste(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	form := url.Values{}
+	form.Add("content", "my one-time password")
+	form.Add("extension", "txt")
+	form.Add("burn", "on")
+	req, err := http.NewRequest("POST", "/upload/", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", Config.siteURL)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 303 {
+		t.Fatalf("Status code is not 303, but %d", w.Code)
+	}
+	location := w.Header().Get("Location")
+
+	// Fetching the page, as link previews do, only shows the confirmation
+	for i := 0; i < 2; i++ {
+		w = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", location, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Previewbot)")
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 200 || strings.Contains(w.Body.String(), "my one-time password") {
+			t.Fatalf("The paste was shown without confirmation")
+		}
+	}
+
+	confirm := url.Values{}
+	confirm.Add("download", "yes")
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("POST", location, strings.NewReader(confirm.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", Config.siteURL)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 || w.Body.String() != "my one-time password" {
+		t.Fatalf("The paste was not served after confirmation: %d %q", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", location, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+}
+
+func TestOriginalFilename(t *testing.T) {
+	mux := setup()
+	w := httptest.NewRecorder()
+
+	original := "Quarterly Report (final) – Zürich.pdf"
+
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	fw, err := mw.CreateFormFile("file", original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = fw.Write([]byte("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw.Close()
+
+	req, err := http.NewRequest("POST", "/upload/", &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myjson["original_name"] != original {
+		t.Fatalf("Original name %q was not kept, got %q", original, myjson["original_name"])
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson["filename"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	disposition, params, err := mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disposition != "inline" || params["filename"] != original {
+		t.Fatalf("Unexpected Content-Disposition %s", w.Header().Get("Content-Disposition"))
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson["filename"]+"?download=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	disposition, params, err = mime.ParseMediaType(w.Header().Get("Content-Disposition"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disposition != "attachment" || params["filename"] != original {
+		t.Fatalf("Unexpected Content-Disposition %s", w.Header().Get("Content-Disposition"))
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+myjson["filename"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	mux.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "Zürich.pdf") {
+		t.Fatalf("Original name is not shown on the display page")
+	}
+}
+
+func TestCleanOriginalName(t *testing.T) {
+	names := map[string]string{
+		"report.pdf":             "report.pdf",
+		"  spaced name.txt ":     "spaced name.txt",
+		`C:\fakepath\photo.jpg`:  "photo.jpg",
+		"some/dir/notes.md":      "notes.md",
+		"tab\there.txt":          "tabhere.txt",
+		"\xff\xfebroken.txt":     "broken.txt",
+		strings.Repeat("é", 200): strings.Repeat("é", 127),
+	}
+
+	for name, expected := range names {
+		if cleaned := cleanOriginalName(name); cleaned != expected {
+			t.Fatalf("Cleaned %q to %q instead of %q", name, cleaned, expected)
+		}
+	}
+}
+
+func TestStripMetadataUpload(t *testing.T) {
+	Config.stripMetadata = true
+	defer func() { Config.stripMetadata = false }()
+	mux := setup()
+
+	// A minimal JPEG with an EXIF segment before its image data
+	exif := []byte("Exif\x00\x00MM\x00\x2a\x00\x00\x00\x08\x00\x00\x00\x00\x00\x00GPS-SECRET")
+	image := []byte{0xff, 0xd8, 0xff, 0xe1, 0x00, byte(len(exif) + 2)}
+	image = append(image, exif...)
+	image = append(image, 0xff, 0xda, 0x00, 0x02, 0x01, 0x02, 0x03, 0xff, 0xd9)
+	stripped := []byte{0xff, 0xd8, 0xff, 0xda, 0x00, 0x02, 0x01, 0x02, 0x03, 0xff, 0xd9}
+
+	for _, keep := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/"+generateBarename()+".jpg", bytes.NewReader(image))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if keep {
+			req.Header.Set("Linx-Keep-Metadata", "yes")
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d", w.Code)
+		}
+
+		var myjson map[string]string
+		err = json.Unmarshal(w.Body.Bytes(), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := stripped
+		if keep {
+			expected = image
+		}
+		if myjson["size"] != strconv.Itoa(len(expected)) || myjson["sha256sum"] != fmt.Sprintf("%x", sha256.Sum256(expected)) {
+			t.Fatalf("Metadata does not describe the stored file: %v", myjson)
+		}
+
+		w = httptest.NewRecorder()
+		req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson["filename"], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+
+		if !bytes.Equal(w.Body.Bytes(), expected) {
+			t.Fatalf("Stored image is not the expected one when keeping metadata is %v", keep)
+		}
+	}
+}
+
+func TestThumbnail(t *testing.T) {
+	Config.thumbnailSize = 8
+	defer func() { Config.thumbnailSize = 0 }()
+	mux := setup()
+
+	var original bytes.Buffer
+	err := png.Encode(&original, image.NewRGBA(image.Rect(0, 0, 32, 16)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := generateBarename() + ".png"
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/upload/"+filename, bytes.NewReader(original.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Delete-Key", "supersecret")
+	req.Header.Set("Linx-Access-Key", "letmein")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	// The thumbnail needs the access key of the image
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+"thumb/"+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 401 {
+		t.Fatalf("Status code is not 401, but %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req.Header.Set("Linx-Access-Key", "letmein")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("Thumbnail has mimetype %s", w.Header().Get("Content-Type"))
+	}
+
+	thumbnail, err := png.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thumbnail.Bounds().Dx() != 8 || thumbnail.Bounds().Dy() != 4 {
+		t.Fatalf("Thumbnail is %v instead of 8x4", thumbnail.Bounds())
+	}
+
+	// The stored thumbnail can't be reached as a file
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+thumbnailKey(filename), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/"+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Delete-Key", "supersecret")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	exists, err := storageBackend.Exists(thumbnailKey(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("Thumbnail was not deleted along with the image")
+	}
+}
+
+func TestThumbnailNotAnImage(t *testing.T) {
+	Config.thumbnailSize = 8
+	defer func() { Config.thumbnailSize = 0 }()
+	mux := setup()
+
+	filename := generateBarename() + ".txt"
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+Config.selifPath+"thumb/"+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+}
+
+func TestOrientImage(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 1))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+	img.Set(1, 0, color.RGBA{0, 0, 255, 255})
+
+	// Turning it clockwise puts the left pixel on top
+	turned := orientImage(img, 6)
+	if turned.Bounds().Dx() != 1 || turned.Bounds().Dy() != 2 {
+		t.Fatalf("Turned image is %v instead of 1x2", turned.Bounds())
+	}
+	if turned.RGBAAt(0, 0) != (color.RGBA{255, 0, 0, 255}) || turned.RGBAAt(0, 1) != (color.RGBA{0, 0, 255, 255}) {
+		t.Fatalf("Turned image has the wrong pixels")
+	}
+
+	if orientImage(img, 1) != img {
+		t.Fatalf("Image was changed without an orientation")
+	}
+}
+
+// Listen like clamd, finding malware in files that contain EICAR
+func startFakeClamd(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				command := make([]byte, len("zINSTREAM\x00"))
+				_, err := io.ReadFull(conn, command)
+				if err != nil {
+					return
+				}
+
+				var file []byte
+				for {
+					var length uint32
+					err = binary.Read(conn, binary.BigEndian, &length)
+					if err != nil {
+						return
+					}
+					if length == 0 {
+						break
+					}
+					chunk := make([]byte, length)
+					_, err = io.ReadFull(conn, chunk)
+					if err != nil {
+						return
+					}
+					file = append(file, chunk...)
+				}
+
+				if bytes.Contains(file, []byte("EICAR")) {
+					conn.Write([]byte("stream: Eicar-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func scanTestUpload(t *testing.T, mux *web.Mux, filename, content string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestScanReject(t *testing.T) {
+	Config.clamdAddress = startFakeClamd(t)
+	Config.scanPolicy = scanPolicyReject
+	defer func() { Config.clamdAddress = "" }()
+	mux := setup()
+
+	filename := generateBarename() + ".txt"
+	w := scanTestUpload(t, mux, filename, "Clean content")
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myjson["size"] != "13" || myjson["malware"] != "" {
+		t.Fatalf("Clean upload was not stored as is: %v", myjson)
+	}
+
+	filename = generateBarename() + ".txt"
+	w = scanTestUpload(t, mux, filename, "Infected EICAR content")
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+
+	for _, key := range []string{filename, quarantineKey(filename)} {
+		exists, err := storageBackend.Exists(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exists {
+			t.Fatalf("Rejected upload was stored as %s", key)
+		}
+	}
+}
+
+func TestScanQuarantine(t *testing.T) {
+	Config.clamdAddress = startFakeClamd(t)
+	Config.scanPolicy = scanPolicyQuarantine
+	defer func() { Config.clamdAddress = "" }()
+	mux := setup()
+
+	filename := generateBarename() + ".txt"
+	w := scanTestUpload(t, mux, filename, "Infected EICAR content")
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+
+	exists, err := storageBackend.Exists(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("Quarantined upload was stored as a file")
+	}
+
+	metadata, err := storageBackend.Head(quarantineKey(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Malware != "Eicar-Signature" {
+		t.Fatalf("Quarantined upload has malware %q", metadata.Malware)
+	}
+
+	for _, path := range []string{"/", "/" + Config.selifPath} {
+		w = httptest.NewRecorder()
+		req, err := http.NewRequest("GET", path+quarantineKey(filename), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 404 {
+			t.Fatalf("Status code of %s is not 404, but %d", path, w.Code)
+		}
+	}
+}
+
+func TestScanFlag(t *testing.T) {
+	Config.clamdAddress = startFakeClamd(t)
+	Config.scanPolicy = scanPolicyFlag
+	defer func() { Config.clamdAddress = "" }()
+	mux := setup()
+
+	filename := generateBarename() + ".txt"
+	w := scanTestUpload(t, mux, filename, "Infected EICAR content")
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+
+	var myjson map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myjson["malware"] != "Eicar-Signature" {
+		t.Fatalf("Flagged upload has malware %q", myjson["malware"])
+	}
+
+	w = httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/"+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if !strings.Contains(w.Body.String(), "Eicar-Signature") {
+		t.Fatalf("Display page does not warn about the malware")
+	}
+}
+
+func TestScanFailure(t *testing.T) {
+	// Nothing listens on a closed listener's address
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.clamdAddress = listener.Addr().String()
+	listener.Close()
+	defer func() { Config.clamdAddress = "" }()
+	mux := setup()
+
+	filename := generateBarename() + ".txt"
+	w := scanTestUpload(t, mux, filename, "Unscanned content")
+	if w.Code != 500 {
+		t.Fatalf("Status code is not 500, but %d", w.Code)
+	}
+
+	exists, err := storageBackend.Exists(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exists {
+		t.Fatalf("Unscanned upload was stored")
+	}
+}
+
+func TestTypePolicy(t *testing.T) {
+	p, err := parseTypePolicy("image/*, text/plain", "image/svg+xml", "", ".exe, gz", "video/*=200MB, image/*=2MiB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := map[[2]string]bool{
+		{"image/png", "png"}:                    true,
+		{"text/plain; charset=utf-8", "txt"}:    true,
+		{"image/svg+xml", "svg"}:                false,
+		{"application/zip", "zip"}:              false,
+		{"image/png", "exe"}:                    false,
+		{"text/plain; charset=utf-8", "tar.gz"}: false,
+	}
+	for upload, ok := range allowed {
+		err := p.check(upload[0], upload[1])
+		if ok && err != nil {
+			t.Fatalf("%v was not allowed", upload)
+		} else if !ok && err != errTypeNotAllowed {
+			t.Fatalf("%v was allowed", upload)
+		}
+	}
+
+	if p.maxSize("video/mp4") != 200*1000*1000 || p.maxSize("image/png") != 2*1024*1024 || p.maxSize("text/plain") != 0 {
+		t.Fatalf("Unexpected maximum sizes %v", p.maxSizes)
+	}
+
+	for _, bad := range [][]string{{"[", ""}, {"", "video/*"}, {"", "video/*=lots"}, {"", "=200MB"}, {"", " ,=1MB"}} {
+		_, err := parseTypePolicy(bad[0], "", "", "", bad[1])
+		if err == nil {
+			t.Fatalf("Bad policy %v was parsed", bad)
+		}
+	}
+}
+
+func TestUploadTypePolicy(t *testing.T) {
+	Config.denyMimetypes = "image/gif"
+	Config.allowExtensions = "png,gif,txt"
+	Config.mimetypeMaxSizes = "image/*=1KB"
+	defer func() {
+		Config.denyMimetypes = ""
+		Config.allowExtensions = ""
+		Config.mimetypeMaxSizes = ""
+	}()
+	mux := setup()
+
+	var small, large bytes.Buffer
+	err := png.Encode(&small, image.NewRGBA(image.Rect(0, 0, 1, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i := range img.Pix {
+		img.Pix[i] = byte(i * 7919 % 251)
+	}
+	err = png.Encode(&large, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gif := []byte("GIF89a\x01\x00\x01\x00\x00\x00\x00;")
+
+	uploads := []struct {
+		filename string
+		content  []byte
+		code     int
+	}{
+		{"small.png", small.Bytes(), 200},
+		// Types are sniffed from the contents rather than the filename
+		{"animation.txt", gif, 400},
+		{"large.png", large.Bytes(), 400},
+		{"small.jpg", small.Bytes(), 400},
+		{"notes.txt", []byte("Some notes"), 200},
+	}
+
+	for _, upload := range uploads {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/"+upload.filename, bytes.NewReader(upload.content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Linx-Randomize", "yes")
+		mux.ServeHTTP(w, req)
+
+		if w.Code != upload.code {
+			t.Fatalf("Status code of %s is not %d, but %d", upload.filename, upload.code, w.Code)
+		}
+	}
+}
+
+func TestWebhooks(t *testing.T) {
+	events := make(chan webhooks.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(webhooks.SignatureHeader) != webhooks.Sign("secret", body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var e webhooks.Event
+		json.Unmarshal(body, &e)
+		events <- e
+	}))
+	defer receiver.Close()
+
+	Config.webhookURLs = headerList{receiver.URL}
+	Config.webhookSecret = "secret"
+	Config.webhookQueuePath = path.Join(Config.filesDir, "webhooks")
+	Config.webhookEvents = "upload,delete,expire,access"
+	defer func() {
+		Config.webhookURLs = nil
+		setupWebhooks()
+	}()
+	mux := setup()
+
+	expectEvent := func(event, filename string) webhooks.Event {
+		select {
+		case e := <-events:
+			if e.Event != event || e.Filename != filename {
+				t.Fatalf("Received %s event for %s instead of %s event for %s", e.Event, e.Filename, event, filename)
+			}
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s event was received for %s", event, filename)
+		}
+		return webhooks.Event{}
+	}
+
+	filenames := []string{generateBarename() + ".txt", generateBarename() + ".txt", generateBarename() + ".txt"}
+	for _, filename := range filenames {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/"+filename, strings.NewReader("File content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Linx-Delete-Key", "supersecret")
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d", w.Code)
+		}
+		expectEvent("upload", filename)
+	}
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/"+Config.selifPath+filenames[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+	expectEvent("access", filenames[0])
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("DELETE", "/"+filenames[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Delete-Key", "supersecret")
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	expectEvent("delete", filenames[0])
+
+	// Files that expired are deleted when they are next requested
+	metadata, err := storageBackend.Head(filenames[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Expiry = time.Now().Add(-time.Minute)
+	err = storageBackend.PutMetadata(filenames[1], metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = httptest.NewRecorder()
+	req, err = http.NewRequest("GET", "/"+filenames[1], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 404 {
+		t.Fatalf("Status code is not 404, but %d", w.Code)
+	}
+	expectEvent("expire", filenames[1])
+
+	// and by the periodic cleanup, with their metadata as well
+	metadata, err = storageBackend.Head(filenames[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata.Expiry = time.Now().Add(-time.Minute)
+	err = storageBackend.PutMetadata(filenames[2], metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanup.Cleanup(storageBackend.(backends.MetaStorageBackend), true, func(filename string, metadata backends.Metadata) {
+		if filename == filenames[2] {
+			cleanedUp(filename, metadata)
+		}
+	})
+	e := expectEvent("expire", filenames[2])
+	if e.Size != int64(len("File content")) || e.Mimetype != "text/plain; charset=utf-8" || e.Expiry != metadata.Expiry.Unix() {
+		t.Fatalf("Unexpected expire event %+v", e)
+	}
+}
+
+func TestUploadExpirySyntax(t *testing.T) {
+	oldMaxExpiry := Config.maxExpiry
+	Config.maxExpiry = 7 * 24 * 60 * 60
+	defer func() { Config.maxExpiry = oldMaxExpiry }()
+	mux := setup()
+
+	uploads := []struct {
+		expiry   string
+		code     int
+		duration time.Duration
+	}{
+		{"2h", 200, 2 * time.Hour},
+		{"1d12h", 200, 36 * time.Hour},
+		{time.Now().Add(3 * time.Hour).UTC().Format(time.RFC3339), 200, 3 * time.Hour},
+		// Expiries longer than the maximum one are shortened to it
+		{"2w", 200, 7 * 24 * time.Hour},
+		{"never", 200, 7 * 24 * time.Hour},
+		{"tomorrow", 400, 0},
+		{"2020-01-02T15:04:05Z", 400, 0},
+	}
+
+	for _, upload := range uploads {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/expiry.txt", strings.NewReader("File content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Linx-Randomize", "yes")
+		req.Header.Set("Linx-Expiry", upload.expiry)
+		mux.ServeHTTP(w, req)
+
+		if w.Code != upload.code {
+			t.Fatalf("Status code with expiry %s is not %d, but %d", upload.expiry, upload.code, w.Code)
+		} else if w.Code != 200 {
+			continue
+		}
+
+		var myjson RespOkJSON
+		err = json.Unmarshal(w.Body.Bytes(), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		myExp, err := strconv.ParseInt(myjson.Expiry, 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := time.Now().Add(upload.duration).Unix()
+		if myExp < expected-5 || myExp > expected+5 {
+			t.Fatalf("Expiry of %s is %d, expected about %d", upload.expiry, myExp, expected)
+		}
+	}
+
+	// The expires field of forms takes the same syntax
+	w := httptest.NewRecorder()
+	form := url.Values{}
+	form.Add("content", "File content")
+	form.Add("expires", "1 hour")
+	req, err := http.NewRequest("POST", "/upload/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.PostForm = form
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Referer", Config.siteURL)
+	req.Header.Set("Origin", strings.TrimSuffix(Config.siteURL, "/"))
+	mux.ServeHTTP(w, req)
+
+	if w.Code != 400 {
+		t.Fatalf("Status code is not 400, but %d", w.Code)
+	}
+}
+
+func TestAPIKeyLimits(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "authfile")
+	err := os.WriteFile(authFile, []byte("# Limited key\n"+
+		"vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM= label=bot maxsize=20B maxexpiry=1h mimetypes=text/* random=true quota=30B\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.authFile = authFile
+	defer func() { Config.authFile = "" }()
+	mux := setup()
+
+	request := func(method, filename, content string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "/"+filename, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Linx-Api-Key", "haPVipRnGJ0QovA9nyqK")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("PUT", "upload/limited.txt", "File content", map[string]string{"Linx-Expiry": "never"})
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var first RespOkJSON
+	err = json.Unmarshal(w.Body.Bytes(), &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Filename == "limited.txt" {
+		t.Fatal("Filename was not randomized")
+	}
+	myExp, err := strconv.ParseInt(first.Expiry, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := time.Now().Add(time.Hour).Unix(); myExp < expected-5 || myExp > expected+5 {
+		t.Fatalf("Expiry is %d, expected about %d", myExp, expected)
+	}
+	metadata, err := storageBackend.Head(first.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Uploader != "bot" {
+		t.Fatalf("Uploader is %q, expected bot", metadata.Uploader)
+	}
+
+	w = request("PUT", "upload/image.png", "\x89PNG\r\n\x1a\n", nil)
+	if w.Code != 400 {
+		t.Fatalf("Status code of image is not 400, but %d", w.Code)
+	}
+	w = request("PUT", "upload/large.txt", strings.Repeat("a", 21), nil)
+	if w.Code != 400 {
+		t.Fatalf("Status code of large file is not 400, but %d", w.Code)
+	}
+
+	// The quota of 30 bytes fits two files of 12 bytes
+	w = request("PUT", "upload/second.txt", "File content", nil)
+	if w.Code != 200 {
+		t.Fatalf("Status code of second file is not 200, but %d", w.Code)
+	}
+	w = request("PUT", "upload/third.txt", "File content", nil)
+	if w.Code != 400 || !strings.Contains(w.Body.String(), errQuotaExceeded.Error()) {
+		t.Fatalf("Status code of third file is not 400, but %d", w.Code)
+	}
+
+	// Deleting a file frees its storage
+	w = request("DELETE", first.Filename, "", map[string]string{"Linx-Delete-Key": first.Delete_Key})
+	if w.Code != 200 {
+		t.Fatalf("Status code of deletion is not 200, but %d", w.Code)
+	}
+	w = request("PUT", "upload/third.txt", "File content", nil)
+	if w.Code != 200 {
+		t.Fatalf("Status code of third file after deletion is not 200, but %d", w.Code)
+	}
+}
+
+func TestEditMetadata(t *testing.T) {
+	oldMaxDurationSize := Config.maxDurationSize
+	Config.maxDurationSize = 4294967296
+	defer func() { Config.maxDurationSize = oldMaxDurationSize }()
+	mux := setup()
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PUT", "/upload/", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Linx-Delete-Key", "editkey")
+	req.Header.Set("Linx-Expiry", "1h")
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	var myjson RespOkJSON
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edit := func(filename, deleteKey, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PATCH", "/"+filename, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Linx-Delete-Key", deleteKey)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w = edit(myjson.Filename, "wrongkey", `{"access_key":"secret"}`)
+	if w.Code != 401 {
+		t.Fatalf("Status code with wrong delete key is not 401, but %d", w.Code)
+	}
+	w = edit("doesnotexist.txt", "editkey", `{"access_key":"secret"}`)
+	if w.Code != 404 {
+		t.Fatalf("Status code of missing file is not 404, but %d", w.Code)
+	}
+
+	invalid := []string{
+		`{"expiry":"tomorrow"}`,
+		`{"max_downloads":"-1"}`,
+		`{"filename":"other.txt"}`,
+		`not json`,
+	}
+	for _, body := range invalid {
+		w = edit(myjson.Filename, "editkey", body)
+		if w.Code != 400 {
+			t.Fatalf("Status code of %s is not 400, but %d", body, w.Code)
+		}
+	}
+
+	w = edit(myjson.Filename, "editkey", `{"expiry":"3d","access_key":"secret","original_name":"notes/Report.txt","max_downloads":"5"}`)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var edited map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := time.Now().Add(3 * 24 * time.Hour).Unix()
+	if exp, _ := strconv.ParseInt(edited["expiry"], 10, 64); exp < expected-5 || exp > expected+5 {
+		t.Fatalf("Expiry is %s, expected about %d", edited["expiry"], expected)
+	}
+	if edited["access_key"] != "secret" || edited["original_name"] != "Report.txt" || edited["max_downloads"] != "5" {
+		t.Fatalf("Unexpected response %v", edited)
+	}
+
+	metadata, err := storageBackend.Head(myjson.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.AccessKey != "secret" || metadata.OriginalName != "Report.txt" || metadata.MaxDownloads != 5 ||
+		strconv.FormatInt(metadata.Expiry.Unix(), 10) != edited["expiry"] {
+		t.Fatalf("Metadata was not updated: %+v", metadata)
+	}
+
+	// Fields left out are kept, and empty ones removed
+	w = edit(myjson.Filename, "editkey", `{"access_key":"","max_downloads":"0"}`)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	metadata, err = storageBackend.Head(myjson.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.AccessKey != "" || metadata.MaxDownloads != 0 || metadata.OriginalName != "Report.txt" {
+		t.Fatalf("Metadata was not updated: %+v", metadata)
+	}
+}
+
+func TestPasteRevisions(t *testing.T) {
+	oldRevisions := Config.pasteRevisions
+	Config.pasteRevisions = 2
+	defer func() { Config.pasteRevisions = oldRevisions }()
+	mux := setup()
+
+	put := func(content string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/upload/revisions.txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Linx-Delete-Key", "revkey")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+		}
+		return w
+	}
+	get := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	put("first\nshared\n")
+	put("second\nshared\n")
+	put("third\nshared\n")
+	put("fourth\nshared\n")
+
+	metadata, err := storageBackend.Head("revisions.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Revision != 4 {
+		t.Fatalf("Revision is %d, expected 4", metadata.Revision)
+	}
+
+	w := get("/" + Config.selifPath + "revisions.txt/rev/2")
+	if w.Code != 200 || w.Body.String() != "second\nshared\n" {
+		t.Fatalf("Unexpected revision 2: %d %q", w.Code, w.Body.String())
+	}
+	w = get("/" + Config.selifPath + "revisions.txt/rev/4")
+	if w.Code != 200 || w.Body.String() != "fourth\nshared\n" {
+		t.Fatalf("Unexpected revision 4: %d %q", w.Code, w.Body.String())
+	}
+
+	// Only the last 2 earlier versions are kept
+	for _, path := range []string{"revisions.txt/rev/1", "revisions.txt/rev/5", "revisions.txt/rev/x", revisionKey("revisions.txt", 4)} {
+		w = get("/" + Config.selifPath + path)
+		if w.Code != 404 {
+			t.Fatalf("Status code of %s is not 404, but %d", path, w.Code)
+		}
+	}
+
+	w = get("/revisions.txt/rev/")
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	var list struct {
+		Revisions []map[string]string `json:"revisions"`
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list.Revisions) != 3 || list.Revisions[0]["revision"] != "4" || list.Revisions[2]["revision"] != "2" {
+		t.Fatalf("Unexpected revisions %v", list.Revisions)
+	}
+
+	req, err := http.NewRequest("GET", "/revisions.txt/rev/2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "revision 2 of 4") {
+		t.Fatalf("Unexpected revision page: %d %s", w.Code, w.Body.String())
+	}
+
+	req, err = http.NewRequest("GET", "/revisions.txt/diff/3/4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), `<span class="diff-delete">-third</span>`) ||
+		!strings.Contains(w.Body.String(), `<span class="diff-insert">+fourth</span>`) {
+		t.Fatalf("Diff is missing changes: %s", w.Body.String())
+	}
+
+	req, err = http.NewRequest("DELETE", "/revisions.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Delete-Key", "revkey")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d", w.Code)
+	}
+	if _, err := storageBackend.Head(revisionKey("revisions.txt", 2)); err == nil {
+		t.Fatal("Revision was not deleted with the paste")
+	}
+}
+
+func TestShortLinks(t *testing.T) {
+	mux := setup()
+
+	putLink := func(name, target string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/link/"+name, strings.NewReader(target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+	visit := func(method, path, userAgent string) *httptest.ResponseRecorder {
+		var body io.Reader
+		if method == "POST" {
+			body = strings.NewReader("download=yes")
+		}
+		req, err := http.NewRequest(method, path, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if method == "POST" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		req.Header.Set("User-Agent", userAgent)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, target := range []string{"", "ftp://example.com/file", "example.com", "https://", "https://example.com/" + strings.Repeat("a", maxLinkLength)} {
+		w := putLink("", target, nil)
+		if w.Code != 400 {
+			t.Fatalf("Status code of link to %.40q is not 400, but %d", target, w.Code)
+		}
+	}
+	customPages["About"] = "About this site"
+	defer delete(customPages, "About")
+	for _, name := range []string{"paste", "auth", "about"} {
+		w := putLink(name, "https://example.com/", nil)
+		if w.Code == 200 {
+			t.Fatalf("Link took the name of page %s", name)
+		}
+	}
+
+	target := "https://example.com/a/long/page?q=1"
+	w := putLink("mylink.txt", " "+target+"\n", nil)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var link map[string]string
+	err := json.Unmarshal(w.Body.Bytes(), &link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link["filename"] != "mylink" || link["mimetype"] != linkMimetype || link["original_name"] != "" {
+		t.Fatalf("Unexpected link %v", link)
+	}
+
+	for _, userAgent := range []string{"Mozilla/5.0", "curl/7.68.0"} {
+		w = visit("GET", "/mylink", userAgent)
+		if w.Code != 302 || w.Header().Get("Location") != target {
+			t.Fatalf("Link did not redirect %s: %d %q", userAgent, w.Code, w.Header().Get("Location"))
+		}
+	}
+	w = visit("GET", "/"+Config.selifPath+"mylink", "Mozilla/5.0")
+	if w.Code != 200 || w.Body.String() != target {
+		t.Fatalf("Unexpected direct link: %d %q", w.Code, w.Body.String())
+	}
+
+	Config.linkInterstitial = true
+	defer func() { Config.linkInterstitial = false }()
+	w = visit("GET", "/mylink", "Mozilla/5.0")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "https://example.com/a/long/page?q=1") {
+		t.Fatalf("Interstitial page was not shown: %d %s", w.Code, w.Body.String())
+	}
+	w = visit("POST", "/mylink", "Mozilla/5.0")
+	if w.Code != 303 || w.Header().Get("Location") != target {
+		t.Fatalf("Link did not redirect from its page: %d %q", w.Code, w.Header().Get("Location"))
+	}
+
+	w = putLink("", target, map[string]string{"Linx-Max-Downloads": "1"})
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var myjson RespOkJSON
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = visit("GET", "/"+myjson.Filename, "curl/7.68.0")
+	if w.Code != 200 || strings.Contains(w.Body.String(), "example.com") {
+		t.Fatalf("Link that can be followed once was not confirmed: %d %s", w.Code, w.Body.String())
+	}
+	w = visit("POST", "/"+myjson.Filename, "Mozilla/5.0")
+	if w.Code != 303 || w.Header().Get("Location") != target {
+		t.Fatalf("Link did not redirect: %d %q", w.Code, w.Header().Get("Location"))
+	}
+	w = visit("GET", "/"+myjson.Filename, "Mozilla/5.0")
+	if w.Code != 404 {
+		t.Fatalf("Link followed once was not deleted: %d", w.Code)
+	}
+}
+
+func TestEncryptedPaste(t *testing.T) {
+	mux := setup()
+
+	block, err := aes.NewCipher(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	paste := base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte("secret paste"), nil))
+
+	upload := func(content string, headers map[string]string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/upload/secret.go", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Linx-Encrypted", "yes")
+		req.Header.Set("Linx-Randomize", "yes")
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, content := range []string{"secret paste", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		w := upload(content, nil)
+		if w.Code != 400 {
+			t.Fatalf("Status code of %q is not 400, but %d", content, w.Code)
+		}
+	}
+
+	w := upload(paste+"\n", nil)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var myjson map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if myjson["mimetype"] != encryptedPasteMimetype || path.Ext(myjson["filename"]) != ".go" {
+		t.Fatalf("Unexpected encrypted paste %v", myjson)
+	}
+
+	req, err := http.NewRequest("GET", "/"+myjson["filename"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `data-ciphertext="`+paste+`"`) {
+		t.Fatalf("Encrypted paste was not displayed: %d %s", w.Code, w.Body.String())
+	}
+	if !strings.Contains(w.Header().Get("Content-Security-Policy"), "script-src 'self'") {
+		t.Fatalf("Encrypted paste can't be decrypted with policy %q", w.Header().Get("Content-Security-Policy"))
+	}
+
+	req, err = http.NewRequest("GET", "/"+myjson["filename"]+"/rev/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 404 {
+		t.Fatalf("Encrypted paste has revisions: %d", w.Code)
+	}
+
+	// Pastes read once are read on their page
+	w = upload(paste, map[string]string{"Linx-Max-Downloads": "1"})
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = http.NewRequest("POST", "/"+myjson["filename"], strings.NewReader("download=yes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `data-ciphertext="`+paste+`"`) {
+		t.Fatalf("Encrypted paste was not displayed: %d %s", w.Code, w.Body.String())
+	}
+	if _, err := storageBackend.Head(myjson["filename"]); err == nil {
+		t.Fatal("Encrypted paste read once was not deleted")
+	}
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "authfile")
+	err := os.WriteFile(authFile, []byte(
+		"vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM= scopes=upload\n"+
+			"YPoh0PwjpcvkafL9rgjFneFMx7Hd2zJA+44DdceVZUw= scopes=read-private\n"+
+			"BhuzO5g2hq46LRQT0cyDWYke6t7nmrfJ4oV1xbtxa0k= scopes=admin\n"+
+			"oIT23sn4PiDiDTNwAeYt3f4dO4vt2YwebRg36rk8e8s= scopes=delete-any\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.authFile = authFile
+	Config.private = true
+	defer func() {
+		Config.authFile = ""
+		Config.private = false
+	}()
+	mux := setup()
+
+	const (
+		uploaderKey = "haPVipRnGJ0QovA9nyqK"
+		readerKey   = "reader-key"
+		adminKey    = "admin-key"
+		deleterKey  = "deleter-key"
+	)
+	request := func(method, path, apiKey, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if apiKey != "" {
+			req.Header.Set("Linx-Api-Key", apiKey)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("PUT", "/upload/scoped.txt", uploaderKey, "File content")
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var myjson RespOkJSON
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if w := request("PUT", "/upload/", readerKey, "File content"); w.Code != 403 {
+		t.Fatalf("Status code of upload with a read-only key is not 403, but %d", w.Code)
+	}
+
+	// The instance is private
+	if w := request("GET", "/"+myjson.Filename, "", ""); w.Code != 401 {
+		t.Fatalf("Status code of read without a key is not 401, but %d", w.Code)
+	}
+	if w := request("GET", "/"+myjson.Filename, uploaderKey, ""); w.Code != 403 {
+		t.Fatalf("Status code of read with an upload key is not 403, but %d", w.Code)
+	}
+	if w := request("GET", "/"+myjson.Filename, readerKey, ""); w.Code != 200 {
+		t.Fatalf("Status code of read with a read-only key is not 200, but %d", w.Code)
+	}
+
+	if w := request("PATCH", "/"+myjson.Filename, uploaderKey, `{"original_name":"other.txt"}`); w.Code != 401 {
+		t.Fatalf("Status code of edit without the delete key is not 401, but %d", w.Code)
+	}
+	if w := request("PATCH", "/"+myjson.Filename, adminKey, `{"original_name":"other.txt"}`); w.Code != 200 {
+		t.Fatalf("Status code of edit with an admin key is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+
+	if w := request("DELETE", "/"+myjson.Filename, uploaderKey, ""); w.Code != 401 {
+		t.Fatalf("Status code of deletion without the delete key is not 401, but %d", w.Code)
+	}
+	if w := request("DELETE", "/"+myjson.Filename, readerKey, ""); w.Code != 403 {
+		t.Fatalf("Status code of deletion with a read-only key is not 403, but %d", w.Code)
+	}
+	if w := request("DELETE", "/"+myjson.Filename, deleterKey, ""); w.Code != 200 {
+		t.Fatalf("Status code of deletion with a delete-any key is not 200, but %d", w.Code)
+	}
+	if _, err := storageBackend.Head(myjson.Filename); err == nil {
+		t.Fatal("File was not deleted")
+	}
+}
+
+func TestCollectionExpiry(t *testing.T) {
+	mux := setup()
+
+	put := func(collection string, expiry string) map[string]string {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/"+generateBarename()+".txt", strings.NewReader("File content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Linx-Collection", collection)
+		req.Header.Set("Linx-Delete-Key", "collectionkey")
+		req.Header.Set("Linx-Expiry", expiry)
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+		}
+
+		var upload map[string]string
+		err = json.Unmarshal(w.Body.Bytes(), &upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return upload
+	}
+
+	collection := put("new", "60")["collection"]
+	_, metadata, err := readCollection(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := metadata.Expiry
+
+	// Files that last longer extend the collection to their expiry
+	longer := put(collection, "3600")
+	_, metadata, err = readCollection(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strconv.FormatInt(metadata.Expiry.Unix(), 10) != longer["expiry"] || !metadata.Expiry.After(created) {
+		t.Fatalf("Collection expiry %v was not extended to %s", metadata.Expiry, longer["expiry"])
+	}
+
+	// and those that don't leave it as it is
+	put(collection, "60")
+	_, shorter, err := readCollection(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !shorter.Expiry.Equal(metadata.Expiry) {
+		t.Fatalf("Collection expiry changed from %v to %v", metadata.Expiry, shorter.Expiry)
+	}
+
+	collectionFiles, _, err := readCollection(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(collectionFiles.Files) != 3 {
+		t.Fatalf("Collection has %d files instead of 3", len(collectionFiles.Files))
+	}
+
+	// Files whose expiry is extended later on extend the collection too
+	oldMaxDurationSize := Config.maxDurationSize
+	Config.maxDurationSize = 4294967296
+	defer func() { Config.maxDurationSize = oldMaxDurationSize }()
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("PATCH", "/"+longer["filename"], strings.NewReader(`{"expiry":"7200"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Delete-Key", "collectionkey")
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var edited map[string]string
+	err = json.Unmarshal(w.Body.Bytes(), &edited)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, metadata, err = readCollection(collection)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strconv.FormatInt(metadata.Expiry.Unix(), 10) != edited["expiry"] || edited["expiry"] == longer["expiry"] {
+		t.Fatalf("Collection expiry %v was not extended to %s", metadata.Expiry, edited["expiry"])
+	}
+}
+
+func TestCollectionLockedFiles(t *testing.T) {
+	mux := setup()
+
+	put := func(collection, content, accessKey string) map[string]string {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("PUT", "/upload/"+generateBarename()+".txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Linx-Collection", collection)
+		req.Header.Set("Linx-Delete-Key", "collectionkey")
+		req.Header.Set("Linx-Access-Key", accessKey)
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+		}
+
+		var upload map[string]string
+		err = json.Unmarshal(w.Body.Bytes(), &upload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return upload
+	}
+	locked := put("new", "Locked file content", "lockedkey")
+	open := put(locked["collection"], "File content", "")
+
+	get := func(accept, accessKey string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, err := http.NewRequest("GET", "/collection/"+locked["collection"], nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", accept)
+		if accessKey != "" {
+			req.Header.Set("Linx-Access-Key", accessKey)
+		}
+		mux.ServeHTTP(w, req)
+
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d", w.Code)
+		}
+		return w
+	}
+	files := func(accessKey string) map[string]map[string]string {
+		var listing struct {
+			Files []map[string]string `json:"files"`
+		}
+		err := json.Unmarshal(get("application/json", accessKey).Body.Bytes(), &listing)
+		if err != nil {
+			t.Fatal(err)
+		}
+		byName := make(map[string]map[string]string)
+		for _, file := range listing.Files {
+			byName[file["filename"]] = file
+		}
+		return byName
+	}
+
+	// Only the name of a file is listed without its access key
+	listed := files("")
+	if len(listed[locked["filename"]]) != 2 || listed[locked["filename"]]["locked"] != "true" {
+		t.Fatalf("Locked file was listed with %v", listed[locked["filename"]])
+	}
+	if listed[open["filename"]]["mimetype"] == "" || listed[open["filename"]]["locked"] != "false" {
+		t.Fatalf("Open file was listed with %v", listed[open["filename"]])
+	}
+	listed = files("lockedkey")
+	if listed[locked["filename"]]["size"] != locked["size"] || listed[locked["filename"]]["locked"] != "true" {
+		t.Fatalf("Locked file was listed with %v despite its access key", listed[locked["filename"]])
+	}
+
+	body := get("text/html", "").Body.String()
+	if !strings.Contains(body, locked["filename"]) || !strings.Contains(body, "12 B") || strings.Contains(body, "19 B") {
+		t.Fatalf("Locked file was not listed by name only: %s", body)
+	}
+}
+
+func TestFailedOverwrite(t *testing.T) {
+	oldRevisions := Config.pasteRevisions
+	Config.pasteRevisions = 2
+	defer func() { Config.pasteRevisions = oldRevisions }()
+	mux := setup()
+
+	put := func(content string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "/upload/failed.txt", strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The size is only found out while the upload is stored
+		req.ContentLength = -1
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Linx-Delete-Key", "failkey")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, content := range []string{"first\n", "second\n"} {
+		w := put(content)
+		if w.Code != 200 {
+			t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+		}
+	}
+
+	oldMaxSize := Config.maxSize
+	Config.maxSize = 1024
+	w := put(strings.Repeat("too large\n", 200))
+	Config.maxSize = oldMaxSize
+	if w.Code == 200 {
+		t.Fatal("Upload larger than the maximum size was stored")
+	}
+
+	// The paste and its revisions are left as they were
+	metadata, err := storageBackend.Head("failed.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Revision != 2 || metadata.Size != int64(len("second\n")) {
+		t.Fatalf("Paste changed by a failed overwrite %+v", metadata)
+	}
+	for revision, content := range map[string]string{"1": "first\n", "2": "second\n"} {
+		req, err := http.NewRequest("GET", "/"+Config.selifPath+"failed.txt/rev/"+revision, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 || w.Body.String() != content {
+			t.Fatalf("Unexpected revision %s: %d %q", revision, w.Code, w.Body.String())
+		}
+	}
+	if exists, _ := storageBackend.Exists(revisionKey("failed.txt", 2)); exists {
+		t.Fatal("Revision of a failed overwrite was kept")
+	}
+}
+
+func TestAuthDownloadConfirmation(t *testing.T) {
+	authFile := filepath.Join(t.TempDir(), "authfile")
+	err := os.WriteFile(authFile, []byte("vhvZ/PT1jeTbTAJ8JdoxddqFtebSxdVb0vwPlYO+4HM=\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Config.authFile = authFile
+	defer func() {
+		Config.authFile = ""
+		Config.private = false
+	}()
+	mux := setup()
+
+	req, err := http.NewRequest("PUT", "/upload/confirmed.txt", strings.NewReader("File content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Linx-Api-Key", "haPVipRnGJ0QovA9nyqK")
+	req.Header.Set("Linx-Max-Downloads", "1")
+	req.Header.Set("Linx-Randomize", "yes")
+	req.Header.Set("Accept", "application/json")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != 200 {
+		t.Fatalf("Status code is not 200, but %d: %s", w.Code, w.Body.String())
+	}
+	var myjson RespOkJSON
+	err = json.Unmarshal(w.Body.Bytes(), &myjson)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	confirm := func(path string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", path, strings.NewReader("download=yes"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// Anyone who can view the file can confirm its download
+	w = confirm("/" + myjson.Filename)
+	if w.Code != 200 || w.Body.String() != "File content" {
+		t.Fatalf("Unexpected confirmed download: %d %q", w.Code, w.Body.String())
+	}
+
+	// but uploads still need a key
+	w = confirm("/upload")
+	if w.Code != 401 {
+		t.Fatalf("Status code of upload without a key is not 401, but %d", w.Code)
+	}
+
+	Config.private = true
+	mux = setup()
+	w = confirm("/" + myjson.Filename)
+	if w.Code != 401 {
+		t.Fatalf("Status code on a private instance is not 401, but %d", w.Code)
+	}
+}
+
+func TestThumbnailLocks(t *testing.T) {
+	locks := keyedMutex{locks: make(map[string]*keyedLock)}
+	unlockA := locks.lock("a.png")
+
+	// Thumbnails of other images are made meanwhile
+	done := make(chan struct{})
+	go func() {
+		locks.lock("b.png")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Lock of another image waited for the first")
+	}
+
+	locked := make(chan struct{})
+	released := make(chan struct{})
+	go func() {
+		unlock := locks.lock("a.png")
+		close(locked)
+		unlock()
+		close(released)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("Lock of the same image did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlockA()
+	<-released
+
+	locks.mu.Lock()
+	defer locks.mu.Unlock()
+	if len(locks.locks) != 0 {
+		t.Fatalf("Locks were kept after being released: %v", locks.locks)
+	}
+}
+
+func TestKeyQuotaReservation(t *testing.T) {
+	keyQuotas.reset()
+	defer keyQuotas.reset()
+	key := &apikeys.Key{Label: "reserving", Quota: 30}
+
+	_, release, err := checkKeyQuota(key, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = checkKeyQuota(key, 20)
+	if err != errQuotaExceeded {
+		t.Fatalf("Reserved storage was not counted: %v", err)
+	}
+	release()
+	_, release, err = checkKeyQuota(key, 20)
+	if err != nil {
+		t.Fatalf("Released storage was still counted: %v", err)
+	}
+	release()
+
+	// Uploads of unknown size hold the whole quota while they are stored
+	_, release, err = checkKeyQuota(key, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = checkKeyQuota(key, -1)
+	if err != errQuotaExceeded {
+		t.Fatalf("Second upload of unknown size was not refused: %v", err)
+	}
+	release()
+
+	// Files stored without going through this server are only counted
+	// once the usage is loaded again
+	_, err = storageBackend.Put("reserving.txt", strings.NewReader(strings.Repeat("a", 25)),
+		backends.Metadata{Expiry: time.Now().Add(time.Hour), DeleteKey: "reserving", Uploader: "reserving"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storageBackend.Delete("reserving.txt")
+
+	_, release, err = checkKeyQuota(key, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	err = keyQuotas.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = checkKeyQuota(key, 10)
+	if err != errQuotaExceeded {
+		t.Fatalf("Reloaded usage was not counted: %v", err)
+	}
+}
+
+func TestInternalKeys(t *testing.T) {
+	mux := setup()
+
+	// Uploads can use the extensions of the server's own objects, and
+	// can't reach its keys
+	for _, name := range []string{"notes.collection", "image.thumb", "paste.rev", "file.quarantine", "_collection_x.txt"} {
+		req, err := http.NewRequest("PUT", "/upload/"+name, strings.NewReader("File content"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 {
+			t.Fatalf("Status code of %s is not 200, but %d: %s", name, w.Code, w.Body.String())
+		}
+
+		var myjson RespOkJSON
+		err = json.Unmarshal(w.Body.Bytes(), &myjson)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isReservedKey(myjson.Filename) {
+			t.Fatalf("Upload %s was stored under internal key %s", name, myjson.Filename)
+		}
+
+		req, err = http.NewRequest("GET", "/"+Config.selifPath+myjson.Filename, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w = httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != 200 || w.Body.String() != "File content" {
+			t.Fatalf("Upload %s was not served: %d", name, w.Code)
+		}
+	}
+}
+
 func TestShutdown(t *testing.T) {
 	os.RemoveAll(Config.filesDir)
 	os.RemoveAll(Config.metaDir)
@@ -40,7 +40,26 @@ function edit(ev) {
 function paste(ev) {
     var editordiv = document.getElementById("inplace-editor");
     document.getElementById("newcontent").value = editordiv.value;
-    document.forms["reply"].submit();
+
+    // With its delete key, the paste is saved under its name as its new
+    // revision rather than as a new paste
+    var form = document.forms["reply"];
+    if (form.elements["delete_key"].value !== "") {
+        var name = form.getAttribute("data-name");
+        var extension = form.getAttribute("data-extension");
+
+        var filename = form.elements["filename"];
+        if (!filename) {
+            filename = document.createElement("input");
+            filename.setAttribute("type", "hidden");
+            filename.setAttribute("name", "filename");
+            form.appendChild(filename);
+        }
+        filename.value = name.substring(0, name.length - extension.length - 1);
+        form.elements["extension"].value = extension;
+    }
+
+    form.submit();
 }
 
 function wrap(ev) {
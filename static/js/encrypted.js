@@ -0,0 +1,55 @@
+// @license magnet:?xt=urn:btih:1f739d935676111cfff4b4693e3816e664797050&dn=gpl-3.0.txt GPL-v3-or-Later
+
+// The key of the paste is in the fragment of its URL, which is never sent
+// to the server
+var codeb = document.getElementById("codeb");
+
+decryptPaste(codeb.getAttribute("data-ciphertext"), window.location.hash.substring(1)).then(function(text) {
+    codeb.textContent = text;
+
+    if (window.hljs) {
+        hljs.tabReplace = '    ';
+        hljs.highlightBlock(codeb);
+
+        var lines = codeb.innerHTML.split("\n");
+        codeb.innerHTML = "";
+        for (var i = 0; i < lines.length; i++) {
+            var div = document.createElement("div");
+            div.innerHTML = lines[i] + "\n";
+            codeb.appendChild(div);
+        }
+
+        document.getElementById("normal-code").className = "linenumbers";
+    }
+}, function(message) {
+    var error = document.getElementById("decrypt-error");
+    error.textContent = message;
+    error.style.display = "block";
+});
+
+function decryptPaste(ciphertext, key) {
+    if (!window.crypto || !crypto.subtle) {
+        return Promise.reject("This paste is encrypted, and your browser can't decrypt it on this page.");
+    }
+    if (key === "") {
+        return Promise.reject("This paste is encrypted, and the key to decrypt it is missing from its link.");
+    }
+
+    var data;
+    try {
+        data = base64ToBytes(ciphertext);
+        key = base64ToBytes(key);
+    } catch (e) {
+        return Promise.reject("This paste could not be decrypted with the key in its link.");
+    }
+
+    return crypto.subtle.importKey("raw", key, "AES-GCM", false, ["decrypt"]).then(function(cryptoKey) {
+        return crypto.subtle.decrypt({name: "AES-GCM", iv: data.slice(0, 12)}, cryptoKey, data.slice(12));
+    }).then(function(plaintext) {
+        return new TextDecoder().decode(plaintext);
+    }).catch(function() {
+        throw "This paste could not be decrypted with the key in its link.";
+    });
+}
+
+// @license-end
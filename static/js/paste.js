@@ -1,3 +1,53 @@
 // @license magnet:?xt=urn:btih:1f739d935676111cfff4b4693e3816e664797050&dn=gpl-3.0.txt GPL-v3-or-Later
 document.getElementById('content').addEventListener('keydown', handleTab);
+
+// Pastes can only be encrypted where the browser can do it, as they would
+// be uploaded as they are otherwise
+if (window.crypto && crypto.subtle) {
+    document.getElementById('encrypt-option').style.display = "";
+    document.getElementById('reply').addEventListener('submit', function(ev) {
+        if (document.getElementById('encrypt').checked) {
+            ev.preventDefault();
+            encryptPaste(ev.target);
+        }
+    });
+}
+
+// Encrypt the paste with a new key and upload it, then go to its page with
+// the key in the fragment of its URL, which is never sent to the server
+function encryptPaste(form) {
+    var iv = crypto.getRandomValues(new Uint8Array(12));
+    var plaintext = new TextEncoder().encode(form.elements["content"].value);
+    var key;
+
+    crypto.subtle.generateKey({name: "AES-GCM", length: 256}, true, ["encrypt"]).then(function(cryptoKey) {
+        key = cryptoKey;
+        return crypto.subtle.encrypt({name: "AES-GCM", iv: iv}, key, plaintext);
+    }).then(function(ciphertext) {
+        var data = new Uint8Array(iv.length + ciphertext.byteLength);
+        data.set(iv);
+        data.set(new Uint8Array(ciphertext), iv.length);
+
+        var body = new URLSearchParams(new FormData(form));
+        body.set("content", bytesToBase64(data, false));
+        body.set("encrypted", "true");
+
+        return fetch(form.action, {
+            method: "POST",
+            headers: {"Accept": "application/json"},
+            body: body
+        });
+    }).then(function(response) {
+        return response.json().then(function(json) {
+            if (!response.ok) {
+                throw json.error;
+            }
+            return crypto.subtle.exportKey("raw", key).then(function(rawKey) {
+                window.location = json.url + "#" + bytesToBase64(new Uint8Array(rawKey), true);
+            });
+        });
+    }).catch(function(err) {
+        alert("Could not upload the encrypted paste: " + err);
+    });
+}
 // @license-end
@@ -63,6 +63,10 @@ Dropzone.options.dropzone = {
         if (randomize != null) {
             formData.append("randomize", randomize.checked);
         }
+        var keepMetadata = document.getElementById("keep_metadata");
+        if (keepMetadata != null) {
+            formData.append("keep_metadata", keepMetadata.checked);
+        }
         formData.append("expires", document.getElementById("expires").value);
     },
     success: function (file, resp) {
@@ -15,4 +15,34 @@ function handleTab(ev) {
     }
 }
 
+// Encode bytes as base64, URL-safe and unpadded for the keys of encrypted
+// pastes, which go in the fragment of their URL
+function bytesToBase64(bytes, urlSafe) {
+    var binary = "";
+    for (var i = 0; i < bytes.length; i++) {
+        binary += String.fromCharCode(bytes[i]);
+    }
+
+    var encoded = btoa(binary);
+    if (urlSafe) {
+        encoded = encoded.replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+    }
+    return encoded;
+}
+
+// Decode standard or URL-safe base64
+function base64ToBytes(encoded) {
+    encoded = encoded.replace(/-/g, "+").replace(/_/g, "/");
+    while (encoded.length % 4 !== 0) {
+        encoded += "=";
+    }
+
+    var binary = atob(encoded);
+    var bytes = new Uint8Array(binary.length);
+    for (var i = 0; i < binary.length; i++) {
+        bytes[i] = binary.charCodeAt(i);
+    }
+    return bytes;
+}
+
 // @license-end
@@ -53,12 +53,18 @@ func populateTemplatesMap(tSet *pongo2.TemplateSet, tMap map[string]*pongo2.Temp
 		"oops.html",
 		"access.html",
 		"custom_page.html",
+		"collection.html",
+		"download.html",
+		"link.html",
+		"revisions.html",
+		"diff.html",
 
 		"display/audio.html",
 		"display/image.html",
 		"display/video.html",
 		"display/pdf.html",
 		"display/bin.html",
+		"display/encrypted.html",
 		"display/story.html",
 		"display/md.html",
 		"display/file.html",
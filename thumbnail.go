@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/httputil"
+	"github.com/andreimarcu/linx-server/imagemeta"
+	"github.com/zenazn/goji/web"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// Largest images thumbnails get made of, in bytes and in pixels, as the
+// whole image is decoded in memory
+const (
+	maxThumbnailSource = 64 << 20
+	maxThumbnailPixels = 64 << 20
+)
+
+var thumbnailMimetypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+var errThumbnailTooLarge = errors.New("Image is too large for a thumbnail.")
+
+// Serializes making the thumbnail of each image within this process, so
+// that an image that gets requested many times at once is only decoded
+// once, while thumbnails of other images are made meanwhile
+var thumbnailLocks = keyedMutex{locks: make(map[string]*keyedLock)}
+
+// Mutexes by key, which are only kept while they are held or waited for
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	k.mu.Lock()
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.waiters++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		k.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}
+
+// Thumbnails of images are made the first time they are requested, and
+// stored like files under an internal key named after the image. They get
+// the image's expiry and keys, so that they expire and get cleaned up along
+// with it.
+func thumbnailKey(filename string) string {
+	return internalKey("thumb", filename)
+}
+
+// Check whether a thumbnail can be made of a file. Files that can only be
+// downloaded a few times have none, as making one would use up a download.
+func hasThumbnail(metadata backends.Metadata) bool {
+	return Config.thumbnailSize > 0 && thumbnailMimetypes[metadata.Mimetype] &&
+		metadata.MaxDownloads == 0 && metadata.Size <= maxThumbnailSource
+}
+
+func thumbnailURL(r *http.Request, filename string) string {
+	return getSiteURL(r) + Config.selifPath + "thumb/" + filename
+}
+
+func deleteThumbnail(filename string) {
+	exists, err := storageBackend.Exists(thumbnailKey(filename))
+	if err == nil && exists {
+		storageBackend.Delete(thumbnailKey(filename))
+	}
+}
+
+func thumbnailHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	fileName := c.URLParams["name"]
+
+	if isReservedKey(fileName) {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	metadata, err := checkFile(fileName)
+	if err == backends.NotFoundErr {
+		notFoundHandler(c, w, r)
+		return
+	} else if err != nil {
+		oopsHandler(c, w, r, RespAUTO, "Corrupt metadata.")
+		return
+	}
+
+	if src, err := checkAccessKey(r, &metadata); err != nil {
+		// remove invalid cookie
+		if src == accessKeySourceCookie {
+			setAccessKeyCookies(w, getSiteURL(r), fileName, "", time.Unix(0, 0))
+		}
+		unauthorizedHandler(c, w, r)
+
+		return
+	}
+
+	if !hasThumbnail(metadata) {
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	if !Config.allowHotlink {
+		referer := r.Header.Get("Referer")
+		u, _ := url.Parse(referer)
+		p, _ := url.Parse(getSiteURL(r))
+		if referer != "" && !sameOrigin(u, p) {
+			http.Redirect(w, r, Config.sitePath+fileName, 303)
+			return
+		}
+	}
+
+	thumbMetadata, err := getThumbnail(fileName, metadata)
+	if err != nil {
+		// Images that can't be decoded have no thumbnail either
+		notFoundHandler(c, w, r)
+		return
+	}
+
+	if !Config.disableSecurityHeaders {
+		w.Header().Set(cspHeader, defaultFileCSPOptions.policy)
+		w.Header().Set(rpHeader, defaultFileCSPOptions.referrerPolicy)
+	}
+	w.Header().Set("Content-Type", thumbMetadata.Mimetype)
+	w.Header().Set("Content-Length", strconv.FormatInt(thumbMetadata.Size, 10))
+	w.Header().Set("Etag", fmt.Sprintf("\"%s\"", thumbMetadata.Sha256sum))
+	w.Header().Set("Cache-Control", "public, no-cache")
+
+	modtime := time.Unix(0, 0)
+	if done := httputil.CheckPreconditions(w, r, modtime); done {
+		return
+	}
+
+	if r.Method != "HEAD" {
+		err = storageBackend.ServeFile(thumbnailKey(fileName), w, r)
+		if err != nil {
+			oopsHandler(c, w, r, RespAUTO, err.Error())
+			return
+		}
+	}
+}
+
+// Get the thumbnail of an image, making it if it doesn't exist yet
+func getThumbnail(filename string, metadata backends.Metadata) (backends.Metadata, error) {
+	thumbMetadata, err := storageBackend.Head(thumbnailKey(filename))
+	if err != backends.NotFoundErr {
+		return thumbMetadata, err
+	}
+
+	unlock := thumbnailLocks.lock(filename)
+	defer unlock()
+
+	// It may have been made while waiting for the lock
+	thumbMetadata, err = storageBackend.Head(thumbnailKey(filename))
+	if err != backends.NotFoundErr {
+		return thumbMetadata, err
+	}
+
+	_, reader, err := storageBackend.Get(filename)
+	if err != nil {
+		return thumbMetadata, err
+	}
+	defer reader.Close()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxThumbnailSource))
+	if err != nil {
+		return thumbMetadata, err
+	}
+
+	thumbnail, err := makeThumbnail(metadata.Mimetype, data, Config.thumbnailSize)
+	if err != nil {
+		return thumbMetadata, err
+	}
+
+	return storageBackend.Put(thumbnailKey(filename), bytes.NewReader(thumbnail), backends.Metadata{
+		Expiry:    metadata.Expiry,
+		DeleteKey: metadata.DeleteKey,
+		AccessKey: metadata.AccessKey,
+		SrcIp:     metadata.SrcIp,
+	})
+}
+
+// Make a thumbnail of an image that fits in a square of the given size,
+// turned the right way up. Thumbnails of JPEG images are JPEG images, and
+// PNG images otherwise, to keep transparency.
+func makeThumbnail(mimetype string, data []byte, size int) ([]byte, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if int64(config.Width)*int64(config.Height) > maxThumbnailPixels {
+		return nil, errThumbnailTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width > height {
+			width, height = size, max(height*size/width, 1)
+		} else {
+			width, height = max(width*size/height, 1), size
+		}
+	}
+
+	scaled := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.BiLinear.Scale(scaled, scaled.Bounds(), img, bounds, draw.Src, nil)
+	thumbnail := orientImage(scaled, imagemeta.Orientation(mimetype, bytes.NewReader(data)))
+
+	var buf bytes.Buffer
+	if mimetype == "image/jpeg" {
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: 85})
+	} else {
+		err = png.Encode(&buf, thumbnail)
+	}
+	return buf.Bytes(), err
+}
+
+// Turn an image according to its EXIF orientation, as thumbnails don't
+// carry one
+func orientImage(img *image.RGBA, orientation uint16) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	// Orientations from 5 on swap the width and height
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if orientation >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Mirrored horizontally
+				dx, dy = w-1-x, y
+			case 3: // Turned by 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Mirrored vertically
+				dx, dy = x, h-1-y
+			case 5: // Transposed
+				dx, dy = y, x
+			case 6: // Turned by 90° clockwise
+				dx, dy = h-1-y, x
+			case 7: // Transversed
+				dx, dy = h-1-y, w-1-x
+			case 8: // Turned by 90° counterclockwise
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):][:4], img.Pix[img.PixOffset(x, y):][:4])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andreimarcu/linx-server/auth/apikeys"
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/dchest/uniuri"
+	"github.com/zenazn/goji/web"
+)
+
+// Resumable uploads following the tus 1.0.0 protocol, with its creation,
+// termination and expiration extensions. Partial uploads are kept in
+// Config.tusDir until they are complete, at which point they go through
+// processUpload like any other upload.
+
+const tusVersion = "1.0.0"
+
+var tusIdRe = regexp.MustCompile(`^[A-Za-z0-9]{32}$`)
+
+// Serializes requests to the same partial upload within this process
+var tusLocks sync.Map
+
+// Options given when a partial upload was created
+type tusInfo struct {
+	Length         int64     `json:"length"`
+	Filename       string    `json:"filename"`
+	Expiry         string    `json:"expiry"`
+	DeleteKey      string    `json:"delete_key"`
+	AccessKey      string    `json:"access_key"`
+	RandomBarename bool      `json:"randomize"`
+	SrcIp          string    `json:"srcip"`
+	Collection     string    `json:"collection"`
+	MaxDownloads   string    `json:"max_downloads"`
+	KeepMetadata   bool      `json:"keep_metadata"`
+	Expires        time.Time `json:"expires"`
+}
+
+func tusDataPath(id string) string {
+	return path.Join(Config.tusDir, id)
+}
+
+func tusInfoPath(id string) string {
+	return path.Join(Config.tusDir, id+".info")
+}
+
+func tusExpiry() time.Duration {
+	return time.Duration(Config.tusExpiry) * time.Second
+}
+
+func readTusInfo(id string) (info tusInfo, err error) {
+	if !tusIdRe.MatchString(id) {
+		return info, backends.NotFoundErr
+	}
+
+	contents, err := os.ReadFile(tusInfoPath(id))
+	if os.IsNotExist(err) {
+		return info, backends.NotFoundErr
+	} else if err != nil {
+		return
+	}
+
+	err = json.Unmarshal(contents, &info)
+	if err != nil {
+		return
+	}
+
+	if time.Now().After(info.Expires) {
+		removeTusUpload(id)
+		return info, backends.NotFoundErr
+	}
+
+	return
+}
+
+func writeTusInfo(id string, info tusInfo) error {
+	contents, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(tusInfoPath(id), contents, 0600)
+}
+
+func removeTusUpload(id string) {
+	os.Remove(tusInfoPath(id))
+	os.Remove(tusDataPath(id))
+	tusLocks.Delete(id)
+}
+
+func periodicTusCleanup(interval time.Duration) {
+	for range time.Tick(interval) {
+		cleanupTusUploads()
+	}
+}
+
+// Remove the partial uploads that have expired
+func cleanupTusUploads() {
+	entries, err := os.ReadDir(Config.tusDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		id, found := strings.CutSuffix(entry.Name(), ".info")
+		if found {
+			// Expired uploads are removed as they are read
+			readTusInfo(id)
+		}
+	}
+}
+
+func lockTusUpload(id string) (unlock func(), ok bool) {
+	if !tusIdRe.MatchString(id) {
+		// There is nothing to lock, and the upload won't be found
+		return func() {}, true
+	}
+
+	mutex, _ := tusLocks.LoadOrStore(id, &sync.Mutex{})
+	if !mutex.(*sync.Mutex).TryLock() {
+		return nil, false
+	}
+	return mutex.(*sync.Mutex).Unlock, true
+}
+
+func tusError(w http.ResponseWriter, status int, msg string) {
+	http.Error(w, msg, status)
+}
+
+func setTusHeaders(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+// Check the protocol version of a request, answering it if it isn't
+// supported
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	setTusHeaders(w)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		tusError(w, http.StatusPreconditionFailed, "Unsupported tus version")
+		return false
+	}
+	return true
+}
+
+// Decode the Upload-Metadata header, a comma-separated list of keys
+// followed by base64-encoded values
+func parseTusMetadata(header string) map[string]string {
+	metadata := make(map[string]string)
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			continue
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err == nil {
+			metadata[key] = string(value)
+		}
+	}
+	return metadata
+}
+
+func tusOptionsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	setTusHeaders(w)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", "creation,termination,expiration")
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(Config.maxSize, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func tusCreateHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		tusError(w, http.StatusBadRequest, "Invalid Upload-Length")
+		return
+	} else if length == 0 {
+		tusError(w, http.StatusBadRequest, backends.FileEmptyError.Error())
+		return
+	} else if length > Config.maxSize {
+		tusError(w, http.StatusRequestEntityTooLarge, FileTooLargeError.Error())
+		return
+	} else if key := apikeys.RequestKey(c); key != nil && key.MaxSize > 0 && length > key.MaxSize {
+		tusError(w, http.StatusRequestEntityTooLarge, FileTooLargeError.Error())
+		return
+	}
+
+	// The expiry is parsed again once the upload is complete, as durations
+	// count from then, but invalid ones are refused right away
+	if _, err := parseExpiry(r.Header.Get("Linx-Expiry")); err != nil {
+		tusError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metadata := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = metadata["name"]
+	}
+
+	info := tusInfo{
+		Length:         length,
+		Filename:       filename,
+		Expiry:         r.Header.Get("Linx-Expiry"),
+		DeleteKey:      r.Header.Get("Linx-Delete-Key"),
+		AccessKey:      r.Header.Get(accessKeyHeaderName),
+		RandomBarename: r.Header.Get("Linx-Randomize") == "yes",
+		SrcIp:          r.Header.Get("X-Forwarded-For"),
+		Collection:     r.Header.Get("Linx-Collection"),
+		MaxDownloads:   r.Header.Get("Linx-Max-Downloads"),
+		KeepMetadata:   r.Header.Get("Linx-Keep-Metadata") == "yes",
+		Expires:        time.Now().Add(tusExpiry()),
+	}
+
+	err = os.MkdirAll(Config.tusDir, 0700)
+	if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not create upload")
+		return
+	}
+
+	id := uniuri.NewLen(32)
+	f, err := os.OpenFile(tusDataPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not create upload")
+		return
+	}
+	f.Close()
+
+	err = writeTusInfo(id, info)
+	if err != nil {
+		removeTusUpload(id)
+		tusError(w, http.StatusInternalServerError, "Could not create upload")
+		return
+	}
+
+	w.Header().Set("Location", getSiteURL(r)+"upload/tus/"+id)
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func tusHeadHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	id := c.URLParams["id"]
+	info, err := readTusInfo(id)
+	if err == backends.NotFoundErr {
+		tusError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not read upload")
+		return
+	}
+
+	fileInfo, err := os.Stat(tusDataPath(id))
+	if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not read upload")
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(fileInfo.Size(), 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+}
+
+func tusPatchHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+	defer r.Body.Close()
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		tusError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	id := c.URLParams["id"]
+	unlock, ok := lockTusUpload(id)
+	if !ok {
+		tusError(w, http.StatusLocked, "Upload is already in progress")
+		return
+	}
+	defer unlock()
+
+	info, err := readTusInfo(id)
+	if err == backends.NotFoundErr {
+		tusError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not read upload")
+		return
+	}
+
+	f, err := os.OpenFile(tusDataPath(id), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not read upload")
+		return
+	}
+	defer f.Close()
+
+	fileInfo, err := f.Stat()
+	if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not read upload")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		tusError(w, http.StatusBadRequest, "Invalid Upload-Offset")
+		return
+	} else if offset != fileInfo.Size() {
+		tusError(w, http.StatusConflict, "Upload-Offset does not match the upload")
+		return
+	}
+
+	remaining := info.Length - offset
+	if r.ContentLength > remaining {
+		tusError(w, http.StatusRequestEntityTooLarge, "Chunk exceeds Upload-Length")
+		return
+	}
+
+	// Whatever was received is kept when the connection drops, so that the
+	// client can resume from there
+	written, err := io.Copy(f, io.LimitReader(r.Body, remaining))
+	offset += written
+	if err != nil && written == 0 {
+		tusError(w, http.StatusBadRequest, "Could not read chunk")
+		return
+	}
+
+	info.Expires = time.Now().Add(tusExpiry())
+	err = writeTusInfo(id, info)
+	if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not update upload")
+		return
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+	w.Header().Set("Upload-Expires", info.Expires.UTC().Format(http.TimeFormat))
+
+	if offset == info.Length {
+		err = finishTusUpload(id, info, apikeys.RequestKey(c), w, r)
+		if err != nil {
+			if isUploadRequestError(err) {
+				// The upload can never be stored, so it is removed rather
+				// than kept at its full length. Other errors can be retried
+				// with an empty chunk.
+				removeTusUpload(id)
+				tusError(w, http.StatusBadRequest, err.Error())
+			} else {
+				tusError(w, http.StatusInternalServerError, "Could not upload file: "+err.Error())
+			}
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Store a complete upload like any other, with the limits of the key its
+// last chunk was sent with, and describe the stored file in the headers of
+// the response to it
+func finishTusUpload(id string, info tusInfo, key *apikeys.Key, w http.ResponseWriter, r *http.Request) error {
+	f, err := os.Open(tusDataPath(id))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	upReq := UploadRequest{
+		src:            f,
+		size:           info.Length,
+		filename:       info.Filename,
+		deleteKey:      info.DeleteKey,
+		randomBarename: info.RandomBarename,
+		accessKey:      info.AccessKey,
+		srcIp:          info.SrcIp,
+		collection:     info.Collection,
+		maxDownloads:   parseMaxDownloads(info.MaxDownloads),
+		keepMetadata:   info.KeepMetadata,
+		apiKey:         key,
+	}
+	upReq.expiry, upReq.expiryErr = parseExpiry(info.Expiry)
+	upload, err := processUpload(upReq)
+	if err != nil {
+		return err
+	}
+
+	removeTusUpload(id)
+
+	w.Header().Set("Linx-Url", getSiteURL(r)+upload.Filename)
+	w.Header().Set("Linx-Filename", upload.Filename)
+	w.Header().Set("Linx-Delete-Key", upload.Metadata.DeleteKey)
+	w.Header().Set("Linx-Expiry", strconv.FormatInt(upload.Metadata.Expiry.Unix(), 10))
+	if upload.Metadata.AccessKey != "" {
+		w.Header().Set(accessKeyHeaderName, upload.Metadata.AccessKey)
+	}
+	if upload.Collection != "" {
+		w.Header().Set("Linx-Collection", upload.Collection)
+	}
+	return nil
+}
+
+func tusDeleteHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	id := c.URLParams["id"]
+	unlock, ok := lockTusUpload(id)
+	if !ok {
+		tusError(w, http.StatusLocked, "Upload is already in progress")
+		return
+	}
+	defer unlock()
+
+	_, err := readTusInfo(id)
+	if err == backends.NotFoundErr {
+		tusError(w, http.StatusNotFound, "Upload not found")
+		return
+	} else if err != nil {
+		tusError(w, http.StatusInternalServerError, "Could not read upload")
+		return
+	}
+
+	removeTusUpload(id)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zenazn/goji/web"
+)
+
+func tusRequest(t *testing.T, mux *web.Mux, method, url string, body string, headers map[string]string) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Tus-Resumable", "1.0.0")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestTusUpload(t *testing.T) {
+	Config.tusDir = t.TempDir()
+	Config.tusExpiry = 3600
+	defer func() { Config.tusDir = "" }()
+	mux := setup()
+
+	content := "resumable file content"
+	filename := generateBarename() + ".txt"
+
+	w := tusRequest(t, mux, "POST", "/upload/tus/", "", map[string]string{
+		"Upload-Length":   strconv.Itoa(len(content)),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+		"Linx-Delete-Key": "tusdelete",
+	})
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 on creation, got %d: %s", w.Code, w.Body.String())
+	}
+	location := strings.TrimPrefix(w.Header().Get("Location"), strings.TrimSuffix(Config.siteURL, "/"))
+	if !strings.HasPrefix(location, "/upload/tus/") {
+		t.Fatalf("Unexpected location %s", w.Header().Get("Location"))
+	}
+
+	w = tusRequest(t, mux, "PATCH", location, content[:10], map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	if w.Code != http.StatusNoContent || w.Header().Get("Upload-Offset") != "10" {
+		t.Fatalf("Expected offset 10 after first chunk, got %d %s", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	// Chunks must continue where the upload is
+	w = tusRequest(t, mux, "PATCH", location, content[5:], map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "5",
+	})
+	if w.Code != http.StatusConflict {
+		t.Fatalf("Expected 409 for wrong offset, got %d", w.Code)
+	}
+
+	w = tusRequest(t, mux, "HEAD", location, "", nil)
+	if w.Code != http.StatusOK || w.Header().Get("Upload-Offset") != "10" || w.Header().Get("Upload-Length") != strconv.Itoa(len(content)) {
+		t.Fatalf("Unexpected HEAD response %d %v", w.Code, w.Header())
+	}
+
+	w = tusRequest(t, mux, "PATCH", location, content[10:], map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "10",
+	})
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on last chunk, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("Linx-Filename") != filename || w.Header().Get("Linx-Delete-Key") != "tusdelete" {
+		t.Fatalf("Unexpected stored file %s %s", w.Header().Get("Linx-Filename"), w.Header().Get("Linx-Delete-Key"))
+	}
+
+	// The partial upload is gone once stored
+	w = tusRequest(t, mux, "HEAD", location, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for completed upload, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/"+Config.selifPath+filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.ServeHTTP(w, req)
+	if w.Body.String() != content {
+		t.Fatalf("Stored contents %q do not match", w.Body.String())
+	}
+}
+
+func TestTusUploadLimits(t *testing.T) {
+	Config.tusDir = t.TempDir()
+	Config.tusExpiry = 3600
+	defer func() { Config.tusDir = "" }()
+	mux := setup()
+
+	w := tusRequest(t, mux, "POST", "/upload/tus/", "", map[string]string{
+		"Upload-Length": strconv.FormatInt(Config.maxSize+1, 10),
+	})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for too large upload, got %d", w.Code)
+	}
+
+	w = tusRequest(t, mux, "POST", "/upload/tus/", "", map[string]string{
+		"Upload-Length": "10",
+		"Linx-Expiry":   "tomorrow",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for invalid expiry, got %d", w.Code)
+	}
+
+	req, _ := http.NewRequest("POST", "/upload/tus/", nil)
+	req.Header.Set("Upload-Length", "10")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Fatalf("Expected 412 without Tus-Resumable, got %d", w.Code)
+	}
+
+	w = tusRequest(t, mux, "POST", "/upload/tus/", "", map[string]string{
+		"Upload-Length": "10",
+	})
+	location := strings.TrimPrefix(w.Header().Get("Location"), strings.TrimSuffix(Config.siteURL, "/"))
+
+	w = tusRequest(t, mux, "PATCH", location, "more than ten bytes", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for chunk past the length, got %d", w.Code)
+	}
+
+	w = tusRequest(t, mux, "DELETE", location, "", nil)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected 204 on termination, got %d", w.Code)
+	}
+	w = tusRequest(t, mux, "HEAD", location, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 after termination, got %d", w.Code)
+	}
+}
+
+func TestTusUploadCleanup(t *testing.T) {
+	Config.tusDir = t.TempDir()
+	Config.tusExpiry = 3600
+	Config.denyMimetypes = "text/plain"
+	defer func() {
+		Config.tusDir = ""
+		Config.denyMimetypes = ""
+	}()
+	mux := setup()
+
+	// Uploads that can't be stored once complete are removed
+	w := tusRequest(t, mux, "POST", "/upload/tus/", "", map[string]string{
+		"Upload-Length":   "5",
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte("denied.txt")),
+	})
+	location := strings.TrimPrefix(w.Header().Get("Location"), strings.TrimSuffix(Config.siteURL, "/"))
+
+	w = tusRequest(t, mux, "PATCH", location, "hello", map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	})
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for denied upload, got %d", w.Code)
+	}
+	w = tusRequest(t, mux, "HEAD", location, "", nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for denied upload, got %d", w.Code)
+	}
+
+	// Abandoned uploads are removed once they expire
+	w = tusRequest(t, mux, "POST", "/upload/tus/", "", map[string]string{
+		"Upload-Length": "5",
+	})
+	id := strings.TrimPrefix(w.Header().Get("Location"), Config.siteURL+"upload/tus/")
+
+	info, err := readTusInfo(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info.Expires = time.Now().Add(-time.Second)
+	err = writeTusInfo(id, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cleanupTusUploads()
+	entries, err := os.ReadDir(Config.tusDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("Expired uploads were not removed: %v", entries)
+	}
+}
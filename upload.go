@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
@@ -12,9 +13,12 @@ import (
 	"strconv"
 	"strings"
 	"time"
+	"unicode"
 
+	"github.com/andreimarcu/linx-server/auth/apikeys"
 	"github.com/andreimarcu/linx-server/backends"
 	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/imagemeta"
 	"github.com/dchest/uniuri"
 	"github.com/gabriel-vasile/mimetype"
 	"github.com/zenazn/goji/web"
@@ -30,31 +34,56 @@ var fileBlacklist = map[string]bool{
 	"crossdomain.xml": true,
 }
 
+// The server stores its own objects, such as collections and thumbnails,
+// under keys starting with this prefix. barePlusExt strips underscores, so
+// no upload can be stored under such a key.
+const internalKeyPrefix = "_"
+
+// Key of an object of the server of the given kind, such as a collection,
+// named after what it belongs to
+func internalKey(kind, name string) string {
+	return internalKeyPrefix + kind + "_" + name
+}
+
+// Check whether a key is one the server stores its own objects under, which
+// are never served as files
+func isReservedKey(filename string) bool {
+	return strings.HasPrefix(filename, internalKeyPrefix)
+}
+
 // Describes metadata directly from the user request
 type UploadRequest struct {
 	src            io.Reader
 	size           int64
 	filename       string
 	expiry         time.Duration // Seconds until expiry, 0 = never
+	expiryErr      error         // Set if the requested expiry is invalid
 	deleteKey      string        // Empty string if not defined
 	randomBarename bool
-	accessKey      string // Empty string if not defined
-	srcIp          string // Empty string if not defined
+	accessKey      string       // Empty string if not defined
+	srcIp          string       // Empty string if not defined
+	collection     string       // Collection ID to add the file to, "new" to create one
+	maxDownloads   int64        // Downloads allowed before deletion, 0 = unlimited
+	keepMetadata   bool         // Whether to keep image metadata when stripping it
+	apiKey         *apikeys.Key // Key the request was authenticated with, nil if none
+	link           bool         // Whether src is the URL of a short link
+	encrypted      bool         // Whether src is a paste encrypted in the browser
 }
 
 // Metadata associated with a file as it would actually be stored
 type Upload struct {
-	Filename string // Final filename on disk
-	Metadata backends.Metadata
+	Filename   string // Final filename on disk
+	Metadata   backends.Metadata
+	Collection string // Collection ID the file was added to, if any
 }
 
 func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	if !strictReferrerCheck(r, getSiteURL(r), []string{"Linx-Delete-Key", "Linx-Expiry", "Linx-Randomize", "X-Requested-With"}) {
+	if !strictReferrerCheck(r, getSiteURL(r), []string{"Linx-Delete-Key", "Linx-Expiry", "Linx-Randomize", "Linx-Collection", "Linx-Max-Downloads", "Linx-Keep-Metadata", "Linx-Encrypted", "X-Requested-With"}) {
 		badRequestHandler(c, w, r, RespAUTO, "")
 		return
 	}
 
-	upReq := UploadRequest{}
+	upReq := UploadRequest{apiKey: apikeys.RequestKey(c)}
 	uploadHeaderProcess(r, &upReq)
 
 	contentType := r.Header.Get("Content-Type")
@@ -66,6 +95,11 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		}
 		defer file.Close()
 
+		if len(r.MultipartForm.File["file"]) > 1 {
+			uploadMultiPostHandler(c, w, r, upReq)
+			return
+		}
+
 		upReq.src = file
 		upReq.size = headers.Size
 		upReq.filename = headers.Filename
@@ -86,16 +120,11 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 		upReq.filename = r.PostFormValue("filename") + "." + extension
 	}
 
-	upReq.expiry = parseExpiry(r.PostFormValue("expires"))
-	upReq.accessKey = r.PostFormValue(accessKeyParamName)
-	if r.PostFormValue("randomize") == "true" {
-		upReq.randomBarename = true
-	}
-	upReq.srcIp = r.Header.Get("X-Forwarded-For")
+	uploadFormProcess(r, &upReq)
 	upload, err := processUpload(upReq)
 
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isUploadRequestError(err) {
 			badRequestHandler(c, w, r, RespJSON, err.Error())
 			return
 		} else if err != nil {
@@ -110,7 +139,7 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 			oopsHandler(c, w, r, RespJSON, "")
 		}
 	} else {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isUploadRequestError(err) {
 			badRequestHandler(c, w, r, RespHTML, err.Error())
 			return
 		} else if err != nil {
@@ -123,7 +152,7 @@ func uploadPostHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 }
 
 func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-	upReq := UploadRequest{}
+	upReq := UploadRequest{apiKey: apikeys.RequestKey(c)}
 	uploadHeaderProcess(r, &upReq)
 
 	defer r.Body.Close()
@@ -132,8 +161,14 @@ func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	upReq.srcIp = r.Header.Get("X-Forwarded-For")
 	upload, err := processUpload(upReq)
 
+	uploadPutResponse(c, w, r, upload, err)
+}
+
+// Respond to a PUT request with the uploaded file's json document, or its
+// URL as plain text
+func uploadPutResponse(c web.C, w http.ResponseWriter, r *http.Request, upload Upload, err error) {
 	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isUploadRequestError(err) {
 			badRequestHandler(c, w, r, RespJSON, err.Error())
 			return
 		} else if err != nil {
@@ -148,7 +183,7 @@ func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 			oopsHandler(c, w, r, RespJSON, "")
 		}
 	} else {
-		if err == FileTooLargeError || err == backends.FileEmptyError {
+		if isUploadRequestError(err) {
 			badRequestHandler(c, w, r, RespPLAIN, err.Error())
 			return
 		} else if err != nil {
@@ -160,44 +195,169 @@ func uploadPutHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Store every file of a multipart request in one collection, which the
+// request can also add them to with the collection field
+func uploadMultiPostHandler(c web.C, w http.ResponseWriter, r *http.Request, upReq UploadRequest) {
+	uploadFormProcess(r, &upReq)
+	if upReq.collection == "" {
+		upReq.collection = newCollection
+	}
+
+	var uploads []map[string]string
+	for _, headers := range r.MultipartForm.File["file"] {
+		file, err := headers.Open()
+		if err != nil {
+			oopsHandler(c, w, r, RespAUTO, "Could not upload file.")
+			return
+		}
+
+		fileReq := upReq
+		fileReq.src = file
+		fileReq.size = headers.Size
+		fileReq.filename = headers.Filename
+		upload, err := processUpload(fileReq)
+		file.Close()
+
+		if isUploadRequestError(err) {
+			badRequestHandler(c, w, r, RespAUTO, headers.Filename+": "+err.Error())
+			return
+		} else if err != nil {
+			oopsHandler(c, w, r, RespAUTO, "Could not upload file: "+err.Error())
+			return
+		}
+
+		// The rest of the files go to the collection created with the
+		// first one, under the delete key it was given
+		upReq.collection = upload.Collection
+		upReq.deleteKey = upload.Metadata.DeleteKey
+		uploads = append(uploads, uploadJSON(upload, r))
+	}
+
+	if strings.EqualFold("application/json", r.Header.Get("Accept")) {
+		js, _ := json.Marshal(map[string]interface{}{
+			"collection":     upReq.collection,
+			"collection_url": collectionURL(r, upReq.collection),
+			"delete_key":     upReq.deleteKey,
+			"files":          uploads,
+		})
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		_, err := w.Write(js)
+		if err != nil {
+			oopsHandler(c, w, r, RespJSON, "")
+		}
+	} else {
+		http.Redirect(w, r, Config.sitePath+"collection/"+upReq.collection, 303)
+	}
+}
+
+// Errors caused by the upload request rather than by the server
+func isUploadRequestError(err error) bool {
+	return err == FileTooLargeError || err == backends.FileEmptyError ||
+		err == errCollectionNotFound || err == errCollectionKey ||
+		err == errMalwareFound || err == errTypeNotAllowed ||
+		err == expiry.ErrInvalid || err == expiry.ErrInPast || err == errQuotaExceeded ||
+		err == errInvalidLink || err == errInvalidEncryptedPaste
+}
+
+func uploadFormProcess(r *http.Request, upReq *UploadRequest) {
+	upReq.expiry, upReq.expiryErr = parseExpiry(r.PostFormValue("expires"))
+	upReq.accessKey = r.PostFormValue(accessKeyParamName)
+	// Pastes edited in place are saved as their new revision with their
+	// delete key
+	if deleteKey := r.PostFormValue("delete_key"); deleteKey != "" {
+		upReq.deleteKey = deleteKey
+	}
+	if r.PostFormValue("randomize") == "true" {
+		upReq.randomBarename = true
+	}
+	if collection := r.PostFormValue("collection"); collection != "" {
+		upReq.collection = collection
+	}
+	if r.PostFormValue("keep_metadata") == "true" {
+		upReq.keepMetadata = true
+	}
+	if r.PostFormValue("encrypted") == "true" {
+		upReq.encrypted = true
+	}
+	if r.PostFormValue("burn") != "" {
+		upReq.maxDownloads = 1
+	} else if maxDownloads := r.PostFormValue("max_downloads"); maxDownloads != "" {
+		upReq.maxDownloads = parseMaxDownloads(maxDownloads)
+	}
+	upReq.srcIp = r.Header.Get("X-Forwarded-For")
+}
+
 func uploadHeaderProcess(r *http.Request, upReq *UploadRequest) {
 	if r.Header.Get("Linx-Randomize") == "yes" {
 		upReq.randomBarename = true
 	}
 	upReq.deleteKey = r.Header.Get("Linx-Delete-Key")
 	upReq.accessKey = r.Header.Get(accessKeyHeaderName)
-	// Get seconds until expiry. Non-integer responses never expire.
-	expStr := r.Header.Get("Linx-Expiry")
-	upReq.expiry = parseExpiry(expStr)
+	upReq.collection = r.Header.Get("Linx-Collection")
+	upReq.maxDownloads = parseMaxDownloads(r.Header.Get("Linx-Max-Downloads"))
+	if r.Header.Get("Linx-Keep-Metadata") == "yes" {
+		upReq.keepMetadata = true
+	}
+	if r.Header.Get("Linx-Encrypted") == "yes" {
+		upReq.encrypted = true
+	}
+	upReq.expiry, upReq.expiryErr = parseExpiry(r.Header.Get("Linx-Expiry"))
 }
 
 func processUpload(upReq UploadRequest) (upload Upload, err error) {
+	if upReq.expiryErr != nil {
+		return upload, upReq.expiryErr
+	}
+	err = applyKeyLimits(&upReq)
+	if err != nil {
+		return upload, err
+	}
 	if upReq.size > Config.maxSize {
 		return upload, FileTooLargeError
 	}
+	if upReq.encrypted {
+		paste, err := readEncryptedPaste(upReq.src)
+		if err != nil {
+			return upload, err
+		}
+		upReq.src = bytes.NewReader(paste)
+		upReq.size = int64(len(paste))
+	}
 
 	// Determine the appropriate filename
 	barename, extension := barePlusExt(upReq.filename)
 	randomize := false
 
+	var originalName string
+	if len(barename) > 0 && !upReq.link {
+		originalName = cleanOriginalName(upReq.filename)
+	}
+
 	// Randomize the "barename" (filename without extension) if needed
 	if upReq.randomBarename || len(barename) == 0 {
 		barename = generateBarename()
 		randomize = true
 	}
 
-	var header []byte
-	if len(extension) == 0 {
-		// Pull the first 512 bytes off for use in MIME detection
-		header = make([]byte, 512)
-		n, _ := upReq.src.Read(header)
-		if n == 0 {
-			return upload, backends.FileEmptyError
-		}
-		header = header[:n]
-
+	// Pull the first 512 bytes off for use in MIME detection, which are
+	// those the backend detects the mimetype it stores from
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(upReq.src, header)
+	if n == 0 {
+		return upload, backends.FileEmptyError
+	}
+	header = header[:n]
+	kind := mimetype.Detect(header)
+	contentType := kind.String()
+
+	if upReq.link {
+		contentType = linkMimetype
+		extension = ""
+	} else if upReq.encrypted {
+		contentType = encryptedPasteMimetype
+	}
+	if len(extension) == 0 && !upReq.link {
 		// Determine the type of file from header
-		kind := mimetype.Detect(header)
 		if len(kind.Extension()) < 2 {
 			extension = "file"
 		} else {
@@ -205,10 +365,32 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		}
 	}
 
-	upload.Filename = strings.Join([]string{barename, extension}, ".")
+	err = uploadTypePolicy.check(contentType, extension)
+	if err != nil {
+		return upload, err
+	}
+	maxSize := uploadTypePolicy.maxSize(contentType)
+	if upReq.apiKey != nil {
+		if len(upReq.apiKey.Mimetypes) > 0 && !matchMimetype(upReq.apiKey.Mimetypes, contentType) {
+			return upload, errTypeNotAllowed
+		}
+		if upReq.apiKey.MaxSize > 0 && (maxSize == 0 || upReq.apiKey.MaxSize < maxSize) {
+			maxSize = upReq.apiKey.MaxSize
+		}
+	}
+	if maxSize > 0 {
+		if upReq.size > maxSize {
+			return upload, FileTooLargeError
+		}
+		upReq.src = &maxSizeReader{r: upReq.src, n: maxSize - int64(n), err: FileTooLargeError}
+	}
+
+	upload.Filename = joinFilename(barename, extension)
 	upload.Filename = strings.Replace(upload.Filename, " ", "", -1)
 
 	fileexists, _ := storageBackend.Exists(upload.Filename)
+	// File the upload overwrites, if any
+	var previous *backends.Metadata
 
 	// Check if the delete key matches, in which case overwrite
 	if fileexists {
@@ -216,6 +398,7 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		if merr == nil {
 			if upReq.deleteKey == metad.DeleteKey {
 				fileexists = false
+				previous = &metad
 			} else if Config.forceRandomFilename {
 				// the file exists
 				// the delete key doesn't match
@@ -243,7 +426,7 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 				barename = barename[:len(barename)-1] + strconv.Itoa(counter+1)
 			}
 		}
-		upload.Filename = strings.Join([]string{barename, extension}, ".")
+		upload.Filename = joinFilename(barename, extension)
 
 		fileexists, err = storageBackend.Exists(upload.Filename)
 		if err != nil {
@@ -251,47 +434,182 @@ func processUpload(upReq UploadRequest) (upload Upload, err error) {
 		}
 	}
 
-	if fileBlacklist[strings.ToLower(upload.Filename)] {
+	if fileBlacklist[strings.ToLower(upload.Filename)] || isReservedKey(upload.Filename) ||
+		(upReq.link && isLinkBlacklisted(upload.Filename)) {
 		return upload, errors.New("Prohibited filename")
 	}
 
-	// Get the rest of the metadata needed for storage
-	var fileExpiry time.Time
-	maxDurationTime := time.Duration(Config.maxDurationTime) * time.Second
-	if upReq.expiry == 0 {
-		if upReq.size > Config.maxDurationSize && maxDurationTime > 0 {
-			fileExpiry = time.Now().Add(maxDurationTime)
-		} else {
-			fileExpiry = expiry.NeverExpire
-		}
-	} else {
-		if upReq.size > Config.maxDurationSize && upReq.expiry > maxDurationTime {
-			fileExpiry = time.Now().Add(maxDurationTime)
-		} else {
-			fileExpiry = time.Now().Add(upReq.expiry)
-		}
+	upload.Collection, err = prepareCollection(upReq.collection, &upReq)
+	if err != nil {
+		return upload, err
 	}
 
+	// Get the rest of the metadata needed for storage
+	fileExpiry := uploadExpiry(upReq.size, upReq.expiry)
+
 	if upReq.deleteKey == "" {
 		upReq.deleteKey = uniuri.NewLen(30)
 	}
 	if Config.disableAccessKey {
 		upReq.accessKey = ""
 	}
-	upload.Metadata, err = storageBackend.Put(upload.Filename, io.MultiReader(bytes.NewReader(header), upReq.src), fileExpiry, upReq.deleteKey, upReq.accessKey, upReq.srcIp)
+	src := io.MultiReader(bytes.NewReader(header), upReq.src)
+	if Config.stripMetadata && !upReq.keepMetadata {
+		// The size and sha256sum are those of the stripped image, since
+		// the backend generates them from what it stores
+		stripped := stripImageMetadata(src)
+		defer stripped.Close()
+		src = stripped
+	}
+
+	var malware string
+	if uploadScanner != nil {
+		var scanned io.ReadCloser
+		scanned, malware, err = scanUpload(src)
+		if err != nil {
+			return upload, err
+		}
+		defer scanned.Close()
+		src = scanned
+
+		if malware != "" && Config.scanPolicy != scanPolicyFlag {
+			if Config.scanPolicy == scanPolicyQuarantine {
+				err = quarantineUpload(upload.Filename, src, malware, fileExpiry, upReq.deleteKey, upReq.srcIp)
+				if err != nil {
+					return upload, err
+				}
+			}
+			return upload, errMalwareFound
+		}
+	}
+
+	quota, release, err := checkKeyQuota(upReq.apiKey, upReq.size)
+	if err != nil {
+		return upload, err
+	}
+	defer release()
+	if quota > 0 {
+		src = &maxSizeReader{r: src, n: quota, err: errQuotaExceeded}
+	}
+
+	// Pastes overwritten with their delete key keep their earlier versions
+	var revision int64
+	if previous != nil && Config.pasteRevisions > 0 && previous.MaxDownloads == 0 && upReq.maxDownloads == 0 &&
+		isPaste(upload.Filename, previous.Mimetype, previous.Size) && isPaste(upload.Filename, contentType, 0) {
+		revision, err = keepRevision(upload.Filename, *previous, fileExpiry)
+		if err != nil {
+			return upload, err
+		}
+	}
+
+	if originalName == upload.Filename {
+		originalName = ""
+	}
+	var uploader string
+	if upReq.apiKey != nil {
+		uploader = upReq.apiKey.Label
+	}
+	metadata := backends.Metadata{
+		Expiry:       fileExpiry,
+		DeleteKey:    upReq.deleteKey,
+		AccessKey:    upReq.accessKey,
+		SrcIp:        upReq.srcIp,
+		OriginalName: originalName,
+		MaxDownloads: upReq.maxDownloads,
+		Malware:      malware,
+		Uploader:     uploader,
+		Collection:   upload.Collection,
+		Revision:     revision,
+	}
+	// Overwritten files are still listed by the collection they were in
+	if metadata.Collection == "" && previous != nil {
+		metadata.Collection = previous.Collection
+	}
+	if upReq.link || upReq.encrypted {
+		metadata.Mimetype = contentType
+	}
+
+	// The file is stored along with all of its metadata, and what it
+	// replaces is only cleaned up once it is
+	upload.Metadata, err = storageBackend.Put(upload.Filename, src, metadata)
 	if err != nil {
+		if revision > 0 {
+			storageBackend.Delete(revisionKey(upload.Filename, revision-1))
+		}
 		return upload, err
 	}
 
+	if revision > 0 {
+		updateRevisions(upload.Filename, revision-1, fileExpiry)
+	} else if previous != nil {
+		deleteRevisions(upload.Filename, previous.Revision)
+	}
+
+	// The thumbnail of a file that was overwritten is out of date
+	deleteThumbnail(upload.Filename)
+
+	keyQuotas.add(uploader, upload.Filename, upload.Metadata.Size)
+
+	if upload.Collection != "" {
+		err = addToCollection(upload.Collection, upReq.deleteKey, upload.Filename, upload.Metadata.Expiry)
+		if err != nil {
+			return upload, err
+		}
+	} else if upload.Metadata.Collection != "" {
+		extendCollection(upload.Metadata.Collection, upload.Metadata.Expiry)
+	}
+
+	sendWebhook(webhookEventUpload, upload.Filename, upload.Metadata)
 	return
 }
 
+// Strip the metadata of images as they are read, passing anything else
+// through as it is
+func stripImageMetadata(r io.Reader) io.ReadCloser {
+	// The first 512 bytes are enough for MIME detection
+	br := bufio.NewReader(r)
+	header, _ := br.Peek(512)
+	kind := mimetype.Detect(header).String()
+	if !imagemeta.Supported(kind) {
+		return io.NopCloser(br)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(imagemeta.Strip(kind, pw, br))
+	}()
+	return pr
+}
+
+// Determine when a file of the given size should expire, given the
+// requested time until expiry
+func uploadExpiry(size int64, requested time.Duration) time.Time {
+	maxDurationTime := time.Duration(Config.maxDurationTime) * time.Second
+	if requested == 0 {
+		if size > Config.maxDurationSize && maxDurationTime > 0 {
+			return time.Now().Add(maxDurationTime)
+		}
+		return expiry.NeverExpire
+	}
+
+	if size > Config.maxDurationSize && requested > maxDurationTime {
+		return time.Now().Add(maxDurationTime)
+	}
+	return time.Now().Add(requested)
+}
+
 func generateBarename() string {
 	return uniuri.NewLenChars(8, []byte("abcdefghijklmnopqrstuvwxyz0123456789"))
 }
 
 func generateJSONresponse(upload Upload, r *http.Request) []byte {
-	js, _ := json.Marshal(map[string]string{
+	js, _ := json.Marshal(uploadJSON(upload, r))
+
+	return js
+}
+
+func uploadJSON(upload Upload, r *http.Request) map[string]string {
+	m := map[string]string{
 		"url":        getSiteURL(r) + upload.Filename,
 		"direct_url": getSiteURL(r) + Config.selifPath + upload.Filename,
 		"filename":   upload.Filename,
@@ -301,9 +619,27 @@ func generateJSONresponse(upload Upload, r *http.Request) []byte {
 		"size":       strconv.FormatInt(upload.Metadata.Size, 10),
 		"mimetype":   upload.Metadata.Mimetype,
 		"sha256sum":  upload.Metadata.Sha256sum,
-	})
+	}
 
-	return js
+	if upload.Metadata.OriginalName != "" {
+		m["original_name"] = upload.Metadata.OriginalName
+	}
+
+	if upload.Metadata.MaxDownloads > 0 {
+		m["max_downloads"] = strconv.FormatInt(upload.Metadata.MaxDownloads, 10)
+	}
+
+	if upload.Metadata.Malware != "" {
+		m["malware"] = upload.Metadata.Malware
+	}
+
+	if upload.Collection != "" {
+		for k, v := range collectionJSON(r, upload.Collection) {
+			m[k] = v
+		}
+	}
+
+	return m
 }
 
 var bareRe = regexp.MustCompile(`[^A-Za-z0-9\-]`)
@@ -317,6 +653,36 @@ var archiveExts = map[string]bool{
 	".tar": true,
 }
 
+// Longest original filename kept, in bytes
+const maxOriginalNameLength = 255
+
+// Clean up the name a file was uploaded with, to keep it as the file's
+// original name. Only the last path element is kept, since some clients
+// send whole paths.
+func cleanOriginalName(filename string) string {
+	filename = filename[strings.LastIndexAny(filename, `/\`)+1:]
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(filename, ""))
+	filename = strings.TrimSpace(filename)
+
+	if len(filename) > maxOriginalNameLength {
+		filename = strings.ToValidUTF8(filename[:maxOriginalNameLength], "")
+	}
+	return filename
+}
+
+// Name of a file, which has no extension if it is a link
+func joinFilename(barename, extension string) string {
+	if extension == "" {
+		return barename
+	}
+	return barename + "." + extension
+}
+
 func barePlusExt(filename string) (barename, extension string) {
 	filename = strings.TrimSpace(filename)
 	filename = strings.ToLower(filename)
@@ -340,18 +706,21 @@ func barePlusExt(filename string) (barename, extension string) {
 	return
 }
 
-func parseExpiry(expStr string) time.Duration {
-	if expStr == "" {
-		return time.Duration(Config.defaultExpiry) * time.Second
-	} else {
-		fileExpiry, err := strconv.ParseUint(expStr, 10, 64)
-		if err != nil {
-			return time.Duration(Config.defaultExpiry) * time.Second
-		} else {
-			if Config.maxExpiry > 0 && (fileExpiry > Config.maxExpiry || fileExpiry == 0) {
-				fileExpiry = Config.maxExpiry
-			}
-			return time.Duration(fileExpiry) * time.Second
-		}
+// Parse the expiry requested for an upload, the default one if none was,
+// capped to the maximum expiry
+func parseExpiry(expStr string) (time.Duration, error) {
+	if strings.TrimSpace(expStr) == "" {
+		return time.Duration(Config.defaultExpiry) * time.Second, nil
+	}
+
+	fileExpiry, err := expiry.Parse(expStr, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	maxExpiry := time.Duration(Config.maxExpiry) * time.Second
+	if maxExpiry > 0 && (fileExpiry > maxExpiry || fileExpiry == 0) {
+		fileExpiry = maxExpiry
 	}
+	return fileExpiry, nil
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"log"
+
+	"github.com/andreimarcu/linx-server/backends"
+	"github.com/andreimarcu/linx-server/expiry"
+	"github.com/andreimarcu/linx-server/webhooks"
+)
+
+// Events sent to webhooks: a file was uploaded, deleted with its delete
+// key, expired or reached its download limit, or downloaded
+const (
+	webhookEventUpload = "upload"
+	webhookEventDelete = "delete"
+	webhookEventExpire = "expire"
+	webhookEventAccess = "access"
+)
+
+// Dispatcher of webhook events, nil if there are no webhooks
+var webhookDispatcher *webhooks.Dispatcher
+
+// Events that are sent to webhooks
+var webhookEvents map[string]bool
+
+func setupWebhooks() {
+	if webhookDispatcher != nil {
+		webhookDispatcher.Close()
+		webhookDispatcher = nil
+	}
+	if len(Config.webhookURLs) == 0 {
+		return
+	}
+
+	webhookEvents = make(map[string]bool)
+	for _, event := range splitList(Config.webhookEvents) {
+		switch event {
+		case webhookEventUpload, webhookEventDelete, webhookEventExpire, webhookEventAccess:
+			webhookEvents[event] = true
+		default:
+			log.Fatalf("Unknown webhook event %s", event)
+		}
+	}
+
+	var err error
+	webhookDispatcher, err = webhooks.NewDispatcher(webhooks.Options{
+		Targets:   Config.webhookURLs,
+		Secret:    Config.webhookSecret,
+		QueuePath: Config.webhookQueuePath,
+		NoLogs:    Config.noLogs,
+	})
+	if err != nil {
+		log.Fatal("Could not open webhook queue:", err)
+	}
+}
+
+// Send an event about a file to the webhooks. Files the server stores for
+// its own use have no events.
+func sendWebhook(event, filename string, metadata backends.Metadata) {
+	if webhookDispatcher == nil || !webhookEvents[event] || isReservedKey(filename) {
+		return
+	}
+
+	e := webhooks.Event{
+		Event:        event,
+		Filename:     filename,
+		Size:         metadata.Size,
+		Mimetype:     metadata.Mimetype,
+		Sha256sum:    metadata.Sha256sum,
+		OriginalName: metadata.OriginalName,
+	}
+	// Requests aren't always at hand, so URLs need the site URL to be set
+	if Config.siteURL != "" {
+		e.URL = Config.siteURL + filename
+	}
+	if !metadata.Expiry.IsZero() && metadata.Expiry != expiry.NeverExpire {
+		e.Expiry = metadata.Expiry.Unix()
+	}
+
+	err := webhookDispatcher.Send(e)
+	if err != nil && !Config.noLogs {
+		log.Printf("Could not queue webhook event for %s: %v", filename, err)
+	}
+}
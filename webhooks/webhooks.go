@@ -0,0 +1,332 @@
+// Package webhooks delivers events to HTTP endpoints as signed JSON
+// payloads. Deliveries go through a queue kept on disk, so that those that
+// haven't succeeded yet survive restarts, and failed ones are retried with
+// an exponential backoff.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+)
+
+// Header holding the HMAC-SHA256 of a payload, keyed with the secret
+const SignatureHeader = "Linx-Signature"
+
+// Longest delay between two attempts at a delivery
+const maxRetryDelay = time.Hour
+
+type Event struct {
+	Event        string `json:"event"`
+	Time         int64  `json:"time"`
+	Filename     string `json:"filename"`
+	URL          string `json:"url,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	Mimetype     string `json:"mimetype,omitempty"`
+	Sha256sum    string `json:"sha256sum,omitempty"`
+	Expiry       int64  `json:"expiry,omitempty"`
+	OriginalName string `json:"original_name,omitempty"`
+}
+
+type Options struct {
+	// URLs every event is posted to
+	Targets []string
+	// Key payloads are signed with, which aren't signed when it is empty
+	Secret string
+	// Directory to keep the queue of deliveries in
+	QueuePath string
+	// Number of attempts at a delivery before giving up, defaults to 12
+	MaxAttempts int
+	// Delay before the first retry, which doubles with every retry after
+	// it, defaults to a second
+	RetryDelay time.Duration
+	Client     *http.Client
+	NoLogs     bool
+}
+
+// Delivery of an event to a target, as it is kept in the queue
+type delivery struct {
+	ID       string          `json:"id"`
+	Target   string          `json:"target"`
+	Event    string          `json:"event"`
+	Payload  json.RawMessage `json:"payload"`
+	Attempts int             `json:"attempts"`
+	Next     int64           `json:"next"`
+}
+
+type Dispatcher struct {
+	o       Options
+	mu      sync.Mutex
+	pending map[string]*delivery
+	wake    chan struct{}
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// Make a dispatcher, which starts with the deliveries left in its queue
+func NewDispatcher(o Options) (*Dispatcher, error) {
+	if o.MaxAttempts == 0 {
+		o.MaxAttempts = 12
+	}
+	if o.RetryDelay == 0 {
+		o.RetryDelay = time.Second
+	}
+	if o.Client == nil {
+		o.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	err := os.MkdirAll(o.QueuePath, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dispatcher{
+		o:       o,
+		pending: make(map[string]*delivery),
+		wake:    make(chan struct{}, 1),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	err = d.load()
+	if err != nil {
+		return nil, err
+	}
+
+	go d.run()
+	return d, nil
+}
+
+func (d *Dispatcher) load() error {
+	entries, err := os.ReadDir(d.o.QueuePath)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(d.o.QueuePath, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var dl delivery
+		err = json.Unmarshal(data, &dl)
+		if err != nil || dl.ID+".json" != entry.Name() {
+			d.logf("Ignoring corrupt webhook delivery %s", path)
+			continue
+		}
+		d.pending[dl.ID] = &dl
+	}
+
+	return nil
+}
+
+// Queue an event for delivery to every target
+func (d *Dispatcher) Send(e Event) error {
+	if e.Time == 0 {
+		e.Time = time.Now().Unix()
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	for _, target := range d.o.Targets {
+		dl := &delivery{
+			// IDs sort in the order deliveries were queued
+			ID:      fmt.Sprintf("%020d-%s", time.Now().UnixNano(), uniuri.NewLen(8)),
+			Target:  target,
+			Event:   e.Event,
+			Payload: payload,
+			Next:    time.Now().UnixNano(),
+		}
+
+		err = d.save(dl)
+		if err != nil {
+			return err
+		}
+
+		d.mu.Lock()
+		d.pending[dl.ID] = dl
+		d.mu.Unlock()
+	}
+
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Stop delivering. Deliveries that are left stay in the queue.
+func (d *Dispatcher) Close() {
+	close(d.stop)
+	<-d.done
+}
+
+func (d *Dispatcher) path(dl *delivery) string {
+	return filepath.Join(d.o.QueuePath, dl.ID+".json")
+}
+
+// Write a delivery to the queue, through a temporary file so that it is
+// never left half written
+func (d *Dispatcher) save(dl *delivery) error {
+	data, err := json.Marshal(dl)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(d.o.QueuePath, ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), d.path(dl))
+}
+
+func (d *Dispatcher) remove(dl *delivery) {
+	d.mu.Lock()
+	delete(d.pending, dl.ID)
+	d.mu.Unlock()
+
+	err := os.Remove(d.path(dl))
+	if err != nil && !os.IsNotExist(err) {
+		d.logf("Could not remove webhook delivery %s: %v", dl.ID, err)
+	}
+}
+
+func (d *Dispatcher) run() {
+	defer close(d.done)
+
+	for {
+		wait := d.deliverDue()
+
+		select {
+		case <-d.stop:
+			return
+		case <-d.wake:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Attempt the deliveries that are due, oldest first, and return how long
+// to wait for the next one
+func (d *Dispatcher) deliverDue() time.Duration {
+	now := time.Now().UnixNano()
+	var due []*delivery
+
+	d.mu.Lock()
+	for _, dl := range d.pending {
+		if dl.Next <= now {
+			due = append(due, dl)
+		}
+	}
+	d.mu.Unlock()
+
+	sort.Slice(due, func(i, j int) bool { return due[i].ID < due[j].ID })
+	for _, dl := range due {
+		select {
+		case <-d.stop:
+			return 0
+		default:
+		}
+		d.attempt(dl)
+	}
+
+	wait := maxRetryDelay
+	now = time.Now().UnixNano()
+	d.mu.Lock()
+	for _, dl := range d.pending {
+		wait = min(wait, time.Duration(dl.Next-now))
+	}
+	d.mu.Unlock()
+	return max(wait, 0)
+}
+
+func (d *Dispatcher) attempt(dl *delivery) {
+	err := d.post(dl)
+	if err == nil {
+		d.remove(dl)
+		return
+	}
+
+	dl.Attempts++
+	if dl.Attempts >= d.o.MaxAttempts {
+		d.logf("Giving up on webhook delivery %s to %s: %v", dl.ID, dl.Target, err)
+		d.remove(dl)
+		return
+	}
+
+	delay := min(d.o.RetryDelay<<(dl.Attempts-1), maxRetryDelay)
+	dl.Next = time.Now().Add(delay).UnixNano()
+	err = d.save(dl)
+	if err != nil {
+		d.logf("Could not save webhook delivery %s: %v", dl.ID, err)
+	}
+}
+
+func (d *Dispatcher) post(dl *delivery) error {
+	req, err := http.NewRequest("POST", dl.Target, bytes.NewReader(dl.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Linx-Event", dl.Event)
+	req.Header.Set("Linx-Delivery", dl.ID)
+	if d.o.Secret != "" {
+		req.Header.Set(SignatureHeader, Sign(d.o.Secret, dl.Payload))
+	}
+
+	resp, err := d.o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("target replied %s", resp.Status)
+	}
+	return nil
+}
+
+// Signature of a payload, as sent in the signature header
+func Sign(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (d *Dispatcher) logf(format string, v ...interface{}) {
+	if !d.o.NoLogs {
+		log.Printf(format, v...)
+	}
+}
@@ -0,0 +1,191 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+type receiver struct {
+	mu       sync.Mutex
+	failures int
+	events   []Event
+	received chan struct{}
+}
+
+func newReceiver(t *testing.T, failures int) (*receiver, *httptest.Server) {
+	rcv := &receiver{failures: failures, received: make(chan struct{}, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rcv.mu.Lock()
+		defer rcv.mu.Unlock()
+
+		if rcv.failures > 0 {
+			rcv.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != Sign("secret", body) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		var e Event
+		json.Unmarshal(body, &e)
+		rcv.events = append(rcv.events, e)
+		rcv.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return rcv, server
+}
+
+func (rcv *receiver) wait(t *testing.T) {
+	select {
+	case <-rcv.received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("No event was received")
+	}
+}
+
+func TestDeliveryWithRetries(t *testing.T) {
+	rcv, server := newReceiver(t, 2)
+
+	d, err := NewDispatcher(Options{
+		Targets:    []string{server.URL},
+		Secret:     "secret",
+		QueuePath:  t.TempDir(),
+		RetryDelay: 10 * time.Millisecond,
+		NoLogs:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.Send(Event{Event: "upload", Filename: "a.txt", Size: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rcv.wait(t)
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if len(rcv.events) != 1 || rcv.events[0].Filename != "a.txt" || rcv.events[0].Time == 0 {
+		t.Fatalf("Unexpected events %+v", rcv.events)
+	}
+}
+
+func TestQueueSurvivesRestarts(t *testing.T) {
+	queue := t.TempDir()
+
+	// Nothing listens on a closed server's address
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	d, err := NewDispatcher(Options{
+		Targets:     []string{closed.URL},
+		QueuePath:   queue,
+		MaxAttempts: 100,
+		RetryDelay:  time.Hour,
+		NoLogs:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Send(Event{Event: "delete", Filename: "b.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	d.Close()
+
+	entries, err := os.ReadDir(queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Queue holds %d deliveries instead of 1", len(entries))
+	}
+
+	// Point the delivery at a working target, as if it came back up
+	rcv, server := newReceiver(t, 0)
+	path := queue + "/" + entries[0].Name()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dl delivery
+	err = json.Unmarshal(data, &dl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dl.Attempts != 1 {
+		t.Fatalf("Delivery was attempted %d times", dl.Attempts)
+	}
+	dl.Target = server.URL
+	dl.Next = 0
+	data, _ = json.Marshal(dl)
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d, err = NewDispatcher(Options{QueuePath: queue, Secret: "secret", NoLogs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	rcv.wait(t)
+
+	// The delivery is removed from the queue once it succeeds
+	for i := 0; i < 50; i++ {
+		entries, _ = os.ReadDir(queue)
+		if len(entries) == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Delivered event was left in the queue")
+}
+
+func TestGivingUp(t *testing.T) {
+	rcv, server := newReceiver(t, 100)
+	queue := t.TempDir()
+
+	d, err := NewDispatcher(Options{
+		Targets:     []string{server.URL},
+		QueuePath:   queue,
+		MaxAttempts: 3,
+		RetryDelay:  time.Millisecond,
+		NoLogs:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	err = d.Send(Event{Event: "expire", Filename: "c.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 100; i++ {
+		entries, _ := os.ReadDir(queue)
+		if len(entries) == 0 {
+			rcv.mu.Lock()
+			defer rcv.mu.Unlock()
+			if rcv.failures != 97 {
+				t.Fatalf("Delivery was attempted %d times instead of 3", 100-rcv.failures)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Failing delivery was never given up on")
+}